@@ -0,0 +1,276 @@
+// Command portfolioctl performs bulk maintenance tasks against a running
+// LocalPortfolioManager API server.
+//
+// Usage:
+//
+//	portfolioctl import -portfolio 2 -file statement.csv [-map type=Side,ticker=Symbol] [-confirm]
+//	portfolioctl check [-portfolio 2] [-repair]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"localportfoliomanager/internal/api"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = runImport(os.Args[2:])
+	case "check":
+		err = runCheck(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: portfolioctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  import   Preview or import a CSV file of transactions")
+	fmt.Fprintln(os.Stderr, "  check    Check portfolio ledgers for inconsistencies and optionally repair them")
+}
+
+// runImport previews a CSV import and, with -confirm, commits it
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "API server base URL")
+	portfolioID := fs.Int("portfolio", 0, "Portfolio ID")
+	file := fs.String("file", "", "CSV file to import")
+	mapping := fs.String("map", "", "Column mapping as field=Header pairs, e.g. type=Side,ticker=Symbol")
+	dateFormat := fs.String("date-format", "", "Go date layout of date columns (default 2006-01-02)")
+	delimiter := fs.String("delimiter", "", "CSV field delimiter (default ,)")
+	confirm := fs.Bool("confirm", false, "Commit the import instead of previewing it")
+	skipDuplicates := fs.Bool("skip-duplicates", false, "Leave out rows flagged as duplicates")
+	fs.Parse(args)
+
+	if *portfolioID == 0 || *file == "" {
+		fs.Usage()
+		return fmt.Errorf("-portfolio and -file are required")
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", *file, err)
+	}
+
+	req := api.ImportRequest{
+		CSV:            string(data),
+		Mapping:        make(map[string]string),
+		DateFormat:     *dateFormat,
+		Delimiter:      *delimiter,
+		Confirm:        *confirm,
+		SkipDuplicates: *skipDuplicates,
+	}
+	if *mapping != "" {
+		for _, pair := range strings.Split(*mapping, ",") {
+			field, header, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid mapping %q, expected field=Header", pair)
+			}
+			req.Mapping[strings.TrimSpace(field)] = strings.TrimSpace(header)
+		}
+	}
+
+	var resp api.ImportResponse
+	url := fmt.Sprintf("%s/api/portfolios/%d/transactions/import", strings.TrimRight(*server, "/"), *portfolioID)
+	status, err := postJSON(url, req, &resp)
+	if err != nil {
+		return err
+	}
+
+	printImport(resp)
+
+	if status >= http.StatusBadRequest {
+		return fmt.Errorf("import rejected (HTTP %d)", status)
+	}
+	if resp.Preview {
+		fmt.Println("\nPreview only. Re-run with -confirm to import.")
+	} else {
+		fmt.Printf("\nImported %d transactions.\n", resp.Imported)
+	}
+	return nil
+}
+
+func printImport(resp api.ImportResponse) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROW\tDATE\tTYPE\tTICKER\tSHARES\tPRICE\tAMOUNT\tCASH AFTER\tSHARES AFTER\tSTATUS")
+	for _, row := range resp.Rows {
+		t := row.Transaction
+		status := "ok"
+		switch {
+		case !row.Valid:
+			status = strings.Join(row.Errors, "; ")
+		case row.Skipped:
+			status = "skipped duplicate"
+		case row.Duplicate && row.DuplicateOf != 0:
+			status = fmt.Sprintf("duplicate of transaction %d", row.DuplicateOf)
+		case row.Duplicate:
+			status = fmt.Sprintf("duplicate of row %d", row.DuplicateOfRow)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%.2f\t%.4f\t%.2f\t%.2f\t%.2f\t%s\n",
+			row.Row, t.TransactionAt.Format("2006-01-02"), t.Type, t.Ticker,
+			t.Shares, t.Price, t.Amount, row.CashBalanceAfter, row.SharesCountAfter, status)
+	}
+	w.Flush()
+
+	fmt.Printf("\nValid: %d  Invalid: %d  Duplicates: %d  Projected cash: %.2f\n",
+		resp.Valid, resp.Invalid, resp.Duplicates, resp.CashBalance)
+	if resp.Error != "" {
+		fmt.Printf("Error: %s\n", resp.Error)
+	}
+}
+
+// runCheck prints the integrity report of one or all portfolios and, with
+// -repair, rebuilds the derived tables of those with issues
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "API server base URL")
+	portfolioID := fs.Int("portfolio", 0, "Portfolio ID (default all portfolios)")
+	repair := fs.Bool("repair", false, "Rebuild holdings, lots and balances of portfolios with issues from their transactions")
+	fs.Parse(args)
+
+	base := strings.TrimRight(*server, "/")
+	var reports []api.IntegrityReport
+	if *portfolioID != 0 {
+		var report reportResponse
+		status, err := getJSON(fmt.Sprintf("%s/api/portfolios/%d/integrity", base, *portfolioID), &report)
+		if err != nil {
+			return err
+		}
+		if status >= http.StatusBadRequest {
+			return fmt.Errorf("check failed (HTTP %d): %s", status, report.Error)
+		}
+		reports = append(reports, report.IntegrityReport)
+	} else if _, err := getJSON(base+"/api/integrity", &reports); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, report := range reports {
+		if !report.OK && *repair {
+			var repaired reportResponse
+			url := fmt.Sprintf("%s/api/portfolios/%d/integrity/repair", base, report.PortfolioID)
+			status, err := postJSON(url, struct{}{}, &repaired)
+			if err != nil {
+				return err
+			}
+			if status >= http.StatusBadRequest {
+				printReport(report)
+				fmt.Printf("  Repair failed (HTTP %d): %s\n\n", status, repaired.Error)
+				failed++
+				continue
+			}
+			report = repaired.IntegrityReport
+		}
+		printReport(report)
+		if !report.OK {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		if !*repair {
+			fmt.Println("Re-run with -repair to rebuild the derived tables from the transactions.")
+		}
+		return fmt.Errorf("%d of %d portfolios have issues", failed, len(reports))
+	}
+	return nil
+}
+
+// reportResponse is an integrity report or an error
+type reportResponse struct {
+	api.IntegrityReport
+	Error string `json:"error"`
+}
+
+func printReport(report api.IntegrityReport) {
+	status := "ok"
+	switch {
+	case !report.OK:
+		status = fmt.Sprintf("%d issues", len(report.Issues))
+	case report.Repaired:
+		status = "repaired"
+	}
+	fmt.Printf("Portfolio %d: %d transactions, %s\n", report.PortfolioID, report.Transactions, status)
+	if len(report.Issues) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  CHECK\tTRANSACTION\tTICKER\tCURRENCY\tEXPECTED\tACTUAL\tMESSAGE")
+	for _, issue := range report.Issues {
+		transaction, expected, actual := "", "", ""
+		if issue.TransactionID != 0 {
+			transaction = fmt.Sprint(issue.TransactionID)
+		}
+		if issue.Expected != nil {
+			expected = fmt.Sprintf("%.6f", *issue.Expected)
+		}
+		if issue.Actual != nil {
+			actual = fmt.Sprintf("%.6f", *issue.Actual)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", issue.Check, transaction,
+			issue.Ticker, issue.Currency, expected, actual, issue.Message)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// getJSON fetches url and decodes the JSON response into out
+func getJSON(url string, out interface{}) (int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %v", err)
+	}
+	return decodeResponse(resp, out)
+}
+
+// postJSON sends payload to url and decodes the JSON response into out
+func postJSON(url string, payload, out interface{}) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %v", err)
+	}
+	return decodeResponse(resp, out)
+}
+
+// decodeResponse reads a JSON response into out and returns its status code
+func decodeResponse(resp *http.Response, out interface{}) (int, error) {
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to read response: %v", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("unexpected response (HTTP %d): %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry is one recorded change to a portfolio, transaction, lot or holding
+type AuditEntry struct {
+	ID          int64           `json:"id"`
+	TableName   string          `json:"table_name"`
+	Operation   string          `json:"operation"` // INSERT, UPDATE or DELETE
+	RowID       *int64          `json:"row_id"`
+	PortfolioID *int            `json:"portfolio_id"`
+	Before      json.RawMessage `json:"before"` // null for INSERT
+	After       json.RawMessage `json:"after"`  // null for DELETE
+	ChangedAt   time.Time       `json:"changed_at"`
+	RequestID   string          `json:"request_id,omitempty"`
+	Client      string          `json:"client,omitempty"`
+	DBUser      string          `json:"db_user"`
+}
+
+// auditedTables are the tables whose changes are written to audit_log
+var auditedTables = []string{
+	"portfolios", "portfolio_transactions", "portfolio_stock_lots",
+	"portfolio_holdings", "portfolio_cash_balances", "portfolio_orders",
+}
+
+// beginTx starts a DB transaction tagged with the request ID and client of r.
+// The audit triggers record both with every change made in the transaction.
+func (s *Server) beginTx(r *http.Request) (*sql.Tx, error) {
+	client, _ := r.Context().Value(clientKey).(string)
+	return s.beginTaggedTx(requestID(r), client)
+}
+
+// beginTaggedTx starts a DB transaction tagged with a request ID and client.
+// Background jobs use it to name themselves in the audit log.
+func (s *Server) beginTaggedTx(requestID, client string) (*sql.Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`SELECT set_config('app.request_id', $1, true), set_config('app.client', $2, true)`,
+		requestID, client)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to tag transaction for audit: %v", err)
+	}
+	return tx, nil
+}
+
+// GetAuditLog lists audit entries, newest first. The portfolio route only
+// returns changes to that portfolio.
+func (s *Server) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if id, ok := mux.Vars(r)["id"]; ok {
+		query.Set("portfolio_id", id)
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	for _, param := range []string{"portfolio_id", "row_id"} {
+		if raw := query.Get(param); raw != "" {
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s", param))
+				return
+			}
+			addCondition(param+" = $%d", value)
+		}
+	}
+	if table := query.Get("table"); table != "" {
+		if !containsString(auditedTables, table) {
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid table: %s", table))
+			return
+		}
+		addCondition("table_name = $%d", table)
+	}
+	if operation := strings.ToUpper(query.Get("operation")); operation != "" {
+		addCondition("operation = $%d", operation)
+	}
+	if id := query.Get("request_id"); id != "" {
+		addCondition("request_id = $%d", id)
+	}
+	for param, condition := range map[string]string{"from": "changed_at >= $%d", "to": "changed_at < $%d"} {
+		if raw := query.Get(param); raw != "" {
+			at, err := parseQueryTime(raw)
+			if err != nil {
+				s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s date", param))
+				return
+			}
+			addCondition(condition, at)
+		}
+	}
+
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			s.respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if raw := query.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid offset")
+			return
+		}
+		offset = n
+	}
+
+	sqlQuery := `
+		SELECT id, table_name, operation, row_id, portfolio_id,
+			before, after, changed_at,
+			COALESCE(request_id, ''), COALESCE(client, ''), db_user
+		FROM audit_log`
+	if len(conditions) > 0 {
+		sqlQuery += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += fmt.Sprintf(` ORDER BY id DESC LIMIT %d OFFSET %d`, limit, offset)
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		s.logger.Error("Failed to query audit log: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch audit log")
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		err := rows.Scan(&e.ID, &e.TableName, &e.Operation, &e.RowID, &e.PortfolioID,
+			&before, &after, &e.ChangedAt, &e.RequestID, &e.Client, &e.DBUser)
+		if err != nil {
+			s.logger.Error("Failed to scan audit entry: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch audit log")
+			return
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, e)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, entries)
+}
+
+// parseQueryTime accepts a date or an RFC 3339 timestamp
+func parseQueryTime(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
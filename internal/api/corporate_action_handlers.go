@@ -0,0 +1,628 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Corporate actions change the number of shares held without moving cash.
+// Applying an action inserts a SPLIT transaction into every portfolio that
+// held the ticker before the effective date; replayLedger then scales the
+// open lots and the average cost from that point on.
+//
+// Rights issues are the exception: each portfolio chooses how many of its
+// rights to take up, and every subscription is a RIGHTS transaction that pays
+// the subscription price out of CASH and opens a new lot.
+
+type CorporateActionType string
+
+const (
+	ActionBonus        CorporateActionType = "BONUS"         // ratio_new bonus shares for every ratio_old held
+	ActionSplit        CorporateActionType = "SPLIT"         // ratio_old shares become ratio_new shares
+	ActionReverseSplit CorporateActionType = "REVERSE_SPLIT" // ratio_old shares become ratio_new shares
+	ActionRights       CorporateActionType = "RIGHTS"        // ratio_new new shares offered for every ratio_old held
+)
+
+type CorporateAction struct {
+	ID                int                 `json:"id"`
+	Ticker            string              `json:"ticker"`
+	ActionType        CorporateActionType `json:"action_type"`
+	RatioNew          float64             `json:"ratio_new"`
+	RatioOld          float64             `json:"ratio_old"`
+	EffectiveDate     time.Time           `json:"effective_date"` // record date for rights issues
+	SubscriptionPrice float64             `json:"subscription_price,omitempty"`
+	Notes             string              `json:"notes,omitempty"`
+	AppliedAt         *time.Time          `json:"applied_at,omitempty"`
+	CreatedAt         time.Time           `json:"created_at"`
+}
+
+// Factor returns the number of shares held after the action for each share held before
+func (a *CorporateAction) Factor() float64 {
+	if a.ActionType == ActionBonus {
+		return (a.RatioOld + a.RatioNew) / a.RatioOld
+	}
+	return a.RatioNew / a.RatioOld
+}
+
+// EntitlementRatio returns the rights offered for each share held on the record date
+func (a *CorporateAction) EntitlementRatio() float64 {
+	return a.RatioNew / a.RatioOld
+}
+
+func (a *CorporateAction) Validate() error {
+	if a.Ticker == "" {
+		return fmt.Errorf("ticker is required")
+	}
+	if a.RatioNew <= 0 || a.RatioOld <= 0 {
+		return fmt.Errorf("ratio_new and ratio_old must be positive")
+	}
+	if a.EffectiveDate.IsZero() {
+		return fmt.Errorf("effective_date is required")
+	}
+	switch a.ActionType {
+	case ActionBonus:
+	case ActionSplit:
+		if a.RatioNew <= a.RatioOld {
+			return fmt.Errorf("a split must increase the share count")
+		}
+	case ActionReverseSplit:
+		if a.RatioNew >= a.RatioOld {
+			return fmt.Errorf("a reverse split must decrease the share count")
+		}
+	case ActionRights:
+		if a.SubscriptionPrice <= 0 {
+			return fmt.Errorf("subscription_price is required for a rights issue")
+		}
+	default:
+		return fmt.Errorf("invalid action type: %s", a.ActionType)
+	}
+	return nil
+}
+
+// CorporateActionResult describes the effect of an action on one portfolio
+type CorporateActionResult struct {
+	PortfolioID   int     `json:"portfolio_id"`
+	TransactionID int     `json:"transaction_id"`
+	SharesBefore  float64 `json:"shares_before"`
+	SharesAfter   float64 `json:"shares_after"`
+}
+
+type CorporateActionResponse struct {
+	Action  CorporateAction         `json:"action"`
+	Results []CorporateActionResult `json:"results"`
+}
+
+const corporateActionColumns = `
+	id, ticker, action_type, ratio_new, ratio_old,
+	effective_date, COALESCE(subscription_price, 0), COALESCE(notes, ''),
+	applied_at, created_at`
+
+func scanCorporateAction(row scanner) (CorporateAction, error) {
+	var a CorporateAction
+	err := row.Scan(
+		&a.ID, &a.Ticker, &a.ActionType, &a.RatioNew, &a.RatioOld,
+		&a.EffectiveDate, &a.SubscriptionPrice, &a.Notes,
+		&a.AppliedAt, &a.CreatedAt,
+	)
+	return a, err
+}
+
+// getCorporateAction loads and locks a corporate action
+func (s *Server) getCorporateAction(actionID int, tx *sql.Tx) (CorporateAction, error) {
+	return s.selectCorporateAction(actionID, tx, "FOR UPDATE")
+}
+
+// readCorporateAction is getCorporateAction without the row lock, for
+// read-only transactions
+func (s *Server) readCorporateAction(actionID int, tx *sql.Tx) (CorporateAction, error) {
+	return s.selectCorporateAction(actionID, tx, "")
+}
+
+func (s *Server) selectCorporateAction(actionID int, tx *sql.Tx, locking string) (CorporateAction, error) {
+	return scanCorporateAction(tx.QueryRow(`
+		SELECT `+corporateActionColumns+`
+		FROM corporate_actions
+		WHERE id = $1
+		`+locking, actionID))
+}
+
+// CreateCorporateAction records a bonus issue, split or reverse split
+func (s *Server) CreateCorporateAction(w http.ResponseWriter, r *http.Request) {
+	var action CorporateAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	action.Ticker = strings.ToUpper(strings.TrimSpace(action.Ticker))
+	action.ActionType = CorporateActionType(strings.ToUpper(string(action.ActionType)))
+
+	if err := action.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if err := s.validateTicker(action.Ticker, tx); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	row := tx.QueryRow(`
+		INSERT INTO corporate_actions (
+			ticker, action_type, ratio_new, ratio_old,
+			effective_date, subscription_price, notes
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+corporateActionColumns,
+		action.Ticker, action.ActionType, action.RatioNew, action.RatioOld,
+		action.EffectiveDate, nullIfZero(action.SubscriptionPrice), nullIfEmpty(action.Notes),
+	)
+	created, err := scanCorporateAction(row)
+	if err != nil {
+		s.logger.Error("Failed to create corporate action: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to create corporate action")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, created)
+}
+
+// ListCorporateActions returns corporate actions, optionally filtered by ticker
+func (s *Server) ListCorporateActions(w http.ResponseWriter, r *http.Request) {
+	ticker := strings.ToUpper(r.URL.Query().Get("ticker"))
+
+	rows, err := s.db.Query(`
+		SELECT `+corporateActionColumns+`
+		FROM corporate_actions
+		WHERE $1 = '' OR ticker = $1
+		ORDER BY effective_date DESC, id DESC
+	`, ticker)
+	if err != nil {
+		s.logger.Error("Failed to list corporate actions: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list corporate actions")
+		return
+	}
+	defer rows.Close()
+
+	actions := []CorporateAction{}
+	for rows.Next() {
+		a, err := scanCorporateAction(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan corporate action: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list corporate actions")
+			return
+		}
+		actions = append(actions, a)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, actions)
+}
+
+// ApplyCorporateAction adjusts every portfolio holding the ticker before the
+// effective date. Portfolios that already have the action are left alone, so
+// applying again only picks up holdings recorded since.
+func (s *Server) ApplyCorporateAction(w http.ResponseWriter, r *http.Request) {
+	actionID, err := strconv.Atoi(mux.Vars(r)["actionId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid corporate action ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	action, err := s.getCorporateAction(actionID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Corporate action not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get corporate action %d: %v", actionID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get corporate action")
+		return
+	}
+
+	if action.ActionType == ActionRights {
+		s.respondWithError(w, http.StatusBadRequest, "Rights issues are subscribed per portfolio")
+		return
+	}
+
+	results, err := s.applyCorporateAction(&action, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.QueryRow(`
+		UPDATE corporate_actions SET applied_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING applied_at
+	`, actionID).Scan(&action.AppliedAt); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to update corporate action")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.logger.Info("Applied corporate action %d (%s %s) to %d portfolios",
+		action.ID, action.ActionType, action.Ticker, len(results))
+	s.respondWithJSON(w, http.StatusOK, CorporateActionResponse{Action: action, Results: results})
+}
+
+// applyCorporateAction inserts a SPLIT transaction for the action into each
+// affected portfolio and replays its ledger
+func (s *Server) applyCorporateAction(action *CorporateAction, tx *sql.Tx) ([]CorporateActionResult, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT portfolio_id
+		FROM portfolio_transactions
+		WHERE ticker = $1
+		AND portfolio_id NOT IN (
+			SELECT portfolio_id FROM portfolio_transactions WHERE corporate_action_id = $2
+		)
+		ORDER BY portfolio_id
+	`, action.Ticker, action.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find affected portfolios: %v", err)
+	}
+	var portfolioIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan portfolio ID: %v", err)
+		}
+		portfolioIDs = append(portfolioIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	notes := fmt.Sprintf("%s %s %g:%g", action.ActionType, action.Ticker, action.RatioNew, action.RatioOld)
+	if action.Notes != "" {
+		notes += " - " + action.Notes
+	}
+
+	results := []CorporateActionResult{}
+	for _, portfolioID := range portfolioIDs {
+		// Skip portfolios that did not hold the ticker going into the effective date
+		txns, err := s.loadLedger(portfolioID, tx)
+		if err != nil {
+			return nil, err
+		}
+		lotIDs, err := s.loadLotIDs(portfolioID, tx)
+		if err != nil {
+			return nil, err
+		}
+		method, err := s.getCostBasisMethod(portfolioID, tx)
+		if err != nil {
+			return nil, err
+		}
+		state, err := replayTransactionsWithMethod(txns, lotIDs, method)
+		if err != nil {
+			return nil, err
+		}
+		if state.position(action.Ticker).sharesBefore(action.EffectiveDate) <= ledgerEpsilon {
+			continue
+		}
+
+		var transactionID int
+		err = tx.QueryRow(`
+			INSERT INTO portfolio_transactions (
+				portfolio_id, type, ticker, shares, amount, fee, notes,
+				transaction_at, split_ratio, corporate_action_id
+			) VALUES ($1, $2, $3, 0, 0, 0, $4, $5, $6, $7)
+			RETURNING id
+		`, portfolioID, Split, action.Ticker, notes,
+			action.EffectiveDate, action.Factor(), action.ID,
+		).Scan(&transactionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert split transaction: %v", err)
+		}
+
+		if _, err := s.replayLedger(portfolioID, tx); err != nil {
+			return nil, err
+		}
+
+		t, err := s.getTransaction(portfolioID, transactionID, tx)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, CorporateActionResult{
+			PortfolioID:   portfolioID,
+			TransactionID: transactionID,
+			SharesBefore:  t.SharesCountBefore,
+			SharesAfter:   t.SharesCountAfter,
+		})
+	}
+	return results, nil
+}
+
+// RightsEntitlement is a portfolio's position in a rights issue
+type RightsEntitlement struct {
+	PortfolioID int     `json:"portfolio_id"`
+	SharesHeld  float64 `json:"shares_held"`
+	Entitled    float64 `json:"entitled"`
+	Subscribed  float64 `json:"subscribed"`
+	Remaining   float64 `json:"remaining"`
+	Error       string  `json:"error,omitempty"` // Why the portfolio's ledger could not be replayed
+}
+
+// RightsSubscriptionRequest accepts all or part of a portfolio's rights.
+// Shares defaults to the whole remaining entitlement.
+type RightsSubscriptionRequest struct {
+	Shares        float64   `json:"shares,omitempty"`
+	Fee           float64   `json:"fee,omitempty"`
+	Notes         string    `json:"notes,omitempty"`
+	TransactionAt time.Time `json:"transaction_at,omitempty"`
+}
+
+// rightsEntitlement replays a portfolio's ledger in memory and returns its
+// entitlement to a rights issue. The ledger stays locked until tx ends.
+func (s *Server) rightsEntitlement(portfolioID int, action *CorporateAction, tx *sql.Tx) (RightsEntitlement, error) {
+	txns, err := s.loadLedger(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	lotIDs, err := s.loadLotIDs(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	return replayEntitlement(portfolioID, action, txns, lotIDs, method)
+}
+
+// readRightsEntitlement is rightsEntitlement without row locks, for
+// read-only transactions
+func (s *Server) readRightsEntitlement(portfolioID int, action *CorporateAction, tx *sql.Tx) (RightsEntitlement, error) {
+	txns, err := s.readLedger(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	lotIDs, err := s.readLotIDs(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+	return replayEntitlement(portfolioID, action, txns, lotIDs, method)
+}
+
+// replayEntitlement replays txns (in ledger order) under the portfolio's
+// cost-basis method and returns its entitlement to a rights issue
+func replayEntitlement(portfolioID int, action *CorporateAction, txns []Transaction, lotIDs map[int]int, method CostBasisMethod) (RightsEntitlement, error) {
+	state, err := replayTransactionsWithMethod(txns, lotIDs, method)
+	if err != nil {
+		return RightsEntitlement{}, err
+	}
+
+	held := state.position(action.Ticker).sharesOn(action.EffectiveDate)
+	entitled := rightsEntitled(held, action.EntitlementRatio())
+	subscribed := state.rights[action.ID]
+	return RightsEntitlement{
+		PortfolioID: portfolioID,
+		SharesHeld:  held,
+		Entitled:    entitled,
+		Subscribed:  subscribed,
+		Remaining:   entitled - subscribed,
+	}, nil
+}
+
+// GetRightsEntitlements lists the entitlement of every portfolio that held the
+// ticker on the record date of a rights issue. A portfolio whose ledger cannot
+// be replayed is listed with the error.
+func (s *Server) GetRightsEntitlements(w http.ResponseWriter, r *http.Request) {
+	actionID, err := strconv.Atoi(mux.Vars(r)["actionId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid corporate action ID")
+		return
+	}
+
+	tx, err := s.beginSnapshotTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	action, err := s.readCorporateAction(actionID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Corporate action not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get corporate action %d: %v", actionID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get corporate action")
+		return
+	}
+	if action.ActionType != ActionRights {
+		s.respondWithError(w, http.StatusBadRequest, "Corporate action is not a rights issue")
+		return
+	}
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT portfolio_id
+		FROM portfolio_transactions
+		WHERE ticker = $1 AND transaction_at < $2
+		ORDER BY portfolio_id
+	`, action.Ticker, action.EffectiveDate.AddDate(0, 0, 1))
+	if err != nil {
+		s.logger.Error("Failed to find portfolios for %s: %v", action.Ticker, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get entitlements")
+		return
+	}
+	var portfolioIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to get entitlements")
+			return
+		}
+		portfolioIDs = append(portfolioIDs, id)
+	}
+	rows.Close()
+
+	entitlements := []RightsEntitlement{}
+	for _, portfolioID := range portfolioIDs {
+		entitlement, err := s.readRightsEntitlement(portfolioID, &action, tx)
+		var ledgerErr *LedgerError
+		if errors.As(err, &ledgerErr) {
+			entitlements = append(entitlements, RightsEntitlement{PortfolioID: portfolioID, Error: ledgerErr.Error()})
+			continue
+		}
+		if err != nil {
+			s.logger.Error("Failed to get entitlement of portfolio %d: %v", portfolioID, err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to get entitlements")
+			return
+		}
+		if entitlement.Entitled > 0 {
+			entitlements = append(entitlements, entitlement)
+		}
+	}
+
+	s.respondWithJSON(w, http.StatusOK, entitlements)
+}
+
+// SubscribeRights takes up all or part of a portfolio's rights. The shares are
+// bought at the subscription price into a new lot and paid for out of CASH.
+func (s *Server) SubscribeRights(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+	actionID, err := strconv.Atoi(vars["actionId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid corporate action ID")
+		return
+	}
+
+	var req RightsSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Shares < 0 || req.Fee < 0 {
+		s.respondWithError(w, http.StatusBadRequest, "shares and fee cannot be negative")
+		return
+	}
+	if req.Shares != math.Trunc(req.Shares) {
+		s.respondWithError(w, http.StatusBadRequest, "Rights can only be subscribed in whole shares")
+		return
+	}
+	if req.TransactionAt.IsZero() {
+		req.TransactionAt = time.Now()
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	action, err := s.getCorporateAction(actionID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Corporate action not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get corporate action %d: %v", actionID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get corporate action")
+		return
+	}
+	if action.ActionType != ActionRights {
+		s.respondWithError(w, http.StatusBadRequest, "Corporate action is not a rights issue")
+		return
+	}
+	if !utcDay(req.TransactionAt).After(utcDay(action.EffectiveDate)) {
+		s.respondWithError(w, http.StatusBadRequest, "Rights can only be subscribed after the record date")
+		return
+	}
+
+	entitlement, err := s.rightsEntitlement(portfolioID, &action, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+	if req.Shares == 0 {
+		req.Shares = entitlement.Remaining
+	}
+	if req.Shares <= 0 {
+		s.respondWithError(w, http.StatusBadRequest, "Portfolio has no remaining rights to subscribe")
+		return
+	}
+
+	notes := req.Notes
+	if notes == "" {
+		notes = fmt.Sprintf("Rights issue %s %g:%g at %.4f", action.Ticker, action.RatioNew, action.RatioOld, action.SubscriptionPrice)
+	}
+
+	var transactionID int
+	err = tx.QueryRow(`
+		INSERT INTO portfolio_transactions (
+			portfolio_id, type, ticker, shares, price, amount, fee, notes,
+			transaction_at, ex_date, entitlement_ratio, corporate_action_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`, portfolioID, Rights, action.Ticker, req.Shares, action.SubscriptionPrice,
+		req.Shares*action.SubscriptionPrice+req.Fee, req.Fee, notes,
+		req.TransactionAt, action.EffectiveDate, action.EntitlementRatio(), action.ID,
+	).Scan(&transactionID)
+	if err != nil {
+		s.logger.Error("Failed to insert rights subscription: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to record subscription")
+		return
+	}
+
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	t, err := s.getTransaction(portfolioID, transactionID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get transaction")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, TransactionResponse{Transaction: *t, TotalAmount: t.Amount})
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayEntitlementUsesCostBasisMethod(t *testing.T) {
+	action := CorporateAction{ID: 7, ActionType: ActionRights, Ticker: "BBOB", RatioNew: 1, RatioOld: 4, EffectiveDate: ledgerDay(6)}
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Sell, Ticker: "BBOB", Shares: 1000, Price: 5, TransactionAt: ledgerDay(4)},
+		{ID: 5, Type: Sell, Ticker: "BBOB", Shares: 500, Price: 5, TransactionAt: ledgerDay(5),
+			Lots: []LotSelection{{LotID: 30, Shares: 500}}},
+	}
+	lotIDs := map[int]int{2: 30, 3: 31}
+
+	// Under LIFO the first sale empties the second lot, leaving the first for the selection
+	entitlement, err := replayEntitlement(1, &action, append([]Transaction(nil), txns...), lotIDs, CostBasisLIFO)
+	assert.NoError(t, err)
+	assert.InDelta(t, 500, entitlement.SharesHeld, 0.001)
+	assert.InDelta(t, 125, entitlement.Entitled, 0.001)
+
+	// Under FIFO the first lot is already sold, so the same ledger cannot be replayed
+	_, err = replayEntitlement(1, &action, append([]Transaction(nil), txns...), lotIDs, CostBasisFIFO)
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 5, ledgerErr.TransactionID)
+}
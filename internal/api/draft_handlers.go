@@ -0,0 +1,369 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// DraftStatus is the state of a draft transaction
+type DraftStatus string
+
+const (
+	DraftPending   DraftStatus = "PENDING"   // Waiting for the user
+	DraftConfirmed DraftStatus = "CONFIRMED" // Recorded in the ledger
+	DraftDismissed DraftStatus = "DISMISSED"
+)
+
+// DraftTransaction is a proposed DEPOSIT, BUY or SELL that is not part of
+// the ledger until it is confirmed
+type DraftTransaction struct {
+	ID            int             `json:"id"`
+	PortfolioID   int             `json:"portfolio_id"`
+	PlanID        *int            `json:"plan_id,omitempty"` // Plan that drafted it
+	Type          TransactionType `json:"type"`
+	Ticker        string          `json:"ticker,omitempty"`
+	Shares        float64         `json:"shares,omitempty"`
+	Price         float64         `json:"price,omitempty"`
+	Amount        float64         `json:"amount"` // Estimated cost of a trade, including fees
+	TransactionAt time.Time       `json:"transaction_at"`
+	Status        DraftStatus     `json:"status"`
+	TransactionID *int            `json:"transaction_id,omitempty"`
+	Notes         string          `json:"notes"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// DraftConfirmRequest confirms a draft, optionally changing it to match what
+// was actually done. Omitted fields keep the drafted values.
+type DraftConfirmRequest struct {
+	Shares        float64   `json:"shares"`
+	Price         float64   `json:"price"`
+	Amount        float64   `json:"amount"`        // Of a deposit
+	Fee           *float64  `json:"fee,omitempty"` // Computed from the fee schedule when omitted
+	TransactionAt time.Time `json:"transaction_at"`
+}
+
+// DraftBatchConfirmRequest confirms several drafts as drafted. Without ids
+// every pending draft of the portfolio is confirmed.
+type DraftBatchConfirmRequest struct {
+	IDs []int `json:"ids"`
+}
+
+const draftColumns = `
+	id, portfolio_id, plan_id, type, COALESCE(ticker, ''), COALESCE(shares, 0), COALESCE(price, 0),
+	amount, transaction_at, status, transaction_id, COALESCE(notes, ''), created_at, updated_at`
+
+func scanDraft(row scanner) (DraftTransaction, error) {
+	var d DraftTransaction
+	var planID, transactionID sql.NullInt64
+	err := row.Scan(
+		&d.ID, &d.PortfolioID, &planID, &d.Type, &d.Ticker, &d.Shares, &d.Price,
+		&d.Amount, &d.TransactionAt, &d.Status, &transactionID, &d.Notes, &d.CreatedAt, &d.UpdatedAt,
+	)
+	if planID.Valid {
+		id := int(planID.Int64)
+		d.PlanID = &id
+	}
+	if transactionID.Valid {
+		id := int(transactionID.Int64)
+		d.TransactionID = &id
+	}
+	return d, err
+}
+
+// insertDraft stores a pending draft
+func (s *Server) insertDraft(d DraftTransaction, tx *sql.Tx) error {
+	var planID interface{}
+	if d.PlanID != nil {
+		planID = *d.PlanID
+	}
+	_, err := tx.Exec(`
+		INSERT INTO portfolio_draft_transactions (
+			portfolio_id, plan_id, type, ticker, shares, price, amount, transaction_at, notes
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, d.PortfolioID, planID, d.Type, nullIfEmpty(d.Ticker), nullIfZero(d.Shares), nullIfZero(d.Price),
+		d.Amount, d.TransactionAt, d.Notes)
+	if err != nil {
+		return fmt.Errorf("failed to save draft %s: %v", d.Type, err)
+	}
+	return nil
+}
+
+// getDrafts returns drafts of a portfolio in the order they are confirmed:
+// by date, deposits before the trades they fund. The drafts are locked for
+// the rest of the DB transaction.
+func (s *Server) getDrafts(portfolioID int, ids []int, status DraftStatus, tx *sql.Tx) ([]DraftTransaction, error) {
+	query := `SELECT ` + draftColumns + ` FROM portfolio_draft_transactions WHERE portfolio_id = $1`
+	args := []interface{}{portfolioID}
+	if status != "" {
+		args = append(args, status)
+		query += fmt.Sprintf(` AND status = $%d`, len(args))
+	}
+	if ids != nil {
+		args = append(args, pq.Array(ids))
+		query += fmt.Sprintf(` AND id = ANY($%d)`, len(args))
+	}
+	query += ` ORDER BY id FOR UPDATE`
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drafts: %v", err)
+	}
+	defer rows.Close()
+
+	drafts := []DraftTransaction{}
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan draft: %v", err)
+		}
+		drafts = append(drafts, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(drafts, func(i, j int) bool {
+		if !drafts[i].TransactionAt.Equal(drafts[j].TransactionAt) {
+			return drafts[i].TransactionAt.Before(drafts[j].TransactionAt)
+		}
+		return drafts[i].Type == Deposit && drafts[j].Type != Deposit
+	})
+	return drafts, nil
+}
+
+// confirmDraft records a draft in the ledger and marks it confirmed
+func (s *Server) confirmDraft(d *DraftTransaction, confirm DraftConfirmRequest, tx *sql.Tx) (*DraftTransaction, error) {
+	req := TransactionRequest{
+		Type:          d.Type,
+		Amount:        d.Amount,
+		Fee:           confirm.Fee,
+		Notes:         d.Notes,
+		TransactionAt: d.TransactionAt,
+	}
+	if d.Type != Deposit {
+		req.Ticker, req.Shares, req.Price = d.Ticker, d.Shares, d.Price
+	}
+	if confirm.Shares > 0 {
+		req.Shares = confirm.Shares
+	}
+	if confirm.Price > 0 {
+		req.Price = confirm.Price
+	}
+	if confirm.Amount > 0 {
+		req.Amount = confirm.Amount
+	}
+	if !confirm.TransactionAt.IsZero() {
+		req.TransactionAt = confirm.TransactionAt
+	}
+
+	if err := s.initializePortfolioHoldings(d.PortfolioID, tx); err != nil {
+		return nil, fmt.Errorf("failed to initialize holdings: %v", err)
+	}
+	if _, err := s.chargeFee(d.PortfolioID, &req, tx); err != nil {
+		return nil, err
+	}
+	transaction, err := s.createTransaction(d.PortfolioID, req, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmed, err := scanDraft(tx.QueryRow(`
+		UPDATE portfolio_draft_transactions
+		SET status = $2, transaction_id = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+draftColumns, d.ID, DraftConfirmed, transaction.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark draft %d confirmed: %v", d.ID, err)
+	}
+	return &confirmed, nil
+}
+
+// draftIDs parses the portfolio and draft IDs of a draft route
+func draftIDs(r *http.Request) (int, int, error) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid portfolio ID")
+	}
+	draftID, err := strconv.Atoi(vars["draftId"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid draft ID")
+	}
+	return portfolioID, draftID, nil
+}
+
+// ListDrafts lists the drafts of a portfolio, newest first. The status query
+// parameter limits the list to drafts in that state.
+func (s *Server) ListDrafts(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	query := `SELECT ` + draftColumns + ` FROM portfolio_draft_transactions WHERE portfolio_id = $1`
+	args := []interface{}{portfolioID}
+	if status := strings.ToUpper(r.URL.Query().Get("status")); status != "" {
+		query += ` AND status = $2`
+		args = append(args, status)
+	}
+	query += ` ORDER BY transaction_at DESC, id DESC`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		s.logger.Error("Failed to list drafts: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list drafts")
+		return
+	}
+	defer rows.Close()
+
+	drafts := []DraftTransaction{}
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan draft: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list drafts")
+			return
+		}
+		drafts = append(drafts, d)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, drafts)
+}
+
+// ConfirmDraft records one pending draft in the ledger
+func (s *Server) ConfirmDraft(w http.ResponseWriter, r *http.Request) {
+	portfolioID, draftID, err := draftIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req DraftConfirmRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	drafts, err := s.getDrafts(portfolioID, []int{draftID}, "", tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(drafts) == 0 {
+		s.respondWithError(w, http.StatusNotFound, "Draft not found")
+		return
+	}
+	if drafts[0].Status != DraftPending {
+		s.respondWithError(w, http.StatusConflict, fmt.Sprintf("Draft %d is %s", draftID, drafts[0].Status))
+		return
+	}
+
+	confirmed, err := s.confirmDraft(&drafts[0], req, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, confirmed)
+}
+
+// ConfirmDrafts records several pending drafts in the ledger, all or none
+func (s *Server) ConfirmDrafts(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req DraftBatchConfirmRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	drafts, err := s.getDrafts(portfolioID, req.IDs, DraftPending, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.IDs != nil && len(drafts) != len(req.IDs) {
+		s.respondWithError(w, http.StatusConflict, "Some drafts do not exist or are not pending")
+		return
+	}
+
+	confirmed := []DraftTransaction{}
+	for i := range drafts {
+		d, err := s.confirmDraft(&drafts[i], DraftConfirmRequest{}, tx)
+		if err != nil {
+			s.respondWithLedgerError(w, fmt.Errorf("draft %d: %w", drafts[i].ID, err))
+			return
+		}
+		confirmed = append(confirmed, *d)
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, confirmed)
+}
+
+// DismissDraft discards a pending draft
+func (s *Server) DismissDraft(w http.ResponseWriter, r *http.Request) {
+	portfolioID, draftID, err := draftIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := scanDraft(s.db.QueryRow(`
+		UPDATE portfolio_draft_transactions
+		SET status = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE portfolio_id = $1 AND id = $2 AND status = $4
+		RETURNING `+draftColumns, portfolioID, draftID, DraftDismissed, DraftPending))
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Pending draft not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to dismiss draft: %v", err))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, d)
+}
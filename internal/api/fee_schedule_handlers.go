@@ -0,0 +1,383 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FeeSchedule is a broker's commission schedule. The commission is a
+// percentage of the trade value (shares * price) of BUY and SELL transactions,
+// and the exchange and clearing levies are charged once per trade. Deposit and
+// withdrawal percentages apply to the transaction amount.
+type FeeSchedule struct {
+	ID                 int       `json:"id"`
+	Name               string    `json:"name"`
+	CommissionPercent  float64   `json:"commission_percent"`
+	MinimumCommission  float64   `json:"minimum_commission"`
+	ExchangeLevy       float64   `json:"exchange_levy"`
+	ClearingLevy       float64   `json:"clearing_levy"`
+	DepositFeePercent  float64   `json:"deposit_fee_percent"`
+	DepositFeeFixed    float64   `json:"deposit_fee_fixed"`
+	WithdrawFeePercent float64   `json:"withdraw_fee_percent"`
+	WithdrawFeeFixed   float64   `json:"withdraw_fee_fixed"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// FeeBreakdown itemizes the fee charged on a transaction
+type FeeBreakdown struct {
+	Source       string  `json:"source"` // "schedule" or "manual"
+	ScheduleID   int     `json:"schedule_id,omitempty"`
+	Commission   float64 `json:"commission"`
+	ExchangeLevy float64 `json:"exchange_levy"`
+	ClearingLevy float64 `json:"clearing_levy"`
+	FixedFee     float64 `json:"fixed_fee"`
+	Total        float64 `json:"total"`
+}
+
+func (fs *FeeSchedule) Validate() error {
+	if fs.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	for _, v := range []float64{
+		fs.CommissionPercent, fs.MinimumCommission,
+		fs.ExchangeLevy, fs.ClearingLevy,
+		fs.DepositFeePercent, fs.DepositFeeFixed,
+		fs.WithdrawFeePercent, fs.WithdrawFeeFixed,
+	} {
+		if v < 0 {
+			return fmt.Errorf("fee schedule values cannot be negative")
+		}
+	}
+	return nil
+}
+
+// Compute returns the fee the schedule charges for a transaction. Each
+// component is rounded to the fils, as brokers itemize them on contract notes.
+func (fs *FeeSchedule) Compute(req TransactionRequest) FeeBreakdown {
+	fee := FeeBreakdown{Source: "schedule", ScheduleID: fs.ID}
+
+	switch req.Type {
+	case Buy, Sell:
+		value := req.Shares * req.Price
+		fee.Commission = roundFee(math.Max(value*fs.CommissionPercent/100, fs.MinimumCommission))
+		fee.ExchangeLevy = fs.ExchangeLevy
+		fee.ClearingLevy = fs.ClearingLevy
+	case Deposit:
+		fee.Commission = roundFee(req.Amount * fs.DepositFeePercent / 100)
+		fee.FixedFee = fs.DepositFeeFixed
+	case Withdraw:
+		fee.Commission = roundFee(req.Amount * fs.WithdrawFeePercent / 100)
+		fee.FixedFee = fs.WithdrawFeeFixed
+	}
+
+	fee.Total = roundFee(fee.Commission + fee.ExchangeLevy + fee.ClearingLevy + fee.FixedFee)
+	return fee
+}
+
+func roundFee(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// applyFee fills in the fee of a request that has none from the schedule
+// (no fee without a schedule) and returns how the fee was made up
+func applyFee(schedule *FeeSchedule, req *TransactionRequest) *FeeBreakdown {
+	if req.Fee != nil {
+		return &FeeBreakdown{Source: "manual", Total: *req.Fee}
+	}
+
+	fee := FeeBreakdown{Source: "schedule"}
+	if schedule != nil {
+		fee = schedule.Compute(*req)
+	}
+	req.Fee = &fee.Total
+	return &fee
+}
+
+// chargeFee applies the portfolio's fee schedule to a request without a fee
+func (s *Server) chargeFee(portfolioID int, req *TransactionRequest, tx *sql.Tx) (*FeeBreakdown, error) {
+	if req.Fee != nil {
+		return applyFee(nil, req), nil
+	}
+	schedule, err := s.getPortfolioFeeSchedule(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	return applyFee(schedule, req), nil
+}
+
+const feeScheduleColumns = `
+	id, name, commission_percent, minimum_commission,
+	exchange_levy, clearing_levy,
+	deposit_fee_percent, deposit_fee_fixed,
+	withdraw_fee_percent, withdraw_fee_fixed,
+	created_at, updated_at`
+
+func scanFeeSchedule(row scanner) (FeeSchedule, error) {
+	var fs FeeSchedule
+	err := row.Scan(
+		&fs.ID, &fs.Name, &fs.CommissionPercent, &fs.MinimumCommission,
+		&fs.ExchangeLevy, &fs.ClearingLevy,
+		&fs.DepositFeePercent, &fs.DepositFeeFixed,
+		&fs.WithdrawFeePercent, &fs.WithdrawFeeFixed,
+		&fs.CreatedAt, &fs.UpdatedAt,
+	)
+	return fs, err
+}
+
+// getPortfolioFeeSchedule returns the fee schedule of a portfolio, or nil if it has none
+func (s *Server) getPortfolioFeeSchedule(portfolioID int, tx *sql.Tx) (*FeeSchedule, error) {
+	fs, err := scanFeeSchedule(tx.QueryRow(`
+		SELECT `+feeScheduleColumns+`
+		FROM fee_schedules
+		WHERE id = (SELECT fee_schedule_id FROM portfolios WHERE id = $1)
+	`, portfolioID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee schedule: %v", err)
+	}
+	return &fs, nil
+}
+
+// ListFeeSchedules returns all fee schedules
+func (s *Server) ListFeeSchedules(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`SELECT ` + feeScheduleColumns + ` FROM fee_schedules ORDER BY name`)
+	if err != nil {
+		s.logger.Error("Failed to list fee schedules: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list fee schedules")
+		return
+	}
+	defer rows.Close()
+
+	schedules := []FeeSchedule{}
+	for rows.Next() {
+		fs, err := scanFeeSchedule(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan fee schedule: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list fee schedules")
+			return
+		}
+		schedules = append(schedules, fs)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, schedules)
+}
+
+// CreateFeeSchedule adds a broker fee schedule
+func (s *Server) CreateFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	var fs FeeSchedule
+	if err := json.NewDecoder(r.Body).Decode(&fs); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := fs.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	created, err := scanFeeSchedule(tx.QueryRow(`
+		INSERT INTO fee_schedules (
+			name, commission_percent, minimum_commission,
+			exchange_levy, clearing_levy,
+			deposit_fee_percent, deposit_fee_fixed,
+			withdraw_fee_percent, withdraw_fee_fixed
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+feeScheduleColumns,
+		fs.Name, fs.CommissionPercent, fs.MinimumCommission,
+		fs.ExchangeLevy, fs.ClearingLevy,
+		fs.DepositFeePercent, fs.DepositFeeFixed,
+		fs.WithdrawFeePercent, fs.WithdrawFeeFixed,
+	))
+	if err != nil {
+		s.logger.Error("Failed to create fee schedule: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to create fee schedule")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, created)
+}
+
+// UpdateFeeSchedule replaces a fee schedule. Existing transactions keep the
+// fees they were recorded with.
+func (s *Server) UpdateFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["scheduleId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid fee schedule ID")
+		return
+	}
+
+	var fs FeeSchedule
+	if err := json.NewDecoder(r.Body).Decode(&fs); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := fs.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	updated, err := scanFeeSchedule(tx.QueryRow(`
+		UPDATE fee_schedules
+		SET name = $2, commission_percent = $3, minimum_commission = $4,
+			exchange_levy = $5, clearing_levy = $6,
+			deposit_fee_percent = $7, deposit_fee_fixed = $8,
+			withdraw_fee_percent = $9, withdraw_fee_fixed = $10,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+feeScheduleColumns,
+		id, fs.Name, fs.CommissionPercent, fs.MinimumCommission,
+		fs.ExchangeLevy, fs.ClearingLevy,
+		fs.DepositFeePercent, fs.DepositFeeFixed,
+		fs.WithdrawFeePercent, fs.WithdrawFeeFixed,
+	))
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Fee schedule not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to update fee schedule %d: %v", id, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to update fee schedule")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, updated)
+}
+
+// DeleteFeeSchedule removes a fee schedule; portfolios using it fall back to manual fees
+func (s *Server) DeleteFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["scheduleId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid fee schedule ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM fee_schedules WHERE id = $1`, id)
+	if err != nil {
+		s.logger.Error("Failed to delete fee schedule %d: %v", id, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to delete fee schedule")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		s.respondWithError(w, http.StatusNotFound, "Fee schedule not found")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Fee schedule %d deleted successfully", id),
+	})
+}
+
+// SetPortfolioFeeSchedule selects the fee schedule used for a portfolio's new
+// transactions. A null fee_schedule_id removes it.
+func (s *Server) SetPortfolioFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req struct {
+		FeeScheduleID *int `json:"fee_schedule_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if req.FeeScheduleID != nil {
+		var exists bool
+		err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM fee_schedules WHERE id = $1)`, *req.FeeScheduleID).Scan(&exists)
+		if err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to check fee schedule")
+			return
+		}
+		if !exists {
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Fee schedule %d does not exist", *req.FeeScheduleID))
+			return
+		}
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var portfolio Portfolio
+	err = tx.QueryRow(`
+		UPDATE portfolios
+		SET fee_schedule_id = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
+	`, req.FeeScheduleID, id).Scan(
+		&portfolio.ID,
+		&portfolio.Name,
+		&portfolio.Description,
+		&portfolio.CostBasisMethod,
+		&portfolio.FeeScheduleID,
+		&portfolio.CreatedAt,
+		&portfolio.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to set fee schedule: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to set fee schedule")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, portfolio)
+}
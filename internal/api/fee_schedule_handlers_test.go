@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeScheduleCompute(t *testing.T) {
+	schedule := FeeSchedule{
+		ID:                 3,
+		CommissionPercent:  0.25,
+		MinimumCommission:  5,
+		ExchangeLevy:       0.5,
+		ClearingLevy:       0.1,
+		WithdrawFeePercent: 0.1,
+		WithdrawFeeFixed:   2,
+	}
+
+	// 0.25% of 1,000 is below the minimum commission
+	small := schedule.Compute(TransactionRequest{Type: Buy, Shares: 400, Price: 2.5})
+	assert.Equal(t, 5.0, small.Commission)
+	assert.Equal(t, 0.5, small.ExchangeLevy)
+	assert.Equal(t, 0.1, small.ClearingLevy)
+	assert.Equal(t, 5.6, small.Total)
+	assert.Equal(t, 3, small.ScheduleID)
+
+	large := schedule.Compute(TransactionRequest{Type: Sell, Shares: 10000, Price: 2.5})
+	assert.Equal(t, 62.5, large.Commission)
+	assert.Equal(t, 63.1, large.Total)
+
+	withdraw := schedule.Compute(TransactionRequest{Type: Withdraw, Amount: 1000})
+	assert.Equal(t, 3.0, withdraw.Total)
+
+	dividend := schedule.Compute(TransactionRequest{Type: Dividend, Amount: 1000})
+	assert.Equal(t, 0.0, dividend.Total)
+}
+
+func TestApplyFeeKeepsManualFee(t *testing.T) {
+	schedule := &FeeSchedule{MinimumCommission: 5}
+
+	manual := 1.5
+	req := TransactionRequest{Type: Buy, Shares: 10, Price: 2, Fee: &manual}
+	fee := applyFee(schedule, &req)
+	assert.Equal(t, "manual", fee.Source)
+	assert.Equal(t, 1.5, req.feeAmount())
+
+	req = TransactionRequest{Type: Buy, Shares: 10, Price: 2}
+	fee = applyFee(schedule, &req)
+	assert.Equal(t, "schedule", fee.Source)
+	assert.Equal(t, 5.0, req.feeAmount())
+}
@@ -0,0 +1,425 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// FXRate is the exchange rate between two currencies on a day: one unit of
+// base_currency is worth rate units of quote_currency. A rate applies until
+// the next rate of the pair, and is also used in the opposite direction.
+type FXRate struct {
+	ID            int       `json:"id"`
+	BaseCurrency  string    `json:"base_currency"`
+	QuoteCurrency string    `json:"quote_currency"`
+	RateDate      time.Time `json:"rate_date"`
+	Rate          float64   `json:"rate"`
+	Source        string    `json:"source"` // "manual" or "import"
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// FXRateRequest is the body of a manual rate entry
+type FXRateRequest struct {
+	BaseCurrency  string  `json:"base_currency"`
+	QuoteCurrency string  `json:"quote_currency"`
+	RateDate      string  `json:"rate_date"` // YYYY-MM-DD
+	Rate          float64 `json:"rate"`
+}
+
+// FXRateImportRequest is the body of a CSV rate import. The CSV needs date,
+// base_currency, quote_currency and rate columns.
+type FXRateImportRequest struct {
+	CSV        string `json:"csv"`
+	DateFormat string `json:"date_format,omitempty"` // Go layout, defaults to 2006-01-02
+	Delimiter  string `json:"delimiter,omitempty"`   // defaults to ","
+}
+
+// CashBalance is the cash a portfolio holds in one currency
+type CashBalance struct {
+	Currency  string    `json:"currency"`
+	Balance   float64   `json:"balance"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// parse validates a manual rate entry
+func (r FXRateRequest) parse() (FXRate, error) {
+	rate := FXRate{Rate: r.Rate, Source: "manual"}
+	var err error
+	if r.BaseCurrency == "" || r.QuoteCurrency == "" {
+		return rate, fmt.Errorf("base_currency and quote_currency are required")
+	}
+	if rate.BaseCurrency, err = normalizeCurrency(r.BaseCurrency); err != nil {
+		return rate, err
+	}
+	if rate.QuoteCurrency, err = normalizeCurrency(r.QuoteCurrency); err != nil {
+		return rate, err
+	}
+	if rate.BaseCurrency == rate.QuoteCurrency {
+		return rate, fmt.Errorf("base_currency and quote_currency must differ")
+	}
+	if rate.RateDate, err = time.Parse("2006-01-02", r.RateDate); err != nil {
+		return rate, fmt.Errorf("invalid rate_date: %q", r.RateDate)
+	}
+	if rate.Rate <= 0 {
+		return rate, fmt.Errorf("rate must be positive")
+	}
+	return rate, nil
+}
+
+// parseFXRateCSV reads the rates of a CSV import. All rows must be valid.
+func parseFXRateCSV(req FXRateImportRequest) ([]FXRate, error) {
+	reader := csv.NewReader(strings.NewReader(req.CSV))
+	reader.TrimLeadingSpace = true
+	if req.Delimiter != "" {
+		reader.Comma = []rune(req.Delimiter)[0]
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"date", "base_currency", "quote_currency", "rate"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV has no column for %s", required)
+		}
+	}
+
+	dateFormat := req.DateFormat
+	if dateFormat == "" {
+		dateFormat = "2006-01-02"
+	}
+
+	var rates []FXRate
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", line, err)
+		}
+		value := func(column string) string {
+			if i := columns[column]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		date, err := time.Parse(dateFormat, value("date"))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid date: %q", line, value("date"))
+		}
+		rate, err := strconv.ParseFloat(strings.ReplaceAll(value("rate"), ",", ""), 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid rate: %q", line, value("rate"))
+		}
+		entry, err := FXRateRequest{
+			BaseCurrency:  value("base_currency"),
+			QuoteCurrency: value("quote_currency"),
+			RateDate:      date.Format("2006-01-02"),
+			Rate:          rate,
+		}.parse()
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", line, err)
+		}
+		entry.Source = "import"
+		rates = append(rates, entry)
+	}
+	return rates, nil
+}
+
+const fxRateColumns = `
+	id, base_currency, quote_currency, rate_date, rate, source, created_at, updated_at`
+
+func scanFXRate(row scanner) (FXRate, error) {
+	var rate FXRate
+	err := row.Scan(
+		&rate.ID, &rate.BaseCurrency, &rate.QuoteCurrency, &rate.RateDate,
+		&rate.Rate, &rate.Source, &rate.CreatedAt, &rate.UpdatedAt,
+	)
+	return rate, err
+}
+
+// saveFXRate adds a rate, replacing the rate of the pair on the same day
+func (s *Server) saveFXRate(rate FXRate, tx *sql.Tx) (FXRate, error) {
+	saved, err := scanFXRate(tx.QueryRow(`
+		INSERT INTO fx_rates (base_currency, quote_currency, rate_date, rate, source)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (base_currency, quote_currency, rate_date) DO UPDATE SET
+			rate = EXCLUDED.rate,
+			source = EXCLUDED.source,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING `+fxRateColumns,
+		rate.BaseCurrency, rate.QuoteCurrency, rate.RateDate, rate.Rate, rate.Source))
+	if err != nil {
+		return saved, fmt.Errorf("failed to save %s/%s rate: %v", rate.BaseCurrency, rate.QuoteCurrency, err)
+	}
+	return saved, nil
+}
+
+// getFXRate returns the number of units of to per unit of from in effect at a
+// time: the latest rate of the pair on or before that day, in either
+// direction, as looked up by the fx_rate SQL function
+func (s *Server) getFXRate(from, to string, at time.Time, tx *sql.Tx) (float64, error) {
+	// A missing rate raises an error, which would abort tx without the savepoint
+	if _, err := tx.Exec(`SAVEPOINT fx_rate`); err != nil {
+		return 0, fmt.Errorf("failed to get exchange rate: %v", err)
+	}
+	var rate float64
+	err := tx.QueryRow(`SELECT fx_rate($1, $2, $3)`, from, to, at).Scan(&rate)
+	if isMissingFXRate(err) {
+		if _, rollbackErr := tx.Exec(`ROLLBACK TO SAVEPOINT fx_rate`); rollbackErr != nil {
+			return 0, fmt.Errorf("failed to get exchange rate: %v", rollbackErr)
+		}
+		return 0, fmt.Errorf("%w: %s", ErrInvalidTransaction, fxRateErrorMessage(err))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get exchange rate: %v", err)
+	}
+	if _, err := tx.Exec(`RELEASE SAVEPOINT fx_rate`); err != nil {
+		return 0, fmt.Errorf("failed to get exchange rate: %v", err)
+	}
+	return rate, nil
+}
+
+// isMissingFXRate reports whether a query failed because the fx_rate SQL
+// function found no exchange rate
+func isMissingFXRate(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "P0002"
+}
+
+// fxRateErrorMessage returns the message of a failed fx_rate lookup
+func fxRateErrorMessage(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Message
+	}
+	return err.Error()
+}
+
+// fillExchangeRate gives an FX request without to_amount or exchange_rate
+// the rate in effect on its transaction date
+func (s *Server) fillExchangeRate(req *TransactionRequest, tx *sql.Tx) error {
+	if req.Type != FX || req.ToAmount != 0 || req.ExchangeRate != 0 || req.ToCurrency == "" {
+		return nil
+	}
+	rate, err := s.getFXRate(req.Currency, req.ToCurrency, req.TransactionAt, tx)
+	if err != nil {
+		return err
+	}
+	req.ExchangeRate = rate
+	req.normalize()
+	return nil
+}
+
+// getCashBalances returns the cash a portfolio holds in each currency
+func (s *Server) getCashBalances(portfolioID int) ([]CashBalance, error) {
+	rows, err := s.db.Query(`
+		SELECT currency, balance, updated_at
+		FROM portfolio_cash_balances
+		WHERE portfolio_id = $1
+		ORDER BY currency <> $2, currency
+	`, portfolioID, LedgerCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cash balances: %v", err)
+	}
+	defer rows.Close()
+
+	balances := []CashBalance{}
+	for rows.Next() {
+		var b CashBalance
+		if err := rows.Scan(&b.Currency, &b.Balance, &b.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning cash balance: %v", err)
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// ListFXRates returns exchange rates, newest first
+func (s *Server) ListFXRates(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+	for _, param := range []string{"base_currency", "quote_currency"} {
+		if raw := query.Get(param); raw != "" {
+			currency, err := normalizeCurrency(raw)
+			if err != nil {
+				s.respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			args = append(args, currency)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", param, len(args)))
+		}
+	}
+	for param, condition := range map[string]string{"from": "rate_date >= $%d", "to": "rate_date <= $%d"} {
+		if raw := query.Get(param); raw != "" {
+			date, err := time.Parse("2006-01-02", raw)
+			if err != nil {
+				s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s date", param))
+				return
+			}
+			args = append(args, date)
+			conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+		}
+	}
+
+	sqlQuery := `SELECT ` + fxRateColumns + ` FROM fx_rates`
+	if len(conditions) > 0 {
+		sqlQuery += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += ` ORDER BY rate_date DESC, base_currency, quote_currency`
+
+	rows, err := s.db.Query(sqlQuery, args...)
+	if err != nil {
+		s.logger.Error("Failed to list exchange rates: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list exchange rates")
+		return
+	}
+	defer rows.Close()
+
+	rates := []FXRate{}
+	for rows.Next() {
+		rate, err := scanFXRate(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan exchange rate: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list exchange rates")
+			return
+		}
+		rates = append(rates, rate)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, rates)
+}
+
+// SetFXRate records the exchange rate of a currency pair on a day
+func (s *Server) SetFXRate(w http.ResponseWriter, r *http.Request) {
+	var req FXRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	rate, err := req.parse()
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	saved, err := s.saveFXRate(rate, tx)
+	if err != nil {
+		s.logger.Error("%v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to save exchange rate")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, saved)
+}
+
+// ImportFXRates records the exchange rates of a CSV file in one DB transaction
+func (s *Server) ImportFXRates(w http.ResponseWriter, r *http.Request) {
+	var req FXRateImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	rates, err := parseFXRateCSV(req)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	for _, rate := range rates {
+		if _, err := s.saveFXRate(rate, tx); err != nil {
+			s.logger.Error("%v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to import exchange rates")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]int{"imported": len(rates)})
+}
+
+// DeleteFXRate removes an exchange rate
+func (s *Server) DeleteFXRate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["rateId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid rate ID")
+		return
+	}
+
+	result, err := s.db.Exec(`DELETE FROM fx_rates WHERE id = $1`, id)
+	if err != nil {
+		s.logger.Error("Failed to delete exchange rate %d: %v", id, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to delete exchange rate")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		s.respondWithError(w, http.StatusNotFound, "Exchange rate not found")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Exchange rate %d deleted successfully", id),
+	})
+}
+
+// GetCashBalances returns the cash a portfolio holds in each currency
+func (s *Server) GetCashBalances(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	balances, err := s.getCashBalances(portfolioID)
+	if err != nil {
+		s.logger.Error("%v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get cash balances")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, balances)
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ImportRequest is the body of a CSV transaction import
+type ImportRequest struct {
+	CSV            string            `json:"csv"`
+	Mapping        map[string]string `json:"mapping,omitempty"`     // transaction field -> CSV column header
+	DateFormat     string            `json:"date_format,omitempty"` // Go layout, defaults to 2006-01-02
+	Delimiter      string            `json:"delimiter,omitempty"`   // defaults to ","
+	Confirm        bool              `json:"confirm"`               // false only previews the import
+	SkipDuplicates bool              `json:"skip_duplicates"`       // leave out rows flagged as duplicates
+}
+
+// ImportRowResult describes how a single CSV row would be imported
+type ImportRowResult struct {
+	Row               int                `json:"row"` // line number in the CSV file
+	Transaction       TransactionRequest `json:"transaction"`
+	Valid             bool               `json:"valid"`
+	Errors            []string           `json:"errors,omitempty"`
+	Duplicate         bool               `json:"duplicate"`
+	DuplicateOf       int                `json:"duplicate_of,omitempty"`     // existing transaction id
+	DuplicateOfRow    int                `json:"duplicate_of_row,omitempty"` // earlier row of the same file
+	Skipped           bool               `json:"skipped"`
+	CashBalanceAfter  float64            `json:"cash_balance_after"`
+	SharesCountAfter  float64            `json:"shares_count_after"`
+	RealizedGainFIFO  float64            `json:"realized_gain_fifo,omitempty"`
+	RealizedGain      float64            `json:"realized_gain,omitempty"` // Under the portfolio's cost-basis method
+	ImportedAsID      int                `json:"imported_as_id,omitempty"`
+	projectedLedgerID int
+}
+
+// ImportResponse summarizes a previewed or committed import
+type ImportResponse struct {
+	Preview     bool              `json:"preview"`
+	Rows        []ImportRowResult `json:"rows"`
+	Valid       int               `json:"valid"`
+	Invalid     int               `json:"invalid"`
+	Duplicates  int               `json:"duplicates"`
+	Imported    int               `json:"imported"`
+	CashBalance float64           `json:"projected_cash_balance"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// importFields are the transaction fields that can be mapped to CSV columns
+var importFields = []string{
+	"type", "ticker", "shares", "price", "amount", "fee", "notes",
+	"transaction_at", "dividend_per_share", "withholding_tax", "ex_date",
+	"currency", "to_currency", "to_amount", "exchange_rate",
+}
+
+// parseImportCSV converts CSV rows into transaction requests. Rows that cannot
+// be parsed or fail TransactionRequest.Validate are returned with errors; FX
+// rows that leave the exchange rate to the import are validated there.
+func parseImportCSV(req ImportRequest) ([]ImportRowResult, error) {
+	reader := csv.NewReader(strings.NewReader(req.CSV))
+	reader.TrimLeadingSpace = true
+	if req.Delimiter != "" {
+		reader.Comma = []rune(req.Delimiter)[0]
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	// Resolve field -> column index, defaulting to a header with the field name
+	fieldIndex := make(map[string]int)
+	for _, field := range importFields {
+		name := field
+		if mapped, ok := req.Mapping[field]; ok {
+			name = mapped
+		}
+		if i, ok := columns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			fieldIndex[field] = i
+		}
+	}
+	for _, required := range []string{"type", "transaction_at"} {
+		if _, ok := fieldIndex[required]; !ok {
+			return nil, fmt.Errorf("CSV has no column for %s", required)
+		}
+	}
+
+	dateFormat := req.DateFormat
+	if dateFormat == "" {
+		dateFormat = "2006-01-02"
+	}
+
+	var results []ImportRowResult
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			results = append(results, ImportRowResult{Row: line, Errors: []string{err.Error()}})
+			continue
+		}
+
+		result := ImportRowResult{Row: line}
+		value := func(field string) string {
+			i, ok := fieldIndex[field]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		number := func(field string) float64 {
+			raw := strings.ReplaceAll(value(field), ",", "")
+			if raw == "" {
+				return 0
+			}
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("invalid %s: %q", field, value(field)))
+			}
+			return n
+		}
+		date := func(field string) time.Time {
+			raw := value(field)
+			if raw == "" {
+				return time.Time{}
+			}
+			for _, layout := range []string{dateFormat, time.RFC3339, "2006-01-02"} {
+				if t, err := time.Parse(layout, raw); err == nil {
+					return t
+				}
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("invalid %s: %q", field, raw))
+			return time.Time{}
+		}
+
+		t := TransactionRequest{
+			Type:             TransactionType(strings.ToUpper(value("type"))),
+			Ticker:           strings.ToUpper(value("ticker")),
+			Shares:           number("shares"),
+			Price:            number("price"),
+			Amount:           number("amount"),
+			Notes:            value("notes"),
+			TransactionAt:    date("transaction_at"),
+			DividendPerShare: number("dividend_per_share"),
+			WithholdingTax:   number("withholding_tax"),
+			ExDate:           date("ex_date"),
+			Currency:         value("currency"),
+			ToCurrency:       value("to_currency"),
+			ToAmount:         number("to_amount"),
+			ExchangeRate:     number("exchange_rate"),
+		}
+		if value("fee") != "" {
+			fee := number("fee")
+			t.Fee = &fee
+		}
+		if t.TransactionAt.IsZero() {
+			result.Errors = append(result.Errors, "transaction_at is required")
+		}
+		t.normalize()
+		// FX rows without a rate or to_amount are validated once the import
+		// has looked up the rate on their date
+		if t.Type != FX || t.ExchangeRate != 0 || t.ToAmount != 0 {
+			if err := t.Validate(); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+
+		result.Transaction = t
+		result.Valid = len(result.Errors) == 0
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// importDuplicateKey identifies transactions that look like the same fill
+func importDuplicateKey(t Transaction) string {
+	return fmt.Sprintf("%s|%s|%s|%.4f|%.4f|%.2f|%s",
+		t.Type, t.Ticker, t.TransactionAt.UTC().Format("2006-01-02"),
+		t.Shares, t.Price, t.Amount, t.currency())
+}
+
+// transactionFromRequest builds an unsaved ledger transaction from a request
+func transactionFromRequest(portfolioID, id int, req TransactionRequest) Transaction {
+	t := Transaction{
+		ID:             id,
+		PortfolioID:    portfolioID,
+		Type:           req.Type,
+		Amount:         req.Amount,
+		Fee:            req.feeAmount(),
+		Notes:          req.Notes,
+		TransactionAt:  req.TransactionAt,
+		WithholdingTax: req.WithholdingTax,
+		Currency:       req.Currency,
+		ToCurrency:     req.ToCurrency,
+		ToAmount:       req.ToAmount,
+		ExchangeRate:   req.ExchangeRate,
+		Lots:           req.Lots,
+	}
+	switch req.Type {
+	case Buy, Sell:
+		t.Ticker, t.Shares, t.Price = req.Ticker, req.Shares, req.Price
+	case Dividend:
+		t.Ticker, t.Price = req.Ticker, req.DividendPerShare
+	case Fee, Tax:
+		t.Ticker = req.Ticker
+	}
+	if !req.ExDate.IsZero() {
+		exDate := req.ExDate
+		t.ExDate = &exDate
+	}
+	return t
+}
+
+// ImportTransactions previews or commits a CSV import of transactions.
+// The preview validates every row, flags duplicates against the existing ledger
+// and earlier rows, and projects the balances after each row. A confirmed
+// import inserts all rows in chronological order in a single DB transaction.
+func (s *Server) ImportTransactions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	rows, err := parseImportCSV(req)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	if err := s.initializePortfolioHoldings(portfolioID, tx); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to initialize holdings: %v", err))
+		return
+	}
+
+	ledger, err := s.loadLedger(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	lotIDs, err := s.loadLotIDs(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	schedule, err := s.getPortfolioFeeSchedule(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Validate tickers and flag duplicates
+	existing := make(map[string]int)
+	maxID := 0
+	for _, t := range ledger {
+		existing[importDuplicateKey(t)] = t.ID
+		if t.ID > maxID {
+			maxID = t.ID
+		}
+	}
+	seen := make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+		if !row.Valid {
+			continue
+		}
+		// Rows without a fee column value are charged by the fee schedule, and
+		// FX rows without a rate get the rate in effect on their date
+		if row.Transaction.Fee == nil {
+			applyFee(schedule, &row.Transaction)
+		}
+		row.Transaction.normalize()
+		err := s.fillExchangeRate(&row.Transaction, tx)
+		if err != nil && !errors.Is(err, ErrInvalidTransaction) {
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("row %d: %v", row.Row, err))
+			return
+		}
+		if err == nil {
+			err = row.Transaction.Validate()
+		}
+		if err != nil {
+			row.Errors = append(row.Errors, err.Error())
+			row.Valid = false
+			continue
+		}
+		if row.Transaction.Ticker != "" {
+			if err := s.validateTicker(row.Transaction.Ticker, tx); err != nil {
+				row.Errors = append(row.Errors, err.Error())
+				row.Valid = false
+				continue
+			}
+		}
+		key := importDuplicateKey(transactionFromRequest(portfolioID, 0, row.Transaction))
+		if id, ok := existing[key]; ok {
+			row.Duplicate, row.DuplicateOf = true, id
+		} else if earlier, ok := seen[key]; ok {
+			row.Duplicate, row.DuplicateOfRow = true, earlier
+		} else {
+			seen[key] = row.Row
+		}
+		row.Skipped = row.Duplicate && req.SkipDuplicates
+	}
+
+	// Project balances by replaying the ledger with the new rows
+	response := ImportResponse{Preview: !req.Confirm}
+	projected := append([]Transaction(nil), ledger...)
+	rowsByLedgerID := make(map[int]*ImportRowResult)
+	for i := range rows {
+		row := &rows[i]
+		if !row.Valid || row.Skipped {
+			continue
+		}
+		row.projectedLedgerID = maxID + 1 + i
+		rowsByLedgerID[row.projectedLedgerID] = row
+		projected = append(projected, transactionFromRequest(portfolioID, row.projectedLedgerID, row.Transaction))
+	}
+	sortLedger(projected)
+
+	state, err := replayTransactionsWithMethod(projected, lotIDs, method)
+	var ledgerErr *LedgerError
+	switch {
+	case errors.As(err, &ledgerErr):
+		if row, ok := rowsByLedgerID[ledgerErr.TransactionID]; ok {
+			row.Errors = append(row.Errors, ledgerErr.Message)
+			row.Valid = false
+		} else {
+			response.Error = fmt.Sprintf("import would make existing %s", ledgerErr.Error())
+		}
+	case err != nil:
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	default:
+		response.CashBalance = state.Cash
+		for _, t := range projected {
+			if row, ok := rowsByLedgerID[t.ID]; ok {
+				row.CashBalanceAfter = t.CashBalanceAfter
+				row.SharesCountAfter = t.SharesCountAfter
+				row.RealizedGainFIFO = t.RealizedGainFIFO
+				row.RealizedGain = t.RealizedGain
+			}
+		}
+	}
+
+	for _, row := range rows {
+		if row.Valid {
+			response.Valid++
+		} else {
+			response.Invalid++
+		}
+		if row.Duplicate {
+			response.Duplicates++
+		}
+	}
+	response.Rows = rows
+
+	if !req.Confirm {
+		s.respondWithJSON(w, http.StatusOK, response)
+		return
+	}
+	if response.Invalid > 0 || response.Error != "" {
+		s.respondWithJSON(w, http.StatusBadRequest, response)
+		return
+	}
+
+	// Commit all rows in chronological order, keeping file order for equal timestamps
+	pending := make([]*ImportRowResult, 0, len(rows))
+	for i := range response.Rows {
+		if !response.Rows[i].Skipped {
+			pending = append(pending, &response.Rows[i])
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Transaction.TransactionAt.Before(pending[j].Transaction.TransactionAt)
+	})
+	for _, row := range pending {
+		id, err := s.insertTransaction(portfolioID, row.Transaction, tx)
+		if err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("row %d: %v", row.Row, err))
+			return
+		}
+		row.ImportedAsID = id
+	}
+
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	response.Imported = len(pending)
+	s.logger.Info("Imported %d transactions into portfolio %d", response.Imported, portfolioID)
+	s.respondWithJSON(w, http.StatusCreated, response)
+}
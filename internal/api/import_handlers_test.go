@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImportCSVWithMapping(t *testing.T) {
+	req := ImportRequest{
+		CSV: "Date;Side;Symbol;Qty;Rate;Commission\n" +
+			"05/02/2024;buy;bbob;1,000;2.5;10\n" +
+			"06/02/2024;SELL;BBOB;-5;2.5;0\n",
+		Mapping: map[string]string{
+			"transaction_at": "Date",
+			"type":           "Side",
+			"ticker":         "Symbol",
+			"shares":         "Qty",
+			"price":          "Rate",
+			"fee":            "Commission",
+		},
+		DateFormat: "02/01/2006",
+		Delimiter:  ";",
+	}
+
+	rows, err := parseImportCSV(req)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	buy := rows[0]
+	assert.True(t, buy.Valid)
+	assert.Equal(t, 2, buy.Row)
+	assert.Equal(t, Buy, buy.Transaction.Type)
+	assert.Equal(t, "BBOB", buy.Transaction.Ticker)
+	assert.InDelta(t, 1000, buy.Transaction.Shares, 0.001)
+	assert.InDelta(t, 2510, buy.Transaction.Amount, 0.001)
+	assert.Equal(t, "2024-02-05", buy.Transaction.TransactionAt.Format("2006-01-02"))
+
+	assert.False(t, rows[1].Valid)
+	assert.NotEmpty(t, rows[1].Errors)
+}
+
+func TestParseImportCSVRequiresDateAndType(t *testing.T) {
+	_, err := parseImportCSV(ImportRequest{CSV: "ticker,shares\nBBOB,10\n"})
+	assert.Error(t, err)
+}
+
+func TestParseImportCSVLeavesFXRateToImport(t *testing.T) {
+	rows, err := parseImportCSV(ImportRequest{
+		CSV: "type,amount,currency,to_currency,exchange_rate,transaction_at\n" +
+			"FX,400,USD,IQD,,2024-02-05\n" +
+			"FX,400,USD,,1310,2024-02-05\n",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	assert.True(t, rows[0].Valid, "the rate on the transaction date is looked up by the import")
+	assert.Zero(t, rows[0].Transaction.ExchangeRate)
+
+	assert.False(t, rows[1].Valid)
+	assert.NotEmpty(t, rows[1].Errors)
+}
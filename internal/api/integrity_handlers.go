@@ -0,0 +1,396 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Checks performed by checkLedger
+const (
+	CheckCashChain      = "cash_chain"      // cash_balance_before differs from the previous cash_balance_after
+	CheckSharesChain    = "shares_chain"    // shares_count_before differs from the previous shares_count_after
+	CheckNegativeCash   = "negative_cash"   // a stored running cash balance is negative
+	CheckNegativeShares = "negative_shares" // a stored running share count is negative
+	CheckReplay         = "replay"          // the transactions cannot be replayed
+	CheckRunningBalance = "running_balance" // stored running balances differ from the replay
+	CheckHolding        = "holding"         // portfolio_holdings differs from the replay
+	CheckCashBalance    = "cash_balance"    // portfolio_cash_balances differs from the replay
+	CheckLotShares      = "lot_shares"      // remaining lot shares differ from the holding
+)
+
+// integrityCashEpsilon allows for cash being stored to the cent
+const integrityCashEpsilon = 0.01
+
+// IntegrityIssue is one inconsistency found in a portfolio's stored ledger
+type IntegrityIssue struct {
+	Check         string   `json:"check"`
+	TransactionID int      `json:"transaction_id,omitempty"`
+	Ticker        string   `json:"ticker,omitempty"`
+	Currency      string   `json:"currency,omitempty"`
+	Expected      *float64 `json:"expected,omitempty"`
+	Actual        *float64 `json:"actual,omitempty"`
+	Message       string   `json:"message"`
+}
+
+// IntegrityReport is the result of checking a portfolio's derived tables
+// against its transactions
+type IntegrityReport struct {
+	PortfolioID  int              `json:"portfolio_id"`
+	CheckedAt    time.Time        `json:"checked_at"`
+	Transactions int              `json:"transactions"`
+	OK           bool             `json:"ok"`
+	Repaired     bool             `json:"repaired,omitempty"`
+	Issues       []IntegrityIssue `json:"issues"`
+}
+
+// storedLedger holds the derived balances of a portfolio as stored
+type storedLedger struct {
+	Holdings     map[string]float64 // ticker -> shares, CASH included
+	CashBalances map[string]float64 // currency -> balance
+	LotShares    map[string]float64 // ticker -> remaining shares of its lots
+}
+
+// checkLedger compares the stored running balances of txns (in ledger order)
+// and the stored holdings, cash balances and lots with a fresh replay. lotIDs
+// maps BUY transactions to their stored lots, which specific-lot sales select.
+func checkLedger(txns []Transaction, lotIDs map[int]int, method CostBasisMethod, stored storedLedger) []IntegrityIssue {
+	issues := []IntegrityIssue{}
+	mismatch := func(issue IntegrityIssue, expected, actual float64) {
+		issue.Expected, issue.Actual = &expected, &actual
+		issues = append(issues, issue)
+	}
+
+	// The running columns must chain from one transaction to the next
+	cash := make(map[string]float64)
+	shares := make(map[string]float64)
+	for _, t := range txns {
+		currency := t.currency()
+		if math.Abs(t.CashBalanceBefore-cash[currency]) > integrityCashEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckCashChain, TransactionID: t.ID, Currency: currency,
+				Message: fmt.Sprintf("%s balance before does not follow the previous transaction", currency),
+			}, cash[currency], t.CashBalanceBefore)
+		}
+		if t.CashBalanceAfter < -integrityCashEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckNegativeCash, TransactionID: t.ID, Currency: currency,
+				Message: fmt.Sprintf("%s balance is negative after this transaction", currency),
+			}, 0, t.CashBalanceAfter)
+		}
+		cash[currency] = t.CashBalanceAfter
+		if t.Type == FX {
+			cash[t.ToCurrency] += t.ToAmount
+		}
+
+		if t.Ticker == "" || t.Type.isIncomeOrExpense() {
+			continue
+		}
+		if math.Abs(t.SharesCountBefore-shares[t.Ticker]) > ledgerEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckSharesChain, TransactionID: t.ID, Ticker: t.Ticker,
+				Message: fmt.Sprintf("%s shares before do not follow the previous transaction", t.Ticker),
+			}, shares[t.Ticker], t.SharesCountBefore)
+		}
+		if t.SharesCountAfter < -ledgerEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckNegativeShares, TransactionID: t.ID, Ticker: t.Ticker,
+				Message: fmt.Sprintf("%s shares are negative after this transaction", t.Ticker),
+			}, 0, t.SharesCountAfter)
+		}
+		shares[t.Ticker] = t.SharesCountAfter
+	}
+
+	// Remaining lot shares must add up to the holding
+	for _, ticker := range sortedKeys(stored.LotShares, stored.Holdings) {
+		if ticker == "CASH" {
+			continue
+		}
+		if math.Abs(stored.LotShares[ticker]-stored.Holdings[ticker]) > ledgerEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckLotShares, Ticker: ticker,
+				Message: fmt.Sprintf("remaining shares of %s lots do not match the holding", ticker),
+			}, stored.Holdings[ticker], stored.LotShares[ticker])
+		}
+	}
+
+	replayed := append([]Transaction(nil), txns...)
+	state, err := replayTransactionsWithMethod(replayed, lotIDs, method)
+	if err != nil {
+		issue := IntegrityIssue{Check: CheckReplay, Message: err.Error()}
+		var ledgerErr *LedgerError
+		if errors.As(err, &ledgerErr) {
+			issue.TransactionID, issue.Message = ledgerErr.TransactionID, ledgerErr.Message
+		}
+		return append(issues, issue)
+	}
+
+	for i, t := range replayed {
+		if math.Abs(t.CashBalanceAfter-txns[i].CashBalanceAfter) > integrityCashEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckRunningBalance, TransactionID: t.ID, Currency: t.currency(),
+				Message: "stored cash balance after differs from the replay",
+			}, t.CashBalanceAfter, txns[i].CashBalanceAfter)
+		}
+		if math.Abs(t.SharesCountAfter-txns[i].SharesCountAfter) > ledgerEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckRunningBalance, TransactionID: t.ID, Ticker: t.Ticker,
+				Message: "stored shares count after differs from the replay",
+			}, t.SharesCountAfter, txns[i].SharesCountAfter)
+		}
+	}
+
+	expected := map[string]float64{"CASH": state.Cash}
+	for ticker, pos := range state.Positions {
+		expected[ticker] = pos.Shares
+	}
+	for _, ticker := range sortedKeys(expected, stored.Holdings) {
+		epsilon := ledgerEpsilon
+		if ticker == "CASH" {
+			epsilon = integrityCashEpsilon
+		}
+		if math.Abs(expected[ticker]-stored.Holdings[ticker]) > epsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckHolding, Ticker: ticker,
+				Message: fmt.Sprintf("%s holding does not equal the sum of its transactions", ticker),
+			}, expected[ticker], stored.Holdings[ticker])
+		}
+	}
+
+	balances := state.cashBalances()
+	for _, currency := range sortedKeys(balances, stored.CashBalances) {
+		if math.Abs(balances[currency]-stored.CashBalances[currency]) > integrityCashEpsilon {
+			mismatch(IntegrityIssue{
+				Check: CheckCashBalance, Currency: currency,
+				Message: fmt.Sprintf("%s cash balance does not equal the sum of its transactions", currency),
+			}, balances[currency], stored.CashBalances[currency])
+		}
+	}
+
+	return issues
+}
+
+// sortedKeys returns the keys of all maps, sorted and without duplicates
+func sortedKeys(maps ...map[string]float64) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadStoredLedger reads the holdings, cash balances and lot totals of a portfolio
+func (s *Server) loadStoredLedger(portfolioID int, tx *sql.Tx) (storedLedger, error) {
+	stored := storedLedger{
+		Holdings:     make(map[string]float64),
+		CashBalances: make(map[string]float64),
+		LotShares:    make(map[string]float64),
+	}
+
+	queries := []struct {
+		query  string
+		values map[string]float64
+	}{
+		{`SELECT ticker, shares FROM portfolio_holdings WHERE portfolio_id = $1`, stored.Holdings},
+		{`SELECT currency, balance FROM portfolio_cash_balances WHERE portfolio_id = $1`, stored.CashBalances},
+		{`SELECT ticker, SUM(remaining_shares) FROM portfolio_stock_lots WHERE portfolio_id = $1 GROUP BY ticker`, stored.LotShares},
+	}
+	for _, q := range queries {
+		rows, err := tx.Query(q.query, portfolioID)
+		if err != nil {
+			return stored, fmt.Errorf("failed to load stored ledger: %v", err)
+		}
+		for rows.Next() {
+			var key string
+			var value float64
+			if err := rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return stored, fmt.Errorf("error scanning stored ledger: %v", err)
+			}
+			q.values[key] = value
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return stored, fmt.Errorf("failed to load stored ledger: %v", err)
+		}
+	}
+	return stored, nil
+}
+
+// beginSnapshotTx starts a read-only transaction that sees one snapshot of
+// the database, so a check does not block writers or see them half done
+func (s *Server) beginSnapshotTx(r *http.Request) (*sql.Tx, error) {
+	return s.db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+}
+
+// checkPortfolio builds the integrity report of a portfolio
+func (s *Server) checkPortfolio(portfolioID int, tx *sql.Tx) (*IntegrityReport, error) {
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	txns, err := s.readLedger(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	lotIDs, err := s.readLotIDs(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.loadStoredLedger(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := checkLedger(txns, lotIDs, method, stored)
+	return &IntegrityReport{
+		PortfolioID:  portfolioID,
+		CheckedAt:    time.Now(),
+		Transactions: len(txns),
+		OK:           len(issues) == 0,
+		Issues:       issues,
+	}, nil
+}
+
+// CheckPortfolioIntegrity reports inconsistencies between a portfolio's
+// transactions and its holdings, cash balances, lots and running balances
+func (s *Server) CheckPortfolioIntegrity(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	tx, err := s.beginSnapshotTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	report, err := s.checkPortfolio(portfolioID, tx)
+	if err != nil {
+		s.logger.Error("Integrity check of portfolio %d failed: %v", portfolioID, err)
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, report)
+}
+
+// CheckIntegrity reports on every portfolio
+func (s *Server) CheckIntegrity(w http.ResponseWriter, r *http.Request) {
+	tx, err := s.beginSnapshotTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM portfolios ORDER BY id`)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list portfolios")
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list portfolios")
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	reports := []IntegrityReport{}
+	for _, id := range ids {
+		report, err := s.checkPortfolio(id, tx)
+		if err != nil {
+			s.logger.Error("Integrity check of portfolio %d failed: %v", id, err)
+			s.respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		reports = append(reports, *report)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, reports)
+}
+
+// RepairPortfolio rebuilds the running balances, lots, lot matches, holdings,
+// cash balances and cost basis of a portfolio from its transactions and
+// returns the integrity report after the repair. A history that cannot be
+// replayed is left untouched; its transactions have to be corrected first.
+func (s *Server) RepairPortfolio(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	report, err := s.checkPortfolio(portfolioID, tx)
+	if err != nil {
+		s.logger.Error("Integrity check of portfolio %d failed: %v", portfolioID, err)
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	report.Repaired = true
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.logger.Info("Repaired ledger of portfolio %d", portfolioID)
+	s.respondWithJSON(w, http.StatusOK, report)
+}
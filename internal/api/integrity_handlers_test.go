@@ -0,0 +1,68 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLedger(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Sell, Ticker: "BBOB", Shares: 400, Price: 3, TransactionAt: ledgerDay(3)},
+	}
+	_, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+
+	consistent := func() storedLedger {
+		return storedLedger{
+			Holdings:     map[string]float64{"CASH": 9200, "BBOB": 600},
+			CashBalances: map[string]float64{"IQD": 9200},
+			LotShares:    map[string]float64{"BBOB": 600},
+		}
+	}
+	assert.Empty(t, checkLedger(txns, nil, CostBasisFIFO, consistent()))
+
+	stored := consistent()
+	stored.Holdings["BBOB"] = 1000
+	checks := func(issues []IntegrityIssue) []string {
+		var names []string
+		for _, issue := range issues {
+			names = append(names, issue.Check)
+		}
+		return names
+	}
+	assert.Equal(t, []string{CheckLotShares, CheckHolding}, checks(checkLedger(txns, nil, CostBasisFIFO, stored)))
+
+	// A transaction deleted without a replay leaves a gap and an impossible sale
+	broken := []Transaction{txns[0], txns[2]}
+	issues := checkLedger(broken, nil, CostBasisFIFO, consistent())
+	assert.Equal(t, []string{CheckCashChain, CheckSharesChain, CheckReplay}, checks(issues))
+	assert.Equal(t, 3, issues[2].TransactionID)
+}
+
+func TestCheckLedgerSpecificLots(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Sell, Ticker: "BBOB", Shares: 500, Price: 5, TransactionAt: ledgerDay(4),
+			Lots: []LotSelection{{LotID: 31, Shares: 500}}},
+	}
+	lotIDs := map[int]int{2: 30, 3: 31}
+	_, err := replayTransactions(txns, lotIDs)
+	assert.NoError(t, err)
+
+	stored := storedLedger{
+		Holdings:     map[string]float64{"CASH": 6500, "BBOB": 1500},
+		CashBalances: map[string]float64{"IQD": 6500},
+		LotShares:    map[string]float64{"BBOB": 1500},
+	}
+	assert.Empty(t, checkLedger(txns, lotIDs, CostBasisFIFO, stored))
+
+	// Without the stored lot ids the selected lot cannot be found
+	issues := checkLedger(txns, nil, CostBasisFIFO, stored)
+	assert.NotEmpty(t, issues)
+	assert.Equal(t, CheckReplay, issues[0].Check)
+}
@@ -0,0 +1,1155 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The ledger is the ordered list of portfolio_transactions for a portfolio.
+// Everything else (running balances on each transaction, portfolio_stock_lots,
+// portfolio_holdings and realized gains) is derived from it, so after any change
+// to the ledger the whole portfolio is replayed in transaction_at order and the
+// derived tables are rewritten inside the same DB transaction.
+
+// ledgerEpsilon absorbs floating point noise when checking for negative balances
+const ledgerEpsilon = 0.000001
+
+// ErrInvalidTransaction wraps request validation failures so handlers can
+// answer with 400 instead of 500
+var ErrInvalidTransaction = errors.New("invalid transaction")
+
+// LedgerError reports a point in the replayed history that is not possible,
+// such as selling shares that are not held or spending cash that is not there
+type LedgerError struct {
+	TransactionID int
+	TransactionAt time.Time
+	Message       string
+}
+
+func (e *LedgerError) Error() string {
+	return fmt.Sprintf("transaction %d on %s: %s",
+		e.TransactionID, e.TransactionAt.Format("2006-01-02"), e.Message)
+}
+
+// ledgerLot is an open or closed purchase lot rebuilt during replay
+type ledgerLot struct {
+	ID              int // existing portfolio_stock_lots id, 0 if new
+	TransactionID   int
+	Ticker          string
+	Shares          float64
+	RemainingShares float64
+	PurchasePrice   float64
+	PurchaseDate    time.Time
+}
+
+// sharesPoint records the share count of a position after a transaction
+type sharesPoint struct {
+	at     time.Time
+	shares float64
+}
+
+// ledgerPosition is the replayed state of a single ticker
+type ledgerPosition struct {
+	Ticker      string
+	Shares      float64
+	AverageCost float64
+	LastPrice   float64
+	LastDate    time.Time
+	Lots        []*ledgerLot
+	history     []sharesPoint
+}
+
+// sharesBefore returns the shares held strictly before the given time
+func (p *ledgerPosition) sharesBefore(t time.Time) float64 {
+	shares := 0.0
+	for _, point := range p.history {
+		if !point.at.Before(t) {
+			break
+		}
+		shares = point.shares
+	}
+	return shares
+}
+
+// sharesOn returns the shares held at the end of the given day
+func (p *ledgerPosition) sharesOn(day time.Time) float64 {
+	return p.sharesBefore(day.AddDate(0, 0, 1))
+}
+
+// lotCost returns the weighted average purchase price of the remaining lots
+func (p *ledgerPosition) lotCost() float64 {
+	var shares, cost float64
+	for _, lot := range p.Lots {
+		shares += lot.RemainingShares
+		cost += lot.RemainingShares * lot.PurchasePrice
+	}
+	if shares <= ledgerEpsilon {
+		return 0
+	}
+	return cost / shares
+}
+
+func (p *ledgerPosition) record(at time.Time) {
+	p.history = append(p.history, sharesPoint{at: at, shares: p.Shares})
+}
+
+// costBasis returns the cost of the shares held under a cost-basis method
+func (p *ledgerPosition) costBasis(method CostBasisMethod) float64 {
+	if method == CostBasisAverage {
+		return p.Shares * p.AverageCost
+	}
+	return p.Shares * p.lotCost()
+}
+
+// lotStrategy orders the lots of a position in the order a sale consumes them
+type lotStrategy func(lots []*ledgerLot) []*ledgerLot
+
+// lotsOldestFirst orders lots by purchase date. Lots are opened in ledger
+// order, except that shares transferred in keep their original purchase date.
+func lotsOldestFirst(lots []*ledgerLot) []*ledgerLot {
+	ordered := append([]*ledgerLot(nil), lots...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].PurchaseDate.Before(ordered[j].PurchaseDate)
+	})
+	return ordered
+}
+
+func lotsNewestFirst(lots []*ledgerLot) []*ledgerLot {
+	oldest := lotsOldestFirst(lots)
+	ordered := make([]*ledgerLot, len(oldest))
+	for i, lot := range oldest {
+		ordered[len(oldest)-1-i] = lot
+	}
+	return ordered
+}
+
+func lotsHighestCostFirst(lots []*ledgerLot) []*ledgerLot {
+	ordered := append([]*ledgerLot(nil), lots...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].PurchasePrice > ordered[j].PurchasePrice
+	})
+	return ordered
+}
+
+func (m CostBasisMethod) lotStrategy() lotStrategy {
+	switch m {
+	case CostBasisLIFO:
+		return lotsNewestFirst
+	case CostBasisHIFO:
+		return lotsHighestCostFirst
+	default:
+		return lotsOldestFirst
+	}
+}
+
+// ledgerState is the result of replaying a portfolio ledger
+type ledgerState struct {
+	Cash        float64            // in LedgerCurrency
+	ForeignCash map[string]float64 // other currencies
+	Positions   map[string]*ledgerPosition
+	Tickers     []string // in order of first appearance
+	Method      CostBasisMethod
+
+	lotIDs  map[int]int     // transaction id -> existing lot id
+	rights  map[int]float64 // corporate action id -> rights shares subscribed
+	matches []ledgerMatch
+}
+
+// ledgerMatch records the shares of a lot consumed by a sale
+type ledgerMatch struct {
+	SaleTransactionID int
+	Lot               *ledgerLot
+	Shares            float64
+	PurchasePrice     float64 // lot price at the time of the sale
+	SalePrice         float64
+	Specified         bool
+}
+
+func (m ledgerMatch) realizedGain() float64 {
+	return m.Shares * (m.SalePrice - m.PurchasePrice)
+}
+
+func newLedgerState(lotIDs map[int]int, method CostBasisMethod) *ledgerState {
+	if lotIDs == nil {
+		lotIDs = make(map[int]int)
+	}
+	return &ledgerState{
+		Method:      method,
+		ForeignCash: make(map[string]float64),
+		Positions:   make(map[string]*ledgerPosition),
+		lotIDs:      lotIDs,
+		rights:      make(map[int]float64),
+	}
+}
+
+// balance returns the cash held in a currency
+func (st *ledgerState) balance(currency string) float64 {
+	if currency == "" || currency == LedgerCurrency {
+		return st.Cash
+	}
+	return st.ForeignCash[currency]
+}
+
+// addCash changes the cash held in a currency
+func (st *ledgerState) addCash(currency string, amount float64) {
+	if currency == "" || currency == LedgerCurrency {
+		st.Cash += amount
+		return
+	}
+	st.ForeignCash[currency] += amount
+}
+
+// cashBalances returns the cash held in every currency that was used
+func (st *ledgerState) cashBalances() map[string]float64 {
+	balances := map[string]float64{LedgerCurrency: st.Cash}
+	for currency, balance := range st.ForeignCash {
+		balances[currency] = balance
+	}
+	return balances
+}
+
+func (st *ledgerState) position(ticker string) *ledgerPosition {
+	pos, ok := st.Positions[ticker]
+	if !ok {
+		pos = &ledgerPosition{Ticker: ticker}
+		st.Positions[ticker] = pos
+		st.Tickers = append(st.Tickers, ticker)
+	}
+	return pos
+}
+
+// lots returns every lot of the replayed portfolio
+func (st *ledgerState) lots() []*ledgerLot {
+	var lots []*ledgerLot
+	for _, ticker := range st.Tickers {
+		lots = append(lots, st.Positions[ticker].Lots...)
+	}
+	return lots
+}
+
+// sortLedger orders transactions the way they are replayed
+func sortLedger(txns []Transaction) {
+	sort.SliceStable(txns, func(i, j int) bool {
+		if !txns[i].TransactionAt.Equal(txns[j].TransactionAt) {
+			return txns[i].TransactionAt.Before(txns[j].TransactionAt)
+		}
+		return txns[i].ID < txns[j].ID
+	})
+}
+
+// replayTransactions applies txns (already in ledger order) to an empty portfolio
+// using FIFO cost basis.
+func replayTransactions(txns []Transaction, lotIDs map[int]int) (*ledgerState, error) {
+	return replayTransactionsWithMethod(txns, lotIDs, CostBasisFIFO)
+}
+
+// replayTransactionsWithMethod applies txns (already in ledger order) to an
+// empty portfolio. The derived fields of each transaction (balances
+// before/after, realized gains and computed amounts) are rewritten in place.
+func replayTransactionsWithMethod(txns []Transaction, lotIDs map[int]int, method CostBasisMethod) (*ledgerState, error) {
+	st := newLedgerState(lotIDs, method)
+	for i := range txns {
+		if err := st.apply(&txns[i]); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// apply replays a single transaction against the state
+func (st *ledgerState) apply(t *Transaction) error {
+	fail := func(format string, args ...interface{}) error {
+		return &LedgerError{
+			TransactionID: t.ID,
+			TransactionAt: t.TransactionAt,
+			Message:       fmt.Sprintf(format, args...),
+		}
+	}
+
+	// Cash balances are those of the transaction's currency
+	t.CashBalanceBefore = st.balance(t.Currency)
+	t.RealizedGainAvg = 0
+	t.RealizedGainFIFO = 0
+	t.RealizedGain = 0
+
+	// Fees and taxes naming a security do not change the position
+	var pos *ledgerPosition
+	if t.Ticker != "" && !t.Type.isIncomeOrExpense() {
+		pos = st.position(t.Ticker)
+		t.SharesCountBefore = pos.Shares
+		t.AverageCostBefore = pos.AverageCost
+	}
+
+	switch t.Type {
+	case Deposit:
+		if t.Fee >= t.Amount {
+			return fail("fee %.2f exceeds deposit amount %.2f", t.Fee, t.Amount)
+		}
+		st.addCash(t.Currency, t.Amount-t.Fee)
+
+	case Withdraw:
+		if have := st.balance(t.Currency); have+ledgerEpsilon < t.Amount+t.Fee {
+			return fail("insufficient funds: have %.2f, need %.2f", have, t.Amount+t.Fee)
+		}
+		st.addCash(t.Currency, -(t.Amount + t.Fee))
+
+	case Interest:
+		st.addCash(t.Currency, t.Amount)
+
+	case Fee, Tax:
+		if have := st.balance(t.Currency); have+ledgerEpsilon < t.Amount {
+			return fail("insufficient funds: have %.2f, need %.2f", have, t.Amount)
+		}
+		st.addCash(t.Currency, -t.Amount)
+
+	case FX:
+		if t.ToCurrency == "" || t.ToCurrency == t.currency() || t.ToAmount <= 0 {
+			return fail("invalid conversion of %s to %s", t.currency(), t.ToCurrency)
+		}
+		if have := st.balance(t.Currency); have+ledgerEpsilon < t.Amount+t.Fee {
+			return fail("insufficient %s funds: have %.2f, need %.2f", t.currency(), have, t.Amount+t.Fee)
+		}
+		st.addCash(t.Currency, -(t.Amount + t.Fee))
+		st.addCash(t.ToCurrency, t.ToAmount)
+
+	case Buy:
+		if err := st.buy(t, pos); err != nil {
+			return fail("%v", err)
+		}
+
+	case Rights:
+		if t.ExDate == nil || t.EntitlementRatio <= 0 || t.CorporateActionID == nil {
+			return fail("rights subscription is missing its corporate action")
+		}
+		if t.Shares != math.Trunc(t.Shares) {
+			return fail("rights can only be subscribed in whole shares")
+		}
+		if !utcDay(t.TransactionAt).After(utcDay(*t.ExDate)) {
+			return fail("rights can only be subscribed after the record date")
+		}
+		entitled := rightsEntitled(pos.sharesOn(*t.ExDate), t.EntitlementRatio)
+		subscribed := st.rights[*t.CorporateActionID]
+		if subscribed+t.Shares > entitled+ledgerEpsilon {
+			return fail("subscription of %.0f shares exceeds remaining rights entitlement of %.0f",
+				t.Shares, entitled-subscribed)
+		}
+		if err := st.buy(t, pos); err != nil {
+			return fail("%v", err)
+		}
+		st.rights[*t.CorporateActionID] += t.Shares
+
+	case Sell:
+		if pos.Shares+ledgerEpsilon < t.Shares {
+			return fail("insufficient shares of %s: have %.2f, need %.2f", t.Ticker, pos.Shares, t.Shares)
+		}
+		matches, err := st.consume(t, pos)
+		if err != nil {
+			return fail("%v", err)
+		}
+		var lotGain float64
+		for i := range matches {
+			matches[i].SaleTransactionID = t.ID
+			matches[i].SalePrice = t.Price
+			matches[i].Specified = len(t.Lots) > 0
+			lotGain += matches[i].realizedGain()
+		}
+		st.matches = append(st.matches, matches...)
+		t.RealizedGainAvg = t.Shares * (t.Price - pos.AverageCost)
+		t.RealizedGain = lotGain
+		if st.Method == CostBasisAverage {
+			t.RealizedGain = t.RealizedGainAvg
+		}
+		// Other methods get their FIFO gain from a separate FIFO replay
+		if st.Method == CostBasisFIFO || st.Method == CostBasisAverage {
+			t.RealizedGainFIFO = lotGain
+		}
+
+		proceeds := t.Shares*t.Price - t.Fee
+		st.Cash += proceeds
+		t.Amount = proceeds
+
+		pos.Shares -= t.Shares
+		if pos.Shares <= ledgerEpsilon {
+			pos.Shares = 0
+			pos.AverageCost = 0
+		}
+		pos.LastPrice = t.Price
+		pos.LastDate = t.TransactionAt
+
+	case TransferOut:
+		if pos == nil {
+			if have := st.balance(t.Currency); have+ledgerEpsilon < t.Amount {
+				return fail("insufficient funds: have %.2f, need %.2f", have, t.Amount)
+			}
+			st.addCash(t.Currency, -t.Amount)
+			break
+		}
+		if pos.Shares+ledgerEpsilon < t.Shares {
+			return fail("insufficient shares of %s: have %.2f, need %.2f", t.Ticker, pos.Shares, t.Shares)
+		}
+		// The lots leave at cost, so the transfer realizes no gain
+		matches, err := st.consume(t, pos)
+		if err != nil {
+			return fail("%v", err)
+		}
+		for i := range matches {
+			matches[i].SaleTransactionID = t.ID
+			matches[i].SalePrice = matches[i].PurchasePrice
+			matches[i].Specified = len(t.Lots) > 0
+		}
+		st.matches = append(st.matches, matches...)
+		pos.Shares -= t.Shares
+		if pos.Shares <= ledgerEpsilon {
+			pos.Shares = 0
+			pos.AverageCost = 0
+		}
+
+	case TransferIn:
+		if pos == nil {
+			st.addCash(t.Currency, t.Amount)
+			break
+		}
+		purchaseDate := t.TransactionAt
+		if t.AcquiredAt != nil {
+			purchaseDate = *t.AcquiredAt
+		}
+		st.openLot(t, pos, purchaseDate)
+
+	case Dividend:
+		exDate := t.TransactionAt
+		if t.ExDate != nil {
+			exDate = *t.ExDate
+		}
+		entitled := pos.sharesBefore(exDate)
+		if entitled <= ledgerEpsilon {
+			return fail("%s was not held on ex-date %s", t.Ticker, exDate.Format("2006-01-02"))
+		}
+		// A row without a per-share rate carries the gross amount; derive the rate once
+		if t.Price <= 0 {
+			t.Price = t.Amount / entitled
+		}
+		gross := t.Price * entitled
+		if t.WithholdingTax >= gross {
+			return fail("withholding tax %.2f exceeds gross dividend %.2f", t.WithholdingTax, gross)
+		}
+		t.Shares = entitled
+		t.Amount = gross - t.WithholdingTax
+		if t.Fee > t.Amount {
+			return fail("fee %.2f exceeds net dividend %.2f", t.Fee, t.Amount)
+		}
+		st.Cash += t.Amount - t.Fee
+
+	case Split:
+		if t.SplitRatio <= 0 {
+			return fail("invalid split ratio %.6f", t.SplitRatio)
+		}
+		applySplit(pos, t.SplitRatio)
+		t.Shares = pos.Shares - t.SharesCountBefore
+		t.Price = 0
+		t.Amount = 0
+
+	default:
+		return fail("unsupported transaction type %s", t.Type)
+	}
+
+	t.CashBalanceAfter = st.balance(t.Currency)
+	if pos != nil {
+		pos.record(t.TransactionAt)
+		t.SharesCountAfter = pos.Shares
+		t.AverageCostAfter = pos.AverageCost
+	}
+	return nil
+}
+
+// buy pays for shares out of cash and opens a new lot at the transaction price
+func (st *ledgerState) buy(t *Transaction, pos *ledgerPosition) error {
+	totalCost := t.Shares*t.Price + t.Fee
+	if st.Cash+ledgerEpsilon < totalCost {
+		return fmt.Errorf("insufficient funds: have %.2f, need %.2f", st.Cash, totalCost)
+	}
+	st.Cash -= totalCost
+	t.Amount = totalCost
+
+	st.openLot(t, pos, t.TransactionAt)
+	pos.LastPrice = t.Price
+	pos.LastDate = t.TransactionAt
+	return nil
+}
+
+// openLot adds the shares of a transaction to the position as a new lot
+// purchased at the transaction price
+func (st *ledgerState) openLot(t *Transaction, pos *ledgerPosition, purchaseDate time.Time) {
+	pos.AverageCost = (pos.Shares*pos.AverageCost + t.Shares*t.Price) / (pos.Shares + t.Shares)
+	pos.Shares += t.Shares
+	pos.Lots = append(pos.Lots, &ledgerLot{
+		ID:              st.lotIDs[t.ID],
+		TransactionID:   t.ID,
+		Ticker:          t.Ticker,
+		Shares:          t.Shares,
+		RemainingShares: t.Shares,
+		PurchasePrice:   t.Price,
+		PurchaseDate:    purchaseDate,
+	})
+}
+
+// consume takes the shares of a sale or transfer out of the position's lots,
+// from the selected lots if any, otherwise in cost-basis method order
+func (st *ledgerState) consume(t *Transaction, pos *ledgerPosition) ([]ledgerMatch, error) {
+	if len(t.Lots) > 0 {
+		return consumeLotsSpecific(pos, t.Lots, t.Shares)
+	}
+	return consumeLots(st.Method.lotStrategy()(pos.Lots), t.Shares)
+}
+
+// rightsEntitled returns the whole number of new shares offered for a holding
+func rightsEntitled(held, ratio float64) float64 {
+	return math.Floor(held*ratio + ledgerEpsilon)
+}
+
+// consumeLots sells shares from the lots in the given order
+func consumeLots(lots []*ledgerLot, shares float64) ([]ledgerMatch, error) {
+	var matches []ledgerMatch
+	remainingToSell := shares
+
+	for _, lot := range lots {
+		if remainingToSell <= ledgerEpsilon {
+			break
+		}
+		if lot.RemainingShares <= ledgerEpsilon {
+			continue
+		}
+		sold := math.Min(remainingToSell, lot.RemainingShares)
+		lot.RemainingShares -= sold
+		remainingToSell -= sold
+		matches = append(matches, ledgerMatch{Lot: lot, Shares: sold, PurchasePrice: lot.PurchasePrice})
+	}
+
+	if remainingToSell > ledgerEpsilon {
+		return nil, fmt.Errorf("insufficient shares in open lots")
+	}
+	return matches, nil
+}
+
+// consumeLotsSpecific sells exactly the selected shares from the selected lots
+func consumeLotsSpecific(pos *ledgerPosition, selections []LotSelection, shares float64) ([]ledgerMatch, error) {
+	if err := validateLotSelections(selections, shares); err != nil {
+		return nil, err
+	}
+
+	matches := make([]ledgerMatch, 0, len(selections))
+	for _, sel := range selections {
+		var lot *ledgerLot
+		for _, candidate := range pos.Lots {
+			if candidate.ID != 0 && candidate.ID == sel.LotID {
+				lot = candidate
+				break
+			}
+		}
+		if lot == nil {
+			return nil, fmt.Errorf("lot %d is not an open %s lot at the time of the sale", sel.LotID, pos.Ticker)
+		}
+		if lot.RemainingShares+ledgerEpsilon < sel.Shares {
+			return nil, fmt.Errorf("lot %d has only %.2f shares remaining, need %.2f", lot.ID, lot.RemainingShares, sel.Shares)
+		}
+		lot.RemainingShares = math.Max(lot.RemainingShares-sel.Shares, 0)
+		matches = append(matches, ledgerMatch{Lot: lot, Shares: sel.Shares, PurchasePrice: lot.PurchasePrice})
+	}
+	return matches, nil
+}
+
+// applySplit scales a position and its open lots by the split ratio
+// (new shares per old share). Cost basis is unchanged, so prices are divided.
+func applySplit(pos *ledgerPosition, ratio float64) {
+	pos.Shares = roundShares(pos.Shares * ratio)
+	pos.AverageCost /= ratio
+	pos.LastPrice /= ratio
+	for _, lot := range pos.Lots {
+		if lot.RemainingShares <= ledgerEpsilon {
+			continue
+		}
+		lot.Shares = roundShares(lot.Shares * ratio)
+		lot.RemainingShares = roundShares(lot.RemainingShares * ratio)
+		lot.PurchasePrice /= ratio
+	}
+}
+
+// roundShares rounds a share count to the precision shares are stored at
+func roundShares(shares float64) float64 {
+	return math.Round(shares/ledgerEpsilon) * ledgerEpsilon
+}
+
+// ledgerColumns is the column list scanned by scanLedgerTransaction
+const ledgerColumns = `
+	id, portfolio_id, type::text,
+	COALESCE(ticker, '') as ticker,
+	COALESCE(shares, 0) as shares,
+	COALESCE(price, 0) as price,
+	amount, fee,
+	COALESCE(notes, '') as notes,
+	transaction_at, created_at,
+	COALESCE(cash_balance_before, 0) as cash_balance_before,
+	COALESCE(cash_balance_after, 0) as cash_balance_after,
+	COALESCE(shares_count_before, 0) as shares_count_before,
+	COALESCE(shares_count_after, 0) as shares_count_after,
+	COALESCE(average_cost_before, 0) as average_cost_before,
+	COALESCE(average_cost_after, 0) as average_cost_after,
+	COALESCE(realized_gain_avg, 0) as realized_gain_avg,
+	COALESCE(realized_gain_fifo, 0) as realized_gain_fifo,
+	COALESCE(realized_gain, 0) as realized_gain,
+	COALESCE(withholding_tax, 0) as withholding_tax,
+	ex_date,
+	COALESCE(split_ratio, 0) as split_ratio,
+	COALESCE(entitlement_ratio, 0) as entitlement_ratio,
+	corporate_action_id,
+	transfer_id,
+	acquired_at,
+	COALESCE(idempotency_key, '') as idempotency_key,
+	currency,
+	COALESCE(to_currency, '') as to_currency,
+	COALESCE(to_amount, 0) as to_amount,
+	COALESCE(exchange_rate, 0) as exchange_rate`
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLedgerTransaction scans a row selected with ledgerColumns
+func scanLedgerTransaction(row scanner) (Transaction, error) {
+	var t Transaction
+	var typeStr string
+	err := row.Scan(
+		&t.ID, &t.PortfolioID, &typeStr, &t.Ticker,
+		&t.Shares, &t.Price, &t.Amount, &t.Fee,
+		&t.Notes, &t.TransactionAt, &t.CreatedAt,
+		&t.CashBalanceBefore, &t.CashBalanceAfter,
+		&t.SharesCountBefore, &t.SharesCountAfter,
+		&t.AverageCostBefore, &t.AverageCostAfter,
+		&t.RealizedGainAvg, &t.RealizedGainFIFO, &t.RealizedGain,
+		&t.WithholdingTax, &t.ExDate,
+		&t.SplitRatio, &t.EntitlementRatio, &t.CorporateActionID,
+		&t.TransferID, &t.AcquiredAt,
+		&t.IdempotencyKey,
+		&t.Currency, &t.ToCurrency, &t.ToAmount, &t.ExchangeRate,
+	)
+	t.Type = TransactionType(typeStr)
+	return t, err
+}
+
+// getTransaction loads a single transaction belonging to a portfolio
+func (s *Server) getTransaction(portfolioID, transactionID int, tx *sql.Tx) (*Transaction, error) {
+	row := tx.QueryRow(`SELECT `+ledgerColumns+`
+		FROM portfolio_transactions
+		WHERE portfolio_id = $1 AND id = $2`, portfolioID, transactionID)
+	t, err := scanLedgerTransaction(row)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction: %v", err)
+	}
+
+	if t.Type == Sell || (t.Type == TransferOut && t.Ticker != "") {
+		if t.LotMatches, err = s.getLotMatches(transactionID, tx); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// getLotMatches returns the lots consumed by a sale
+func (s *Server) getLotMatches(saleTransactionID int, tx *sql.Tx) ([]LotMatch, error) {
+	rows, err := tx.Query(`
+		SELECT lot_id, shares, COALESCE(purchase_price, 0), COALESCE(sale_price, 0),
+			COALESCE(realized_gain, 0), specified
+		FROM portfolio_lot_matches
+		WHERE sale_transaction_id = $1
+		ORDER BY id
+	`, saleTransactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lot matches: %v", err)
+	}
+	defer rows.Close()
+
+	var matches []LotMatch
+	for rows.Next() {
+		var m LotMatch
+		if err := rows.Scan(&m.LotID, &m.Shares, &m.PurchasePrice, &m.SalePrice, &m.RealizedGain, &m.Specified); err != nil {
+			return nil, fmt.Errorf("error scanning lot match: %v", err)
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// loadLotSelections returns the lots chosen for each sale of a portfolio
+func (s *Server) loadLotSelections(portfolioID int, tx *sql.Tx) (map[int][]LotSelection, error) {
+	rows, err := tx.Query(`
+		SELECT sale_transaction_id, lot_id, shares
+		FROM portfolio_lot_matches
+		WHERE portfolio_id = $1 AND specified
+		ORDER BY id
+	`, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lot selections: %v", err)
+	}
+	defer rows.Close()
+
+	selections := make(map[int][]LotSelection)
+	for rows.Next() {
+		var saleID int
+		var sel LotSelection
+		if err := rows.Scan(&saleID, &sel.LotID, &sel.Shares); err != nil {
+			return nil, fmt.Errorf("error scanning lot selection: %v", err)
+		}
+		selections[saleID] = append(selections[saleID], sel)
+	}
+	return selections, rows.Err()
+}
+
+// saveLotSelections replaces the lots chosen for a sale. The matching
+// details are filled in by the next replayLedger.
+func (s *Server) saveLotSelections(portfolioID, saleTransactionID int, lots []LotSelection, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		DELETE FROM portfolio_lot_matches
+		WHERE sale_transaction_id = $1 AND specified
+	`, saleTransactionID)
+	if err != nil {
+		return fmt.Errorf("failed to clear lot selections: %v", err)
+	}
+
+	for _, lot := range lots {
+		result, err := tx.Exec(`
+			INSERT INTO portfolio_lot_matches (portfolio_id, sale_transaction_id, lot_id, shares, specified)
+			SELECT $1, $2, id, $4, TRUE
+			FROM portfolio_stock_lots
+			WHERE id = $3 AND portfolio_id = $1
+		`, portfolioID, saleTransactionID, lot.LotID, lot.Shares)
+		if err != nil {
+			return fmt.Errorf("failed to save lot selection: %v", err)
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return fmt.Errorf("%w: lot %d not found in portfolio %d", ErrInvalidTransaction, lot.LotID, portfolioID)
+		}
+	}
+	return nil
+}
+
+// loadLedger returns all transactions of a portfolio in replay order, locked
+// until tx ends
+func (s *Server) loadLedger(portfolioID int, tx *sql.Tx) ([]Transaction, error) {
+	return s.selectLedger(portfolioID, tx, "FOR UPDATE")
+}
+
+// readLedger is loadLedger without row locks, for read-only transactions
+func (s *Server) readLedger(portfolioID int, tx *sql.Tx) ([]Transaction, error) {
+	return s.selectLedger(portfolioID, tx, "")
+}
+
+func (s *Server) selectLedger(portfolioID int, tx *sql.Tx, locking string) ([]Transaction, error) {
+	rows, err := tx.Query(`SELECT `+ledgerColumns+`
+		FROM portfolio_transactions
+		WHERE portfolio_id = $1
+		ORDER BY transaction_at ASC, id ASC
+		`+locking, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ledger: %v", err)
+	}
+	defer rows.Close()
+
+	var txns []Transaction
+	for rows.Next() {
+		t, err := scanLedgerTransaction(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning transaction: %v", err)
+		}
+		txns = append(txns, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load ledger: %v", err)
+	}
+
+	selections, err := s.loadLotSelections(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range txns {
+		txns[i].Lots = selections[txns[i].ID]
+	}
+	sortLedger(txns)
+	return txns, nil
+}
+
+// loadLotIDs maps each BUY transaction id to the id of the lot it created,
+// locking the lots until tx ends
+func (s *Server) loadLotIDs(portfolioID int, tx *sql.Tx) (map[int]int, error) {
+	return s.selectLotIDs(portfolioID, tx, "FOR UPDATE")
+}
+
+// readLotIDs is loadLotIDs without row locks, for read-only transactions
+func (s *Server) readLotIDs(portfolioID int, tx *sql.Tx) (map[int]int, error) {
+	return s.selectLotIDs(portfolioID, tx, "")
+}
+
+func (s *Server) selectLotIDs(portfolioID int, tx *sql.Tx, locking string) (map[int]int, error) {
+	rows, err := tx.Query(`
+		SELECT transaction_id, id
+		FROM portfolio_stock_lots
+		WHERE portfolio_id = $1 AND transaction_id IS NOT NULL
+		`+locking, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lots: %v", err)
+	}
+	defer rows.Close()
+
+	lotIDs := make(map[int]int)
+	for rows.Next() {
+		var transactionID, lotID int
+		if err := rows.Scan(&transactionID, &lotID); err != nil {
+			return nil, fmt.Errorf("error scanning lot: %v", err)
+		}
+		lotIDs[transactionID] = lotID
+	}
+	return lotIDs, rows.Err()
+}
+
+// costBasisReplay is a replay of the ledger under one cost-basis method
+type costBasisReplay struct {
+	Txns  []Transaction
+	State *ledgerState
+}
+
+// replayCostBasisMethods replays copies of txns under every cost-basis method.
+// Only a failure under the portfolio's own method is an error; specific lot
+// selections can be impossible under another method, which is then left out.
+func replayCostBasisMethods(txns []Transaction, lotIDs map[int]int, method CostBasisMethod) (map[CostBasisMethod]*costBasisReplay, error) {
+	replays := make(map[CostBasisMethod]*costBasisReplay)
+	for _, m := range CostBasisMethods {
+		replayed := append([]Transaction(nil), txns...)
+		state, err := replayTransactionsWithMethod(replayed, lotIDs, m)
+		if err != nil {
+			if m == method {
+				return nil, err
+			}
+			continue
+		}
+		replays[m] = &costBasisReplay{Txns: replayed, State: state}
+	}
+	return replays, nil
+}
+
+// getCostBasisMethod returns the cost-basis policy of a portfolio
+func (s *Server) getCostBasisMethod(portfolioID int, tx *sql.Tx) (CostBasisMethod, error) {
+	var method CostBasisMethod
+	err := tx.QueryRow(`SELECT cost_basis_method FROM portfolios WHERE id = $1`, portfolioID).Scan(&method)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cost basis method: %v", err)
+	}
+	return method, nil
+}
+
+// replayLedger rebuilds running balances, lots, holdings and realized gains
+// for a portfolio from its transactions and marks the holdings to market.
+// It returns a *LedgerError if any point in the history would go negative.
+func (s *Server) replayLedger(portfolioID int, tx *sql.Tx) (*ledgerState, error) {
+	txns, err := s.loadLedger(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	lotIDs, err := s.loadLotIDs(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	replays, err := replayCostBasisMethods(txns, lotIDs, method)
+	if err != nil {
+		return nil, err
+	}
+	txns, state := replays[method].Txns, replays[method].State
+
+	transferLegs, err := s.loadTransferLegs(portfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransferredLots(txns, state.matches, transferLegs); err != nil {
+		return nil, err
+	}
+
+	// realized_gain_fifo and purchase_cost_fifo always hold the FIFO figures
+	fifo := replays[method]
+	if r, ok := replays[CostBasisFIFO]; ok {
+		fifo = r
+		for i := range txns {
+			txns[i].RealizedGainFIFO = r.Txns[i].RealizedGain
+		}
+	}
+
+	if err := s.saveLedgerTransactions(txns, tx); err != nil {
+		return nil, err
+	}
+	if err := s.saveLedgerLots(portfolioID, state, tx); err != nil {
+		return nil, err
+	}
+	if err := s.saveLedgerMatches(portfolioID, state, tx); err != nil {
+		return nil, err
+	}
+	if err := s.saveLedgerHoldings(portfolioID, state, fifo.State, tx); err != nil {
+		return nil, err
+	}
+	if err := s.saveLedgerCashBalances(portfolioID, state, tx); err != nil {
+		return nil, err
+	}
+	if err := s.saveLedgerCostBasis(portfolioID, replays, tx); err != nil {
+		return nil, err
+	}
+	if _, err := s.revalueHoldings([]int{portfolioID}, tx); err != nil {
+		return nil, err
+	}
+
+	s.logger.Debug("Replayed %d transactions for portfolio %d", len(txns), portfolioID)
+	return state, nil
+}
+
+// saveLedgerTransactions writes the replayed derived fields back to each transaction
+func (s *Server) saveLedgerTransactions(txns []Transaction, tx *sql.Tx) error {
+	stmt, err := tx.Prepare(`
+		UPDATE portfolio_transactions
+		SET shares = CASE WHEN ticker IS NULL THEN NULL ELSE $2 END,
+			price = CASE WHEN ticker IS NULL THEN NULL ELSE $3 END,
+			amount = $4,
+			cash_balance_before = $5,
+			cash_balance_after = $6,
+			shares_count_before = $7,
+			shares_count_after = $8,
+			average_cost_before = $9,
+			average_cost_after = $10,
+			realized_gain_avg = $11,
+			realized_gain_fifo = $12,
+			realized_gain = CASE WHEN type = 'SELL' THEN $13::numeric ELSE NULL END
+		WHERE id = $1`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare transaction update: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, t := range txns {
+		_, err := stmt.Exec(t.ID, t.Shares, t.Price, t.Amount,
+			t.CashBalanceBefore, t.CashBalanceAfter,
+			t.SharesCountBefore, t.SharesCountAfter,
+			t.AverageCostBefore, t.AverageCostAfter,
+			t.RealizedGainAvg, t.RealizedGainFIFO, t.RealizedGain)
+		if err != nil {
+			return fmt.Errorf("failed to update transaction %d: %v", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// saveLedgerLots rewrites portfolio_stock_lots, keeping the ids of existing lots
+func (s *Server) saveLedgerLots(portfolioID int, state *ledgerState, tx *sql.Tx) error {
+	keep := []int64{}
+	for _, lot := range state.lots() {
+		if lot.ID != 0 {
+			_, err := tx.Exec(`
+				UPDATE portfolio_stock_lots
+				SET ticker = $2, shares = $3, remaining_shares = $4,
+					purchase_price = $5, purchase_date = $6
+				WHERE id = $1
+			`, lot.ID, lot.Ticker, lot.Shares, lot.RemainingShares, lot.PurchasePrice, lot.PurchaseDate)
+			if err != nil {
+				return fmt.Errorf("failed to update lot %d: %v", lot.ID, err)
+			}
+		} else {
+			err := tx.QueryRow(`
+				INSERT INTO portfolio_stock_lots (
+					portfolio_id, ticker, shares, remaining_shares,
+					purchase_price, purchase_date, transaction_id
+				) VALUES ($1, $2, $3, $4, $5, $6, $7)
+				RETURNING id
+			`, portfolioID, lot.Ticker, lot.Shares, lot.RemainingShares,
+				lot.PurchasePrice, lot.PurchaseDate, lot.TransactionID).Scan(&lot.ID)
+			if err != nil {
+				return fmt.Errorf("failed to create lot: %v", err)
+			}
+		}
+		keep = append(keep, int64(lot.ID))
+	}
+
+	// Lots of deleted transactions and legacy lots without a transaction are dropped
+	_, err := tx.Exec(`
+		DELETE FROM portfolio_stock_lots
+		WHERE portfolio_id = $1 AND NOT (id = ANY($2))
+	`, portfolioID, pq.Array(keep))
+	if err != nil {
+		return fmt.Errorf("failed to remove stale lots: %v", err)
+	}
+	return nil
+}
+
+// saveLedgerMatches rewrites portfolio_lot_matches from the replayed sales.
+// It runs after saveLedgerLots so that new lots already have their ids.
+func (s *Server) saveLedgerMatches(portfolioID int, state *ledgerState, tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM portfolio_lot_matches WHERE portfolio_id = $1`, portfolioID)
+	if err != nil {
+		return fmt.Errorf("failed to clear lot matches: %v", err)
+	}
+
+	for _, m := range state.matches {
+		_, err := tx.Exec(`
+			INSERT INTO portfolio_lot_matches (
+				portfolio_id, sale_transaction_id, lot_id, shares,
+				purchase_price, sale_price, realized_gain, specified
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, portfolioID, m.SaleTransactionID, m.Lot.ID, m.Shares,
+			m.PurchasePrice, m.SalePrice, m.realizedGain(), m.Specified)
+		if err != nil {
+			return fmt.Errorf("failed to save lot match: %v", err)
+		}
+	}
+	return nil
+}
+
+// saveLedgerCostBasis rewrites portfolio_cost_basis with the cost basis and
+// realized gains of every ticker under each cost-basis method
+func (s *Server) saveLedgerCostBasis(portfolioID int, replays map[CostBasisMethod]*costBasisReplay, tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM portfolio_cost_basis WHERE portfolio_id = $1`, portfolioID)
+	if err != nil {
+		return fmt.Errorf("failed to clear cost basis: %v", err)
+	}
+
+	for method, replay := range replays {
+		realized := make(map[string]float64)
+		for _, t := range replay.Txns {
+			if t.Type == Sell {
+				realized[t.Ticker] += t.RealizedGain
+			}
+		}
+		for _, ticker := range replay.State.Tickers {
+			pos := replay.State.Positions[ticker]
+			_, err := tx.Exec(`
+				INSERT INTO portfolio_cost_basis (
+					portfolio_id, ticker, method, shares, cost_basis, realized_gain
+				) VALUES ($1, $2, $3, $4, $5, $6)
+			`, portfolioID, ticker, method, pos.Shares, pos.costBasis(method), realized[ticker])
+			if err != nil {
+				return fmt.Errorf("failed to save %s cost basis for %s: %v", method, ticker, err)
+			}
+		}
+	}
+	return nil
+}
+
+// saveLedgerHoldings rewrites share counts and costs in portfolio_holdings.
+// purchase_cost_fifo is taken from the FIFO replay.
+func (s *Server) saveLedgerHoldings(portfolioID int, state, fifo *ledgerState, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		INSERT INTO portfolio_holdings (portfolio_id, ticker, shares)
+		VALUES ($1, 'CASH', $2)
+		ON CONFLICT (portfolio_id, ticker) DO UPDATE SET
+			shares = EXCLUDED.shares,
+			updated_at = CURRENT_TIMESTAMP
+	`, portfolioID, state.Cash)
+	if err != nil {
+		return fmt.Errorf("failed to update cash holding: %v", err)
+	}
+
+	tickers := []string{"CASH"}
+	for _, ticker := range state.Tickers {
+		pos := state.Positions[ticker]
+		_, err := tx.Exec(`
+			INSERT INTO portfolio_holdings (
+				portfolio_id, ticker, shares,
+				purchase_cost_average, purchase_cost_fifo,
+				current_price, price_last_date
+			) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (portfolio_id, ticker) DO UPDATE SET
+				shares = EXCLUDED.shares,
+				purchase_cost_average = EXCLUDED.purchase_cost_average,
+				purchase_cost_fifo = EXCLUDED.purchase_cost_fifo,
+				current_price = COALESCE(portfolio_holdings.current_price, EXCLUDED.current_price),
+				price_last_date = COALESCE(portfolio_holdings.price_last_date, EXCLUDED.price_last_date),
+				updated_at = CURRENT_TIMESTAMP
+		`, portfolioID, ticker, pos.Shares, pos.AverageCost, fifo.position(ticker).lotCost(),
+			nullIfZero(pos.LastPrice), nullIfZeroTime(pos.LastDate))
+		if err != nil {
+			return fmt.Errorf("failed to update holding for %s: %v", ticker, err)
+		}
+		tickers = append(tickers, ticker)
+	}
+
+	// Holdings no longer backed by any transaction are emptied
+	_, err = tx.Exec(`
+		UPDATE portfolio_holdings
+		SET shares = 0,
+			purchase_cost_average = 0,
+			purchase_cost_fifo = 0,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE portfolio_id = $1 AND NOT (ticker = ANY($2)) AND shares <> 0
+	`, portfolioID, pq.Array(tickers))
+	if err != nil {
+		return fmt.Errorf("failed to clear stale holdings: %v", err)
+	}
+	return nil
+}
+
+// saveLedgerCashBalances rewrites portfolio_cash_balances with the cash held
+// in each currency. Currencies no longer used are set to zero.
+func (s *Server) saveLedgerCashBalances(portfolioID int, state *ledgerState, tx *sql.Tx) error {
+	currencies := []string{}
+	for currency, balance := range state.cashBalances() {
+		_, err := tx.Exec(`
+			INSERT INTO portfolio_cash_balances (portfolio_id, currency, balance)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (portfolio_id, currency) DO UPDATE SET
+				balance = EXCLUDED.balance,
+				updated_at = CURRENT_TIMESTAMP
+		`, portfolioID, currency, balance)
+		if err != nil {
+			return fmt.Errorf("failed to update %s cash balance: %v", currency, err)
+		}
+		currencies = append(currencies, currency)
+	}
+
+	_, err := tx.Exec(`
+		UPDATE portfolio_cash_balances
+		SET balance = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE portfolio_id = $1 AND NOT (currency = ANY($2)) AND balance <> 0
+	`, portfolioID, pq.Array(currencies))
+	if err != nil {
+		return fmt.Errorf("failed to clear stale cash balances: %v", err)
+	}
+	return nil
+}
+
+func nullIfZero(v float64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+func nullIfZeroTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ledgerDay(day int) time.Time {
+	return time.Date(2024, 1, day, 10, 0, 0, 0, time.UTC)
+}
+
+func TestReplayTransactionsRebuildsBalancesAndLots(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, Fee: 10, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Sell, Ticker: "BBOB", Shares: 1500, Price: 5, Fee: 5, TransactionAt: ledgerDay(4)},
+	}
+
+	state, err := replayTransactions(txns, map[int]int{2: 42})
+	assert.NoError(t, err)
+
+	assert.InDelta(t, 10000-2010-4000+7495, state.Cash, 0.001)
+	assert.InDelta(t, 10000, txns[1].CashBalanceBefore, 0.001)
+	assert.InDelta(t, 7990, txns[1].CashBalanceAfter, 0.001)
+	assert.InDelta(t, 2010, txns[1].Amount, 0.001)
+
+	sell := txns[3]
+	assert.InDelta(t, 2000, sell.SharesCountBefore, 0.001)
+	assert.InDelta(t, 500, sell.SharesCountAfter, 0.001)
+	assert.InDelta(t, 1000*(5-2)+500*(5-4), sell.RealizedGainFIFO, 0.001)
+	assert.InDelta(t, 1500*(5-3), sell.RealizedGainAvg, 0.001)
+
+	pos := state.Positions["BBOB"]
+	assert.InDelta(t, 500, pos.Shares, 0.001)
+	assert.InDelta(t, 4, pos.lotCost(), 0.001)
+	assert.Equal(t, 42, pos.Lots[0].ID, "existing lot ids are kept")
+	assert.InDelta(t, 0, pos.Lots[0].RemainingShares, 0.001)
+	assert.InDelta(t, 500, pos.Lots[1].RemainingShares, 0.001)
+}
+
+func TestReplayTransactionsRejectsNegativeHistory(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 1000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Sell, Ticker: "BBOB", Shares: 150, Price: 5, TransactionAt: ledgerDay(3)},
+	}
+
+	_, err := replayTransactions(txns, nil)
+
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 3, ledgerErr.TransactionID)
+}
+
+func TestReplayTransactionsDividendEntitlement(t *testing.T) {
+	exDate := ledgerDay(5)
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 1000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(6)},
+		{ID: 4, Type: Dividend, Ticker: "BBOB", Price: 0.5, WithholdingTax: 5, ExDate: &exDate, TransactionAt: ledgerDay(10)},
+	}
+
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+
+	dividend := txns[3]
+	assert.InDelta(t, 100, dividend.Shares, 0.001, "only shares held before the ex-date are entitled")
+	assert.InDelta(t, 45, dividend.Amount, 0.001)
+	assert.InDelta(t, 45, state.Cash, 0.001)
+}
+
+func TestReplayTransactionsBackdatedEntry(t *testing.T) {
+	// Transaction 4 is keyed in late but dated before the sale
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 1000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(5)},
+		{ID: 3, Type: Sell, Ticker: "BBOB", Shares: 100, Price: 6, TransactionAt: ledgerDay(10)},
+		{ID: 4, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 2, TransactionAt: ledgerDay(3)},
+	}
+	sortLedger(txns)
+
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, txns[1].ID)
+	assert.InDelta(t, 1000, txns[1].CashBalanceBefore, 0.001)
+	assert.InDelta(t, 800, txns[2].CashBalanceBefore, 0.001)
+
+	sell := txns[3]
+	assert.InDelta(t, 100*(6-2), sell.RealizedGainFIFO, 0.001, "the backdated lot is consumed first")
+	assert.InDelta(t, 100, state.Positions["BBOB"].Shares, 0.001)
+
+	// A backdated withdrawal that leaves nothing for the later buys is rejected
+	txns = append(txns, Transaction{ID: 5, Type: Withdraw, Amount: 900, TransactionAt: ledgerDay(2)})
+	sortLedger(txns)
+	_, err = replayTransactions(txns, nil)
+
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 4, ledgerErr.TransactionID)
+}
+
+func TestReplayTransactionsSplitScalesLotsAndCost(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Sell, Ticker: "BBOB", Shares: 500, Price: 5, TransactionAt: ledgerDay(4)},
+		{ID: 5, Type: Split, Ticker: "BBOB", SplitRatio: 1.25, TransactionAt: ledgerDay(5)},
+		{ID: 6, Type: Sell, Ticker: "BBOB", Shares: 625, Price: 4, TransactionAt: ledgerDay(6)},
+	}
+
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+
+	split := txns[4]
+	assert.InDelta(t, 1500, split.SharesCountBefore, 0.001)
+	assert.InDelta(t, 1875, split.SharesCountAfter, 0.001)
+	assert.InDelta(t, 375, split.Shares, 0.001)
+	assert.InDelta(t, 3/1.25, split.AverageCostAfter, 0.001)
+	assert.InDelta(t, split.CashBalanceBefore, split.CashBalanceAfter, 0.001, "splits move no cash")
+
+	// The first lot had 500 shares left at 2.00, now 625 at 1.60
+	assert.InDelta(t, 625*(4-1.6), txns[5].RealizedGainFIFO, 0.001)
+
+	pos := state.Positions["BBOB"]
+	assert.InDelta(t, 1250, pos.Shares, 0.001)
+	assert.InDelta(t, 0, pos.Lots[0].RemainingShares, 0.001)
+	assert.InDelta(t, 1250, pos.Lots[1].RemainingShares, 0.001)
+	assert.InDelta(t, 3.2, pos.Lots[1].PurchasePrice, 0.001)
+}
+
+func TestReplayTransactionsSplitKeepsWholeShares(t *testing.T) {
+	action := CorporateAction{ActionType: ActionSplit, RatioNew: 4, RatioOld: 3}
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 750, Price: 4, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Split, Ticker: "BBOB", SplitRatio: action.Factor(), TransactionAt: ledgerDay(3)},
+	}
+
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+
+	pos := state.Positions["BBOB"]
+	assert.Equal(t, 1000.0, pos.Shares)
+	assert.Equal(t, 1000.0, pos.Lots[0].RemainingShares)
+	assert.Equal(t, 1000.0, txns[2].SharesCountAfter)
+}
+
+func TestReplayTransactionsRightsSubscription(t *testing.T) {
+	recordDate := ledgerDay(3)
+	actionID := 7
+	rights := func(id int, shares float64, day int) Transaction {
+		return Transaction{
+			ID: id, Type: Rights, Ticker: "BBOB", Shares: shares, Price: 1, Fee: 5,
+			ExDate: &recordDate, EntitlementRatio: 0.25, CorporateActionID: &actionID,
+			TransactionAt: ledgerDay(day),
+		}
+	}
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 3, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 3, TransactionAt: ledgerDay(4)},
+		rights(4, 200, 5),
+	}
+
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10000-3000-3000-205, state.Cash, 0.001)
+	assert.InDelta(t, 200, state.rights[actionID], 0.001)
+
+	pos := state.Positions["BBOB"]
+	assert.InDelta(t, 2200, pos.Shares, 0.001)
+	assert.InDelta(t, 1, pos.Lots[2].PurchasePrice, 0.001)
+
+	// Only the 1000 shares held on the record date carry rights
+	txns = append(txns, rights(5, 100, 6))
+	_, err = replayTransactions(txns, nil)
+
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 5, ledgerErr.TransactionID)
+
+	// Rights are taken up in whole shares
+	txns[4] = rights(5, 0.5, 6)
+	_, err = replayTransactions(txns, nil)
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Contains(t, err.Error(), "whole shares")
+
+	// A subscription later on the record day itself is too early
+	txns[4] = rights(5, 10, 3)
+	txns[4].TransactionAt = recordDate.Add(4 * time.Hour)
+	_, err = replayTransactions(txns, nil)
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Contains(t, err.Error(), "after the record date")
+}
+
+func TestReplayTransactionsSpecificLots(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Sell, Ticker: "BBOB", Shares: 600, Price: 5, TransactionAt: ledgerDay(4),
+			Lots: []LotSelection{{LotID: 31, Shares: 500}, {LotID: 30, Shares: 100}}},
+	}
+
+	state, err := replayTransactions(txns, map[int]int{2: 30, 3: 31})
+	assert.NoError(t, err)
+
+	assert.InDelta(t, 500*(5-4)+100*(5-2), txns[3].RealizedGainFIFO, 0.001)
+	assert.Len(t, state.matches, 2)
+	assert.True(t, state.matches[0].Specified)
+
+	pos := state.Positions["BBOB"]
+	assert.InDelta(t, 900, pos.Lots[0].RemainingShares, 0.001)
+	assert.InDelta(t, 500, pos.Lots[1].RemainingShares, 0.001)
+
+	// Selecting more than a lot holds is rejected
+	txns[3].Lots = []LotSelection{{LotID: 30, Shares: 100}, {LotID: 31, Shares: 1100}}
+	txns[3].Shares = 1200
+	_, err = replayTransactions(txns, map[int]int{2: 30, 3: 31})
+
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 4, ledgerErr.TransactionID)
+}
+
+func TestReplayCostBasisMethods(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 6, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 4, TransactionAt: ledgerDay(4)},
+		{ID: 5, Type: Sell, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(5)},
+	}
+
+	replays, err := replayCostBasisMethods(txns, nil, CostBasisHIFO)
+	assert.NoError(t, err)
+
+	expected := map[CostBasisMethod]struct{ gain, cost float64 }{
+		CostBasisFIFO:    {100 * (5 - 2), 100*6 + 100*4},
+		CostBasisLIFO:    {100 * (5 - 4), 100*2 + 100*6},
+		CostBasisHIFO:    {100 * (5 - 6), 100*2 + 100*4},
+		CostBasisAverage: {100 * (5 - 4), 200 * 4},
+	}
+	for method, want := range expected {
+		r := replays[method]
+		assert.InDelta(t, want.gain, r.Txns[4].RealizedGain, 0.001, method)
+		assert.InDelta(t, want.cost, r.State.Positions["BBOB"].costBasis(method), 0.001, method)
+	}
+	assert.InDelta(t, 0, txns[4].RealizedGain, 0.001, "the input ledger is not modified")
+}
+
+func TestReplayTransactionsTransfers(t *testing.T) {
+	transferID := 9
+	source := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: TransferOut, Ticker: "BBOB", Shares: 1500, Price: 5, Amount: 7500, TransferID: &transferID, TransactionAt: ledgerDay(10)},
+		{ID: 5, Type: TransferOut, Amount: 1000, TransferID: &transferID, TransactionAt: ledgerDay(10)},
+	}
+
+	state, err := replayTransactions(source, nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10000-2000-4000-1000, state.Cash, 0.001)
+	assert.InDelta(t, 500, state.Positions["BBOB"].Shares, 0.001)
+	assert.InDelta(t, 0, source[3].RealizedGainFIFO, 0.001, "transfers realize no gain")
+	assert.InDelta(t, 7500, source[3].Amount, 0.001, "the market value is kept as the flow")
+	assert.Len(t, state.matches, 2)
+
+	// The destination receives each lot with its original price and date, so
+	// FIFO sells the transferred lot before a later purchase
+	acquiredAt := ledgerDay(2)
+	destination := []Transaction{
+		{ID: 10, Type: Deposit, Amount: 1000, TransactionAt: ledgerDay(5)},
+		{ID: 11, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 6, TransactionAt: ledgerDay(6)},
+		{ID: 12, Type: TransferIn, Ticker: "BBOB", Shares: 1000, Price: 2, Amount: 5000, AcquiredAt: &acquiredAt, TransferID: &transferID, TransactionAt: ledgerDay(10)},
+		{ID: 13, Type: Sell, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(11)},
+	}
+
+	state, err = replayTransactions(destination, nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 400+500, state.Cash, 0.001)
+	assert.InDelta(t, 100*(5-2), destination[3].RealizedGainFIFO, 0.001)
+	assert.Equal(t, acquiredAt, state.Positions["BBOB"].Lots[1].PurchaseDate)
+}
+
+func TestReplayTransactionsFX(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 1000, Currency: "USD", TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: FX, Amount: 400, Fee: 1, Currency: "USD", ToCurrency: "IQD", ToAmount: 524000, ExchangeRate: 1310, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 500, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: FX, Amount: 1000, Currency: "USD", ToCurrency: "IQD", ToAmount: 1310000, ExchangeRate: 1310, TransactionAt: ledgerDay(4)},
+	}
+
+	state, err := replayTransactions(txns[:3], nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 24000, state.Cash, 0.001)
+	assert.InDelta(t, 599, state.ForeignCash["USD"], 0.001)
+	assert.InDelta(t, 1000, txns[1].CashBalanceBefore, 0.001, "balances are in the source currency")
+	assert.InDelta(t, 599, txns[1].CashBalanceAfter, 0.001)
+
+	_, err = replayTransactions(txns, nil)
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr), "converting more than is held fails")
+	assert.Equal(t, 4, ledgerErr.TransactionID)
+}
+
+func TestReplayTransactionsIncomeAndExpenses(t *testing.T) {
+	txns := []Transaction{
+		{ID: 1, Type: Deposit, Amount: 1000, TransactionAt: ledgerDay(1)},
+		{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 100, Price: 5, TransactionAt: ledgerDay(2)},
+		{ID: 3, Type: Interest, Amount: 12, TransactionAt: ledgerDay(3)},
+		{ID: 4, Type: Fee, Amount: 7, TransactionAt: ledgerDay(4)},
+		{ID: 5, Type: Tax, Ticker: "BBOB", Amount: 3, TransactionAt: ledgerDay(5)},
+		{ID: 6, Type: Fee, Amount: 1000, TransactionAt: ledgerDay(6)},
+	}
+
+	state, err := replayTransactions(txns[:5], nil)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1000-500+12-7-3, state.Cash, 0.001)
+	assert.InDelta(t, 100, state.Positions["BBOB"].Shares, 0.001, "a tax naming a security leaves the position alone")
+	assert.InDelta(t, 0, txns[4].SharesCountAfter, 0.001)
+
+	_, err = replayTransactions(txns, nil)
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr), "fees cannot overdraw the account")
+	assert.Equal(t, 6, ledgerErr.TransactionID)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestContextMiddleware(t *testing.T) {
+	s := &Server{}
+	var gotID, gotClient string
+	handler := s.requestContextMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = requestID(r)
+		gotClient, _ = r.Context().Value(clientKey).(string)
+	}))
+
+	req := httptest.NewRequest("POST", "/api/portfolios", nil)
+	req.RemoteAddr = "192.168.1.20:53211"
+	req.Header.Set("X-Request-ID", "import-42")
+	req.Header.Set("X-Client-ID", "portfolio-web")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, "import-42", gotID)
+	assert.Equal(t, "import-42", rec.Header().Get("X-Request-ID"))
+	assert.Equal(t, "portfolio-web @ 192.168.1.20", gotClient)
+
+	// Without headers an ID is generated and the User-Agent names the client
+	req = httptest.NewRequest("GET", "/api/portfolios", nil)
+	req.RemoteAddr = "10.0.0.5:4000"
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Len(t, gotID, 24)
+	assert.Equal(t, gotID, rec.Header().Get("X-Request-ID"))
+	assert.Equal(t, "curl/8.5.0 @ 10.0.0.5", gotClient)
+}
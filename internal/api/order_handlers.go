@@ -0,0 +1,693 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OrderStatus is the state of a pending limit order
+type OrderStatus string
+
+const (
+	OrderOpen      OrderStatus = "OPEN"      // Waiting for the price to reach the limit
+	OrderTriggered OrderStatus = "TRIGGERED" // The limit was reached; waiting for confirmation
+	OrderFilled    OrderStatus = "FILLED"    // Recorded as a transaction
+	OrderCancelled OrderStatus = "CANCELLED"
+	OrderExpired   OrderStatus = "EXPIRED"
+)
+
+// orderBookClient names the order processing job in the audit log
+const orderBookClient = "order-book"
+
+// Order is a limit order placed with the broker that has not been recorded
+// as a transaction yet
+type Order struct {
+	ID            int             `json:"id"`
+	PortfolioID   int             `json:"portfolio_id"`
+	Side          TransactionType `json:"side"` // BUY or SELL
+	Ticker        string          `json:"ticker"`
+	Shares        float64         `json:"shares"`
+	LimitPrice    float64         `json:"limit_price"`
+	AutoFill      bool            `json:"auto_fill"` // Record the transaction without confirmation
+	Status        OrderStatus     `json:"status"`
+	PlacedAt      time.Time       `json:"placed_at"`
+	ExpiresAt     *time.Time      `json:"expires_at"`
+	FillDate      *time.Time      `json:"fill_date,omitempty"`
+	FillPrice     float64         `json:"fill_price,omitempty"`
+	TransactionID *int            `json:"transaction_id,omitempty"`
+	StatusMessage string          `json:"status_message,omitempty"` // Why an automatic fill failed
+	Notes         string          `json:"notes"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// OrderRequest places a limit order
+type OrderRequest struct {
+	Side       TransactionType `json:"side"`
+	Ticker     string          `json:"ticker"`
+	Shares     float64         `json:"shares"`
+	LimitPrice float64         `json:"limit_price"`
+	AutoFill   bool            `json:"auto_fill"`
+	PlacedAt   time.Time       `json:"placed_at"`  // Defaults to now
+	ExpiresAt  *time.Time      `json:"expires_at"` // Defaults to the configured expiry
+	// Keep the order open until it fills or is cancelled
+	GoodTillCancelled bool   `json:"good_till_cancelled"`
+	Notes             string `json:"notes"`
+}
+
+// OrderFillRequest confirms the fill of an order. Omitted fields are taken
+// from the triggered fill, or the order's limit price.
+type OrderFillRequest struct {
+	Price         float64   `json:"price"`
+	Fee           *float64  `json:"fee,omitempty"` // Computed from the fee schedule when omitted
+	TransactionAt time.Time `json:"transaction_at"`
+}
+
+// priceBar is one trading day of a ticker
+type priceBar struct {
+	Date time.Time
+	Open float64
+	High float64
+	Low  float64
+}
+
+// Validate checks if the order request is valid
+func (r *OrderRequest) Validate() error {
+	if r.Side != Buy && r.Side != Sell {
+		return fmt.Errorf("side must be %s or %s", Buy, Sell)
+	}
+	if r.Ticker == "" {
+		return fmt.Errorf("ticker is required")
+	}
+	if r.Shares <= 0 {
+		return fmt.Errorf("shares must be positive")
+	}
+	if r.LimitPrice <= 0 {
+		return fmt.Errorf("limit_price must be positive")
+	}
+	if r.ExpiresAt != nil && r.GoodTillCancelled {
+		return fmt.Errorf("expires_at cannot be set for a good-till-cancelled order")
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(r.PlacedAt) {
+		return fmt.Errorf("expires_at must be after placed_at")
+	}
+	return nil
+}
+
+// fill returns the price the order would have filled at during a trading
+// day, and whether it filled. A buy fills when the low reaches the limit and
+// a sell when the high does. A day after the order was placed that opens
+// through the limit fills at the open.
+func (o *Order) fill(bar priceBar) (float64, bool) {
+	if bar.Low <= 0 || bar.High <= 0 {
+		return 0, false // No trades that day
+	}
+	gapAllowed := bar.Open > 0 && bar.Date.After(o.PlacedAt)
+	switch o.Side {
+	case Buy:
+		if bar.Low > o.LimitPrice {
+			return 0, false
+		}
+		if gapAllowed && bar.Open < o.LimitPrice {
+			return bar.Open, true
+		}
+	case Sell:
+		if bar.High < o.LimitPrice {
+			return 0, false
+		}
+		if gapAllowed && bar.Open > o.LimitPrice {
+			return bar.Open, true
+		}
+	default:
+		return 0, false
+	}
+	return o.LimitPrice, true
+}
+
+// expired reports whether an unfilled order is past its expiry
+func (o *Order) expired(now time.Time) bool {
+	return o.ExpiresAt != nil && now.After(*o.ExpiresAt)
+}
+
+// fillTime is when the fill of an order is recorded: the time the order was
+// placed when it filled that day, otherwise the start of the fill date
+func (o *Order) fillTime() time.Time {
+	if o.FillDate == nil || o.FillDate.Before(o.PlacedAt) {
+		return o.PlacedAt
+	}
+	return *o.FillDate
+}
+
+const orderColumns = `
+	id, portfolio_id, side, ticker, shares, limit_price, auto_fill, status,
+	placed_at, expires_at, fill_date, COALESCE(fill_price, 0), transaction_id,
+	COALESCE(status_message, ''), COALESCE(notes, ''), created_at, updated_at`
+
+func scanOrder(row scanner) (Order, error) {
+	var o Order
+	var expiresAt, fillDate sql.NullTime
+	var transactionID sql.NullInt64
+	err := row.Scan(
+		&o.ID, &o.PortfolioID, &o.Side, &o.Ticker, &o.Shares, &o.LimitPrice, &o.AutoFill, &o.Status,
+		&o.PlacedAt, &expiresAt, &fillDate, &o.FillPrice, &transactionID,
+		&o.StatusMessage, &o.Notes, &o.CreatedAt, &o.UpdatedAt,
+	)
+	if expiresAt.Valid {
+		o.ExpiresAt = &expiresAt.Time
+	}
+	if fillDate.Valid {
+		o.FillDate = &fillDate.Time
+	}
+	if transactionID.Valid {
+		id := int(transactionID.Int64)
+		o.TransactionID = &id
+	}
+	return o, err
+}
+
+// getOrder returns an order of a portfolio, locking it for the rest of the
+// DB transaction so it is not filled twice
+func (s *Server) getOrder(portfolioID, orderID int, tx *sql.Tx) (*Order, error) {
+	o, err := scanOrder(tx.QueryRow(`
+		SELECT `+orderColumns+`
+		FROM portfolio_orders
+		WHERE portfolio_id = $1 AND id = $2
+		FOR UPDATE
+	`, portfolioID, orderID))
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// orderIDs parses the portfolio and order IDs of an order route
+func orderIDs(r *http.Request) (int, int, error) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid portfolio ID")
+	}
+	orderID, err := strconv.Atoi(vars["orderId"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid order ID")
+	}
+	return portfolioID, orderID, nil
+}
+
+// ListOrders lists the orders of a portfolio, newest first. The status query
+// parameter limits the list to orders in that state.
+func (s *Server) ListOrders(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	query := `SELECT ` + orderColumns + ` FROM portfolio_orders WHERE portfolio_id = $1`
+	args := []interface{}{portfolioID}
+	if status := strings.ToUpper(r.URL.Query().Get("status")); status != "" {
+		query += ` AND status = $2`
+		args = append(args, status)
+	}
+	query += ` ORDER BY placed_at DESC, id DESC`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		s.logger.Error("Failed to list orders: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list orders")
+		return
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan order: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list orders")
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, orders)
+}
+
+// GetOrder returns one order of a portfolio
+func (s *Server) GetOrder(w http.ResponseWriter, r *http.Request) {
+	portfolioID, orderID, err := orderIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	o, err := scanOrder(s.db.QueryRow(`
+		SELECT `+orderColumns+`
+		FROM portfolio_orders
+		WHERE portfolio_id = $1 AND id = $2
+	`, portfolioID, orderID))
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get order: %v", err))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, o)
+}
+
+// CreateOrder places a limit order. Prices already scraped since placed_at
+// are checked on the next order processing run.
+func (s *Server) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	req.Side = TransactionType(strings.ToUpper(string(req.Side)))
+	req.Ticker = strings.ToUpper(strings.TrimSpace(req.Ticker))
+	if req.PlacedAt.IsZero() {
+		req.PlacedAt = time.Now()
+	}
+	if req.ExpiresAt == nil && !req.GoodTillCancelled && s.config != nil && s.config.Orders.DefaultExpiryDays > 0 {
+		expiresAt := req.PlacedAt.AddDate(0, 0, s.config.Orders.DefaultExpiryDays)
+		req.ExpiresAt = &expiresAt
+	}
+	if err := req.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+	if err := s.validateTicker(req.Ticker, tx); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var expiresAt interface{}
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	o, err := scanOrder(tx.QueryRow(`
+		INSERT INTO portfolio_orders (
+			portfolio_id, side, ticker, shares, limit_price, auto_fill,
+			placed_at, expires_at, notes
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+orderColumns,
+		portfolioID, req.Side, req.Ticker, req.Shares, req.LimitPrice, req.AutoFill,
+		req.PlacedAt, expiresAt, req.Notes))
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create order: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, o)
+}
+
+// CancelOrder cancels an order that has not been filled
+func (s *Server) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	portfolioID, orderID, err := orderIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	o, err := s.getOrder(portfolioID, orderID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get order: %v", err))
+		return
+	}
+	if o.Status != OrderOpen && o.Status != OrderTriggered {
+		s.respondWithError(w, http.StatusConflict, fmt.Sprintf("Order %d is %s", o.ID, o.Status))
+		return
+	}
+
+	updated, err := scanOrder(tx.QueryRow(`
+		UPDATE portfolio_orders
+		SET status = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+orderColumns, o.ID, OrderCancelled))
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to cancel order: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, updated)
+}
+
+// ConfirmOrder records the fill of an order as a BUY or SELL transaction. An
+// open order can be confirmed too, for fills the scraped prices do not show.
+func (s *Server) ConfirmOrder(w http.ResponseWriter, r *http.Request) {
+	portfolioID, orderID, err := orderIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req OrderFillRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	if req.Price < 0 {
+		s.respondWithError(w, http.StatusBadRequest, "price must be positive")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	o, err := s.getOrder(portfolioID, orderID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get order: %v", err))
+		return
+	}
+	if o.Status != OrderOpen && o.Status != OrderTriggered {
+		s.respondWithError(w, http.StatusConflict, fmt.Sprintf("Order %d is %s", o.ID, o.Status))
+		return
+	}
+
+	filled, err := s.fillOrder(o, req, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, filled)
+}
+
+// ProcessOrders runs order processing now instead of after the next scrape
+func (s *Server) ProcessOrders(w http.ResponseWriter, r *http.Request) {
+	result, err := s.processOrders()
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.respondWithJSON(w, http.StatusOK, result)
+}
+
+// fillOrder records an order as a transaction at its fill and marks it filled
+func (s *Server) fillOrder(o *Order, fill OrderFillRequest, tx *sql.Tx) (*Order, error) {
+	if fill.Price == 0 {
+		fill.Price = o.FillPrice
+	}
+	if fill.Price == 0 {
+		fill.Price = o.LimitPrice
+	}
+	if fill.TransactionAt.IsZero() {
+		fill.TransactionAt = o.fillTime()
+	}
+
+	req := TransactionRequest{
+		Type:          o.Side,
+		Ticker:        o.Ticker,
+		Shares:        o.Shares,
+		Price:         fill.Price,
+		Fee:           fill.Fee,
+		Notes:         strings.TrimSpace(fmt.Sprintf("Limit order %d %s", o.ID, o.Notes)),
+		TransactionAt: fill.TransactionAt,
+	}
+
+	if err := s.initializePortfolioHoldings(o.PortfolioID, tx); err != nil {
+		return nil, fmt.Errorf("failed to initialize holdings: %v", err)
+	}
+	if _, err := s.chargeFee(o.PortfolioID, &req, tx); err != nil {
+		return nil, err
+	}
+	transaction, err := s.createTransaction(o.PortfolioID, req, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	filled, err := scanOrder(tx.QueryRow(`
+		UPDATE portfolio_orders
+		SET status = $2,
+			fill_price = $3,
+			fill_date = $4::date,
+			transaction_id = $5,
+			status_message = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+orderColumns,
+		o.ID, OrderFilled, fill.Price, fill.TransactionAt, transaction.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark order %d filled: %v", o.ID, err)
+	}
+	return &filled, nil
+}
+
+// OrderProcessingResult counts what an order processing run did
+type OrderProcessingResult struct {
+	Triggered int `json:"triggered"` // Waiting for confirmation
+	Filled    int `json:"filled"`    // Recorded as transactions
+	Failed    int `json:"failed"`    // Automatic fills rejected by the ledger, left triggered
+	Expired   int `json:"expired"`
+}
+
+// processOrders checks every open order against the prices scraped since it
+// was placed. Orders whose limit was reached are filled when they allow it,
+// and otherwise wait for confirmation; orders past their expiry are expired.
+// Each order is processed in its own DB transaction.
+func (s *Server) processOrders() (OrderProcessingResult, error) {
+	var result OrderProcessingResult
+
+	rows, err := s.db.Query(`SELECT `+orderColumns+` FROM portfolio_orders WHERE status = $1 ORDER BY placed_at, id`, OrderOpen)
+	if err != nil {
+		return result, fmt.Errorf("failed to get open orders: %v", err)
+	}
+	var orders []Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan order: %v", err)
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+
+	for i := range orders {
+		status, err := s.processOrder(&orders[i])
+		if err != nil {
+			s.logger.Error("Failed to process order %d: %v", orders[i].ID, err)
+			continue
+		}
+		switch {
+		case status == OrderTriggered && orders[i].AutoFill:
+			result.Failed++
+		case status == OrderTriggered:
+			result.Triggered++
+		case status == OrderFilled:
+			result.Filled++
+		case status == OrderExpired:
+			result.Expired++
+		}
+	}
+
+	s.logger.Info("Processed %d open orders: %d filled, %d triggered, %d failed, %d expired",
+		len(orders), result.Filled, result.Triggered, result.Failed, result.Expired)
+	return result, nil
+}
+
+// processOrder checks one open order and returns its new status
+func (s *Server) processOrder(o *Order) (OrderStatus, error) {
+	tx, err := s.beginTaggedTx(newRequestID(), orderBookClient)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	bars, err := s.getPriceBars(o.Ticker, o.PlacedAt, o.ExpiresAt, tx)
+	if err != nil {
+		return "", err
+	}
+
+	status := OrderOpen
+	for _, bar := range bars {
+		if price, ok := o.fill(bar); ok {
+			fillDate := bar.Date
+			o.FillDate, o.FillPrice = &fillDate, price
+			status = OrderTriggered
+			break
+		}
+	}
+	if status == OrderOpen {
+		if !o.expired(time.Now()) {
+			return OrderOpen, nil
+		}
+		status = OrderExpired
+	}
+
+	var fillDate interface{}
+	if o.FillDate != nil {
+		fillDate = *o.FillDate
+	}
+	// The order may have been cancelled or confirmed since it was read
+	result, err := tx.Exec(`
+		UPDATE portfolio_orders
+		SET status = $2, fill_date = $3, fill_price = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = $5
+	`, o.ID, status, fillDate, nullIfZero(o.FillPrice), OrderOpen)
+	if err != nil {
+		return "", fmt.Errorf("failed to update order: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("order is no longer open")
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if status != OrderTriggered || !o.AutoFill {
+		return status, nil
+	}
+
+	// An automatic fill the ledger rejects, such as a buy without the cash,
+	// stays triggered with the reason so it can be confirmed once fixed
+	if err := s.autoFillOrder(o); err != nil {
+		s.logger.Error("Automatic fill of order %d failed: %v", o.ID, err)
+		if dbErr := s.recordFillError(o, err); dbErr != nil {
+			return status, fmt.Errorf("failed to record fill error: %v", dbErr)
+		}
+		return status, nil
+	}
+	return OrderFilled, nil
+}
+
+// recordFillError saves why an automatic fill of an order failed
+func (s *Server) recordFillError(o *Order, fillErr error) error {
+	tx, err := s.beginTaggedTx(newRequestID(), orderBookClient)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE portfolio_orders
+		SET status_message = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, o.ID, fillErr.Error())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// autoFillOrder records a triggered order at its fill price
+func (s *Server) autoFillOrder(o *Order) error {
+	tx, err := s.beginTaggedTx(newRequestID(), orderBookClient)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Skip orders confirmed or cancelled since they were triggered
+	current, err := s.getOrder(o.PortfolioID, o.ID, tx)
+	if err != nil {
+		return err
+	}
+	if current.Status != OrderTriggered {
+		return nil
+	}
+
+	if _, err := s.fillOrder(current, OrderFillRequest{}, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getPriceBars returns the trading days of a ticker from the day an order
+// was placed until it expires, oldest first
+func (s *Server) getPriceBars(ticker string, from time.Time, until *time.Time, tx *sql.Tx) ([]priceBar, error) {
+	var untilDate interface{}
+	if until != nil {
+		untilDate = *until
+	}
+	rows, err := tx.Query(`
+		SELECT date, COALESCE(open_price, 0), COALESCE(high_price, 0), COALESCE(low_price, 0)
+		FROM daily_stock_prices
+		WHERE ticker = $1 AND date >= $2::date
+			AND ($3::timestamptz IS NULL OR date <= $3::date)
+		ORDER BY date
+	`, ticker, from, untilDate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prices for %s: %v", ticker, err)
+	}
+	defer rows.Close()
+
+	var bars []priceBar
+	for rows.Next() {
+		var bar priceBar
+		if err := rows.Scan(&bar.Date, &bar.Open, &bar.High, &bar.Low); err != nil {
+			return nil, fmt.Errorf("failed to scan price: %v", err)
+		}
+		bars = append(bars, bar)
+	}
+	return bars, rows.Err()
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderFill(t *testing.T) {
+	placedAt := time.Date(2024, 3, 4, 9, 30, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	buy := Order{Side: Buy, LimitPrice: 2.5, PlacedAt: placedAt}
+	sell := Order{Side: Sell, LimitPrice: 3, PlacedAt: placedAt}
+
+	_, ok := buy.fill(priceBar{Date: day(4), Open: 2.7, High: 2.8, Low: 2.6})
+	assert.False(t, ok, "the low never reached the limit")
+
+	price, ok := buy.fill(priceBar{Date: day(4), Open: 2.4, High: 2.8, Low: 2.4})
+	assert.True(t, ok)
+	assert.Equal(t, 2.5, price, "the open of the day the order was placed came before it")
+
+	price, ok = buy.fill(priceBar{Date: day(5), Open: 2.4, High: 2.6, Low: 2.3})
+	assert.True(t, ok)
+	assert.Equal(t, 2.4, price, "a later day opening below the limit fills at the open")
+
+	price, ok = sell.fill(priceBar{Date: day(6), Open: 2.9, High: 3.1, Low: 2.9})
+	assert.True(t, ok)
+	assert.Equal(t, 3.0, price)
+
+	_, ok = sell.fill(priceBar{Date: day(7)})
+	assert.False(t, ok, "days without trades do not fill")
+}
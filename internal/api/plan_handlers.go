@@ -0,0 +1,735 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PlanFrequency is how often a plan comes due
+type PlanFrequency string
+
+const (
+	Weekly    PlanFrequency = "WEEKLY"
+	Monthly   PlanFrequency = "MONTHLY"
+	Quarterly PlanFrequency = "QUARTERLY"
+)
+
+// planSchedulerClient names the plan scheduler in the audit log
+const planSchedulerClient = "plan-scheduler"
+
+// Plan is a recurring contribution: on each due date it drafts a deposit of
+// amount and purchases of its basket worth amount, split by weight
+type Plan struct {
+	ID          int              `json:"id"`
+	PortfolioID int              `json:"portfolio_id"`
+	Name        string           `json:"name"`
+	Frequency   PlanFrequency    `json:"frequency"`
+	StartDate   time.Time        `json:"start_date"`
+	EndDate     *time.Time       `json:"end_date"`
+	Amount      float64          `json:"amount"`
+	Deposit     bool             `json:"deposit"` // Draft a deposit, or buy from the cash already held
+	Active      bool             `json:"active"`
+	NextDueDate *time.Time       `json:"next_due_date"` // nil once the plan has ended
+	Allocations []PlanAllocation `json:"allocations"`
+	Notes       string           `json:"notes"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+
+	occurrences int
+}
+
+// PlanAllocation is a ticker of a plan's basket and its relative weight
+type PlanAllocation struct {
+	Ticker string  `json:"ticker"`
+	Weight float64 `json:"weight"`
+}
+
+// PlanRequest creates or replaces a plan
+type PlanRequest struct {
+	Name        string           `json:"name"`
+	Frequency   PlanFrequency    `json:"frequency"`
+	StartDate   string           `json:"start_date"` // YYYY-MM-DD
+	EndDate     string           `json:"end_date"`   // YYYY-MM-DD, optional
+	Amount      float64          `json:"amount"`
+	Deposit     *bool            `json:"deposit"` // Defaults to true
+	Active      *bool            `json:"active"`  // Defaults to true
+	Allocations []PlanAllocation `json:"allocations"`
+	Notes       string           `json:"notes"`
+}
+
+// parse validates a plan request
+func (r PlanRequest) parse() (Plan, error) {
+	p := Plan{
+		Name:        strings.TrimSpace(r.Name),
+		Frequency:   PlanFrequency(strings.ToUpper(string(r.Frequency))),
+		Amount:      r.Amount,
+		Deposit:     r.Deposit == nil || *r.Deposit,
+		Active:      r.Active == nil || *r.Active,
+		Allocations: []PlanAllocation{},
+		Notes:       r.Notes,
+	}
+	if p.Name == "" {
+		return p, fmt.Errorf("name is required")
+	}
+	switch p.Frequency {
+	case Weekly, Monthly, Quarterly:
+	default:
+		return p, fmt.Errorf("frequency must be %s, %s or %s", Weekly, Monthly, Quarterly)
+	}
+	var err error
+	if p.StartDate, err = time.Parse("2006-01-02", r.StartDate); err != nil {
+		return p, fmt.Errorf("invalid start_date: %q", r.StartDate)
+	}
+	if r.EndDate != "" {
+		endDate, err := time.Parse("2006-01-02", r.EndDate)
+		if err != nil {
+			return p, fmt.Errorf("invalid end_date: %q", r.EndDate)
+		}
+		if endDate.Before(p.StartDate) {
+			return p, fmt.Errorf("end_date cannot be before start_date")
+		}
+		p.EndDate = &endDate
+	}
+	if p.Amount <= 0 {
+		return p, fmt.Errorf("amount must be positive")
+	}
+	if !p.Deposit && len(r.Allocations) == 0 {
+		return p, fmt.Errorf("a plan without a deposit needs allocations")
+	}
+	seen := make(map[string]bool)
+	for _, a := range r.Allocations {
+		a.Ticker = strings.ToUpper(strings.TrimSpace(a.Ticker))
+		if a.Ticker == "" {
+			return p, fmt.Errorf("allocation ticker is required")
+		}
+		if a.Weight <= 0 {
+			return p, fmt.Errorf("weight must be positive for %s", a.Ticker)
+		}
+		if seen[a.Ticker] {
+			return p, fmt.Errorf("%s is allocated more than once", a.Ticker)
+		}
+		seen[a.Ticker] = true
+		p.Allocations = append(p.Allocations, a)
+	}
+	return p, nil
+}
+
+// dueDate returns the nth due date of the plan, counting from zero. Monthly
+// and quarterly dates past the end of a month fall on its last day.
+func (p *Plan) dueDate(n int) time.Time {
+	switch p.Frequency {
+	case Weekly:
+		return p.StartDate.AddDate(0, 0, 7*n)
+	case Quarterly:
+		return addMonthsClamped(p.StartDate, 3*n)
+	default:
+		return addMonthsClamped(p.StartDate, n)
+	}
+}
+
+// addMonthsClamped adds months to a date, keeping it in the resulting month
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// nextDueDate returns the due date after the ones already drafted, or nil
+// when the plan has ended
+func (p *Plan) nextDueDate() *time.Time {
+	due := p.dueDate(p.occurrences)
+	if p.EndDate != nil && due.After(*p.EndDate) {
+		return nil
+	}
+	return &due
+}
+
+// planShares returns the whole shares a budget buys at a price, leaving room
+// for the fee
+func planShares(budget, price float64, fee func(shares float64) float64) float64 {
+	if price <= 0 {
+		return 0
+	}
+	shares := math.Floor(budget / price)
+	for shares > 0 && shares*price+fee(shares) > budget+ledgerEpsilon {
+		shares--
+	}
+	return shares
+}
+
+const planColumns = `
+	id, portfolio_id, name, frequency, start_date, end_date, amount, deposit, active,
+	occurrences, next_due_date, COALESCE(notes, ''), created_at, updated_at`
+
+func scanPlan(row scanner) (Plan, error) {
+	var p Plan
+	var endDate, nextDueDate sql.NullTime
+	err := row.Scan(
+		&p.ID, &p.PortfolioID, &p.Name, &p.Frequency, &p.StartDate, &endDate, &p.Amount, &p.Deposit, &p.Active,
+		&p.occurrences, &nextDueDate, &p.Notes, &p.CreatedAt, &p.UpdatedAt,
+	)
+	if endDate.Valid {
+		p.EndDate = &endDate.Time
+	}
+	if nextDueDate.Valid {
+		p.NextDueDate = &nextDueDate.Time
+	}
+	p.Allocations = []PlanAllocation{}
+	return p, err
+}
+
+// loadPlanAllocations fills in the basket of a plan
+func (s *Server) loadPlanAllocations(p *Plan, tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT ticker, weight
+		FROM portfolio_plan_allocations
+		WHERE plan_id = $1
+		ORDER BY weight DESC, ticker
+	`, p.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get plan allocations: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a PlanAllocation
+		if err := rows.Scan(&a.Ticker, &a.Weight); err != nil {
+			return fmt.Errorf("failed to scan plan allocation: %v", err)
+		}
+		p.Allocations = append(p.Allocations, a)
+	}
+	return rows.Err()
+}
+
+// savePlanAllocations replaces the basket of a plan
+func (s *Server) savePlanAllocations(p *Plan, tx *sql.Tx) error {
+	if _, err := tx.Exec(`DELETE FROM portfolio_plan_allocations WHERE plan_id = $1`, p.ID); err != nil {
+		return fmt.Errorf("failed to clear plan allocations: %v", err)
+	}
+	for _, a := range p.Allocations {
+		if err := s.validateTicker(a.Ticker, tx); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO portfolio_plan_allocations (plan_id, ticker, weight)
+			VALUES ($1, $2, $3)
+		`, p.ID, a.Ticker, a.Weight)
+		if err != nil {
+			return fmt.Errorf("failed to save allocation for %s: %v", a.Ticker, err)
+		}
+	}
+	return nil
+}
+
+// getPlan returns a plan of a portfolio with its basket, locked for the
+// rest of the DB transaction
+func (s *Server) getPlan(portfolioID, planID int, tx *sql.Tx) (*Plan, error) {
+	return s.selectPlan(portfolioID, planID, tx, "FOR UPDATE")
+}
+
+// readPlan is getPlan without the row lock, for read-only transactions
+func (s *Server) readPlan(portfolioID, planID int, tx *sql.Tx) (*Plan, error) {
+	return s.selectPlan(portfolioID, planID, tx, "")
+}
+
+func (s *Server) selectPlan(portfolioID, planID int, tx *sql.Tx, locking string) (*Plan, error) {
+	p, err := scanPlan(tx.QueryRow(`
+		SELECT `+planColumns+`
+		FROM portfolio_plans
+		WHERE portfolio_id = $1 AND id = $2
+		`+locking, portfolioID, planID))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadPlanAllocations(&p, tx); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// planIDs parses the portfolio and plan IDs of a plan route
+func planIDs(r *http.Request) (int, int, error) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid portfolio ID")
+	}
+	planID, err := strconv.Atoi(vars["planId"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid plan ID")
+	}
+	return portfolioID, planID, nil
+}
+
+// ListPlans lists the plans of a portfolio
+func (s *Server) ListPlans(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	tx, err := s.beginSnapshotTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT `+planColumns+`
+		FROM portfolio_plans
+		WHERE portfolio_id = $1
+		ORDER BY name, id
+	`, portfolioID)
+	if err != nil {
+		s.logger.Error("Failed to list plans: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list plans")
+		return
+	}
+	plans := []Plan{}
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			rows.Close()
+			s.logger.Error("Failed to scan plan: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list plans")
+			return
+		}
+		plans = append(plans, p)
+	}
+	rows.Close()
+
+	for i := range plans {
+		if err := s.loadPlanAllocations(&plans[i], tx); err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	s.respondWithJSON(w, http.StatusOK, plans)
+}
+
+// GetPlan returns one plan of a portfolio
+func (s *Server) GetPlan(w http.ResponseWriter, r *http.Request) {
+	portfolioID, planID, err := planIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginSnapshotTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	p, err := s.readPlan(portfolioID, planID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get plan: %v", err))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, p)
+}
+
+// CreatePlan stores a new plan. Due dates from start_date on are drafted by
+// the scheduler, including ones already past.
+func (s *Server) CreatePlan(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	p, err := req.parse()
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.PortfolioID = portfolioID
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	var endDate interface{}
+	if p.EndDate != nil {
+		endDate = *p.EndDate
+	}
+	var nextDueDate interface{}
+	if next := p.nextDueDate(); next != nil {
+		nextDueDate = *next
+	}
+	err = tx.QueryRow(`
+		INSERT INTO portfolio_plans (
+			portfolio_id, name, frequency, start_date, end_date, amount, deposit, active,
+			next_due_date, notes
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, portfolioID, p.Name, p.Frequency, p.StartDate, endDate, p.Amount, p.Deposit, p.Active,
+		nextDueDate, p.Notes).Scan(&p.ID)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create plan: %v", err))
+		return
+	}
+	if err := s.savePlanAllocations(&p, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	created, err := s.getPlan(portfolioID, p.ID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get plan: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusCreated, created)
+}
+
+// UpdatePlan replaces a plan. Changing its schedule restarts it from the
+// first due date after today, so drafted dates are not drafted again.
+func (s *Server) UpdatePlan(w http.ResponseWriter, r *http.Request) {
+	portfolioID, planID, err := planIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	p, err := req.parse()
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	existing, err := s.getPlan(portfolioID, planID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get plan: %v", err))
+		return
+	}
+
+	p.ID, p.PortfolioID, p.occurrences = existing.ID, existing.PortfolioID, existing.occurrences
+	if p.Frequency != existing.Frequency || !p.StartDate.Equal(existing.StartDate) {
+		today := time.Now()
+		p.occurrences = 0
+		for !p.dueDate(p.occurrences).After(today) {
+			p.occurrences++
+		}
+	}
+
+	var endDate interface{}
+	if p.EndDate != nil {
+		endDate = *p.EndDate
+	}
+	var nextDueDate interface{}
+	if next := p.nextDueDate(); next != nil {
+		nextDueDate = *next
+	}
+	_, err = tx.Exec(`
+		UPDATE portfolio_plans
+		SET name = $2, frequency = $3, start_date = $4, end_date = $5, amount = $6,
+			deposit = $7, active = $8, occurrences = $9, next_due_date = $10, notes = $11,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, p.ID, p.Name, p.Frequency, p.StartDate, endDate, p.Amount,
+		p.Deposit, p.Active, p.occurrences, nextDueDate, p.Notes)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update plan: %v", err))
+		return
+	}
+	if err := s.savePlanAllocations(&p, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	updated, err := s.getPlan(portfolioID, planID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get plan: %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, updated)
+}
+
+// DeletePlan removes a plan. Its pending drafts are dismissed.
+func (s *Server) DeletePlan(w http.ResponseWriter, r *http.Request) {
+	portfolioID, planID, err := planIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE portfolio_draft_transactions
+		SET status = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE portfolio_id = $1 AND plan_id = $2 AND status = $4
+	`, portfolioID, planID, DraftDismissed, DraftPending)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to dismiss drafts: %v", err))
+		return
+	}
+
+	result, err := tx.Exec(`DELETE FROM portfolio_plans WHERE portfolio_id = $1 AND id = $2`, portfolioID, planID)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete plan: %v", err))
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		s.respondWithError(w, http.StatusNotFound, "Plan not found")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Plan %d deleted successfully", planID),
+	})
+}
+
+// RunPlans drafts the plans that are due now instead of on the next
+// scheduler run
+func (s *Server) RunPlans(w http.ResponseWriter, r *http.Request) {
+	drafted, err := s.runPlans(time.Now())
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.respondWithJSON(w, http.StatusOK, map[string]int{"drafted": drafted})
+}
+
+// startPlanScheduler drafts due plans at startup and then hourly
+func (s *Server) startPlanScheduler() {
+	run := func() {
+		if drafted, err := s.runPlans(time.Now()); err != nil {
+			s.logger.Error("Plan scheduler failed: %v", err)
+		} else if drafted > 0 {
+			s.logger.Info("Plan scheduler drafted %d transactions", drafted)
+		}
+	}
+
+	go run()
+
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-s.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// runPlans drafts every due date up to now of the active plans and returns
+// the number of drafts created. Each plan is drafted in its own DB
+// transaction, so a failing plan does not hold up the others.
+func (s *Server) runPlans(now time.Time) (int, error) {
+	rows, err := s.db.Query(`
+		SELECT portfolio_id, id
+		FROM portfolio_plans
+		WHERE active AND next_due_date <= $1::date
+		ORDER BY next_due_date, id
+	`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due plans: %v", err)
+	}
+	var due [][2]int
+	for rows.Next() {
+		var ids [2]int
+		if err := rows.Scan(&ids[0], &ids[1]); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan plan: %v", err)
+		}
+		due = append(due, ids)
+	}
+	rows.Close()
+
+	total := 0
+	for _, ids := range due {
+		drafted, err := s.runPlan(ids[0], ids[1], now)
+		if err != nil {
+			s.logger.Error("Failed to draft plan %d: %v", ids[1], err)
+			continue
+		}
+		total += drafted
+	}
+	return total, nil
+}
+
+// runPlan drafts the due dates of one plan up to now
+func (s *Server) runPlan(portfolioID, planID int, now time.Time) (int, error) {
+	tx, err := s.beginTaggedTx(newRequestID(), planSchedulerClient)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	p, err := s.getPlan(portfolioID, planID, tx)
+	if err != nil {
+		return 0, err
+	}
+	schedule, err := s.getPortfolioFeeSchedule(portfolioID, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	drafted := 0
+	for next := p.nextDueDate(); next != nil && !next.After(now); next = p.nextDueDate() {
+		drafts := s.planDrafts(p, *next, schedule, tx)
+		for _, d := range drafts {
+			if err := s.insertDraft(d, tx); err != nil {
+				return 0, err
+			}
+		}
+		drafted += len(drafts)
+		p.occurrences++
+	}
+
+	var nextDueDate interface{}
+	if next := p.nextDueDate(); next != nil {
+		nextDueDate = *next
+	}
+	_, err = tx.Exec(`
+		UPDATE portfolio_plans
+		SET occurrences = $2, next_due_date = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, p.ID, p.occurrences, nextDueDate)
+	if err != nil {
+		return 0, fmt.Errorf("failed to advance plan: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return drafted, nil
+}
+
+// planDrafts returns the drafts of a plan for a due date: the deposit, then
+// whole shares of each basket ticker at its latest close, within its share
+// of the amount after fees. Tickers without a price are skipped.
+func (s *Server) planDrafts(p *Plan, due time.Time, schedule *FeeSchedule, tx *sql.Tx) []DraftTransaction {
+	notes := fmt.Sprintf("Plan %s, %s", p.Name, due.Format("2006-01-02"))
+	planID := p.ID
+	var drafts []DraftTransaction
+	if p.Deposit {
+		drafts = append(drafts, DraftTransaction{
+			PortfolioID:   p.PortfolioID,
+			PlanID:        &planID,
+			Type:          Deposit,
+			Amount:        p.Amount,
+			TransactionAt: due,
+			Notes:         notes,
+		})
+	}
+
+	totalWeight := 0.0
+	for _, a := range p.Allocations {
+		totalWeight += a.Weight
+	}
+	for _, a := range p.Allocations {
+		price, err := s.getClosePrice(a.Ticker, due, tx)
+		if err != nil {
+			s.logger.Error("Plan %d: skipping %s: %v", p.ID, a.Ticker, err)
+			continue
+		}
+		fee := func(shares float64) float64 {
+			if schedule == nil {
+				return 0
+			}
+			return schedule.Compute(TransactionRequest{Type: Buy, Shares: shares, Price: price}).Total
+		}
+		budget := p.Amount * a.Weight / totalWeight
+		shares := planShares(budget, price, fee)
+		if shares <= 0 {
+			s.logger.Info("Plan %d: %.2f does not buy a share of %s at %.2f", p.ID, budget, a.Ticker, price)
+			continue
+		}
+		drafts = append(drafts, DraftTransaction{
+			PortfolioID:   p.PortfolioID,
+			PlanID:        &planID,
+			Type:          Buy,
+			Ticker:        a.Ticker,
+			Shares:        shares,
+			Price:         price,
+			Amount:        shares*price + fee(shares),
+			TransactionAt: due,
+			Notes:         notes,
+		})
+	}
+	return drafts
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanDueDate(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	monthly := Plan{Frequency: Monthly, StartDate: date(2024, 1, 31)}
+
+	assert.Equal(t, date(2024, 2, 29), monthly.dueDate(1), "month ends are clamped")
+	assert.Equal(t, date(2024, 3, 31), monthly.dueDate(2), "clamping does not drift")
+
+	quarterly := Plan{Frequency: Quarterly, StartDate: date(2024, 11, 30)}
+	assert.Equal(t, date(2025, 2, 28), quarterly.dueDate(1))
+
+	weekly := Plan{Frequency: Weekly, StartDate: date(2024, 1, 1)}
+	assert.Equal(t, date(2024, 1, 15), weekly.dueDate(2))
+
+	end := date(2024, 3, 1)
+	monthly.EndDate = &end
+	monthly.occurrences = 1
+	assert.Equal(t, date(2024, 2, 29), *monthly.nextDueDate())
+	monthly.occurrences = 2
+	assert.Nil(t, monthly.nextDueDate(), "the plan has ended")
+}
+
+func TestPlanShares(t *testing.T) {
+	noFee := func(float64) float64 { return 0 }
+	assert.Equal(t, 400.0, planShares(1000, 2.5, noFee))
+
+	fee := func(shares float64) float64 { return shares * 2.5 * 0.01 }
+	assert.Equal(t, 396.0, planShares(1000, 2.5, fee), "shares are reduced to leave room for the fee")
+
+	assert.Equal(t, 0.0, planShares(2, 2.5, noFee))
+}
@@ -3,10 +3,12 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"localportfoliomanager/internal/reporting"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"localportfoliomanager/internal/utils"
@@ -16,16 +18,19 @@ import (
 
 // Portfolio types for request/response
 type Portfolio struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	Description     string          `json:"description"`
+	CostBasisMethod CostBasisMethod `json:"cost_basis_method"`
+	FeeScheduleID   *int            `json:"fee_schedule_id"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
 }
 
 type CreatePortfolioRequest struct {
-	Name        string `json:"name" validate:"required"`
-	Description string `json:"description"`
+	Name            string          `json:"name" validate:"required"`
+	Description     string          `json:"description"`
+	CostBasisMethod CostBasisMethod `json:"cost_basis_method"` // Defaults to FIFO
 }
 
 type PortfolioHandler struct {
@@ -57,23 +62,40 @@ func (s *Server) CreatePortfolio(w http.ResponseWriter, r *http.Request) {
 		s.respondWithError(w, http.StatusBadRequest, "Portfolio name is required")
 		return
 	}
+	if req.CostBasisMethod == "" {
+		req.CostBasisMethod = CostBasisFIFO
+	}
+	if !req.CostBasisMethod.Valid() {
+		s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid cost basis method: %s", req.CostBasisMethod))
+		return
+	}
 
 	// Insert into database
 	query := `
-		INSERT INTO portfolios (name, description)
-		VALUES ($1, $2)
-		RETURNING id, name, description, created_at, updated_at
+		INSERT INTO portfolios (name, description, cost_basis_method)
+		VALUES ($1, $2, $3)
+		RETURNING id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
 	`
 
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
 	var portfolio Portfolio
-	err = s.db.QueryRow(
+	err = tx.QueryRow(
 		query,
 		req.Name,
 		req.Description,
+		req.CostBasisMethod,
 	).Scan(
 		&portfolio.ID,
 		&portfolio.Name,
 		&portfolio.Description,
+		&portfolio.CostBasisMethod,
+		&portfolio.FeeScheduleID,
 		&portfolio.CreatedAt,
 		&portfolio.UpdatedAt,
 	)
@@ -84,13 +106,18 @@ func (s *Server) CreatePortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
 	s.respondWithJSON(w, http.StatusCreated, portfolio)
 }
 
 // ListPortfolios returns all portfolios
 func (s *Server) ListPortfolios(w http.ResponseWriter, r *http.Request) {
 	query := `
-		SELECT id, name, description, created_at, updated_at
+		SELECT id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
 		FROM portfolios
 		ORDER BY created_at DESC
 	`
@@ -110,6 +137,8 @@ func (s *Server) ListPortfolios(w http.ResponseWriter, r *http.Request) {
 			&p.ID,
 			&p.Name,
 			&p.Description,
+			&p.CostBasisMethod,
+			&p.FeeScheduleID,
 			&p.CreatedAt,
 			&p.UpdatedAt,
 		)
@@ -134,7 +163,7 @@ func (s *Server) GetPortfolio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := `
-		SELECT id, name, description, created_at, updated_at
+		SELECT id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
 		FROM portfolios
 		WHERE id = $1
 	`
@@ -144,6 +173,8 @@ func (s *Server) GetPortfolio(w http.ResponseWriter, r *http.Request) {
 		&portfolio.ID,
 		&portfolio.Name,
 		&portfolio.Description,
+		&portfolio.CostBasisMethod,
+		&portfolio.FeeScheduleID,
 		&portfolio.CreatedAt,
 		&portfolio.UpdatedAt,
 	)
@@ -174,7 +205,7 @@ func (s *Server) DeletePortfolio(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("Attempting to delete portfolio with ID: %d", id)
 
 	// Start transaction
-	tx, err := s.db.Begin()
+	tx, err := s.beginTx(r)
 	if err != nil {
 		s.logger.Error("Failed to start transaction: %v", err)
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to start delete operation")
@@ -182,6 +213,18 @@ func (s *Server) DeletePortfolio(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	// The other side of a transfer would be left unbalanced
+	conflict, err := s.transferConflict(id, tx)
+	if err != nil {
+		s.logger.Error("Failed to check transfers: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to check transfers")
+		return
+	}
+	if conflict != "" {
+		s.respondWithError(w, http.StatusConflict, conflict)
+		return
+	}
+
 	// First, delete any related records (if they exist)
 	deleteRelatedQuery := `DELETE FROM portfolio_transactions WHERE portfolio_id = $1`
 	_, err = tx.Exec(deleteRelatedQuery, id)
@@ -254,14 +297,23 @@ func (s *Server) RenamePortfolio(w http.ResponseWriter, r *http.Request) {
 		UPDATE portfolios
 		SET name = $1, description = $2, updated_at = NOW()
 		WHERE id = $3
-		RETURNING id, name, description, created_at, updated_at
+		RETURNING id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
 	`
 
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
 	var portfolio Portfolio
-	err = s.db.QueryRow(query, req.NewName, req.Description, id).Scan(
+	err = tx.QueryRow(query, req.NewName, req.Description, id).Scan(
 		&portfolio.ID,
 		&portfolio.Name,
 		&portfolio.Description,
+		&portfolio.CostBasisMethod,
+		&portfolio.FeeScheduleID,
 		&portfolio.CreatedAt,
 		&portfolio.UpdatedAt,
 	)
@@ -276,6 +328,78 @@ func (s *Server) RenamePortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, portfolio)
+}
+
+// SetCostBasisMethod changes the cost-basis policy of a portfolio and replays
+// its ledger, so lots, holdings and realized gains follow the new method
+func (s *Server) SetCostBasisMethod(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req struct {
+		Method CostBasisMethod `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !req.Method.Valid() {
+		s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid cost basis method: %s", req.Method))
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var portfolio Portfolio
+	err = tx.QueryRow(`
+		UPDATE portfolios
+		SET cost_basis_method = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING id, name, description, cost_basis_method, fee_schedule_id, created_at, updated_at
+	`, req.Method, id).Scan(
+		&portfolio.ID,
+		&portfolio.Name,
+		&portfolio.Description,
+		&portfolio.CostBasisMethod,
+		&portfolio.FeeScheduleID,
+		&portfolio.CreatedAt,
+		&portfolio.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to update cost basis method: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to update cost basis method")
+		return
+	}
+
+	if _, err := s.replayLedger(id, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
 	s.respondWithJSON(w, http.StatusOK, portfolio)
 }
 
@@ -289,7 +413,7 @@ func (s *Server) GetPortfolioHoldings(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Start transaction
-	tx, err := s.db.Begin()
+	tx, err := s.beginTx(r)
 	if err != nil {
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
 		return
@@ -441,12 +565,21 @@ func (s *Server) GetPortfolioSummary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Figures are in the ledger currency unless another one is requested.
+	// Holdings are converted at the latest rate and realized gains at the rate
+	// on the day of each sale.
+	currency, err := normalizeCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// Updated query to include realized gains from transactions
 	query := `
 		WITH portfolio_totals AS (
 			SELECT 
 				SUM(CASE 
-					WHEN ticker = 'CASH' THEN shares 
+					WHEN ticker = 'CASH' THEN 0
 					ELSE shares * COALESCE(current_price, purchase_cost_average)
 				END) as total_value,
 				SUM(CASE 
@@ -464,32 +597,45 @@ func (s *Server) GetPortfolioSummary(w http.ResponseWriter, r *http.Request) {
 			FROM portfolio_holdings h
 			WHERE h.portfolio_id = $1
 		),
+		cash AS (
+			SELECT SUM(balance * fx_rate(currency, $2, $3)) as total_cash
+			FROM portfolio_cash_balances
+			WHERE portfolio_id = $1 AND balance <> 0
+		),
 		realized_gains AS (
 			SELECT 
-				COALESCE(SUM(realized_gain_avg), 0) as total_realized_gain_avg,
-				COALESCE(SUM(realized_gain_fifo), 0) as total_realized_gain_fifo
+				COALESCE(SUM(realized_gain_avg * fx_rate(currency, $2, transaction_at)), 0) as total_realized_gain_avg,
+				COALESCE(SUM(realized_gain_fifo * fx_rate(currency, $2, transaction_at)), 0) as total_realized_gain_fifo
 			FROM portfolio_transactions
 			WHERE portfolio_id = $1 AND type = 'SELL'
+		),
+		converted_totals AS (
+			SELECT
+				COALESCE(pt.total_value, 0) * fx_rate($4, $2, $3) + COALESCE(c.total_cash, 0) as total_value,
+				COALESCE(pt.total_cost_average, 0) * fx_rate($4, $2, $3) as total_cost_average,
+				COALESCE(pt.total_cost_fifo, 0) * fx_rate($4, $2, $3) as total_cost_fifo
+			FROM portfolio_totals pt, cash c
 		)
 		SELECT 
 			p.name,
 			p.description,
-			COALESCE(pt.total_value, 0) as total_value,
-			COALESCE(pt.total_cost_average, 0) as total_cost_average,
-			COALESCE(pt.total_cost_fifo, 0) as total_cost_fifo,
-			COALESCE(pt.total_value - pt.total_cost_average + rg.total_realized_gain_avg, 0) as total_gain_average,
-			COALESCE(pt.total_value - pt.total_cost_fifo + rg.total_realized_gain_fifo, 0) as total_gain_fifo,
-			COALESCE(rg.total_realized_gain_avg, 0) as realized_gain_average,
-			COALESCE(rg.total_realized_gain_fifo, 0) as realized_gain_fifo,
+			ct.total_value,
+			ct.total_cost_average,
+			ct.total_cost_fifo,
+			ct.total_value - ct.total_cost_average + rg.total_realized_gain_avg as total_gain_average,
+			ct.total_value - ct.total_cost_fifo + rg.total_realized_gain_fifo as total_gain_fifo,
+			rg.total_realized_gain_avg as realized_gain_average,
+			rg.total_realized_gain_fifo as realized_gain_fifo,
+			p.cost_basis_method,
 			p.created_at,
 			p.updated_at
 		FROM portfolios p
-		LEFT JOIN portfolio_totals pt ON true
+		LEFT JOIN converted_totals ct ON true
 		LEFT JOIN realized_gains rg ON true
 		WHERE p.id = $1`
 
-	var summary PortfolioSummary
-	err = s.db.QueryRow(query, portfolioID).Scan(
+	summary := PortfolioSummary{Currency: currency}
+	err = s.db.QueryRow(query, portfolioID, currency, time.Now(), LedgerCurrency).Scan(
 		&summary.Name,
 		&summary.Description,
 		&summary.TotalValue,
@@ -499,6 +645,7 @@ func (s *Server) GetPortfolioSummary(w http.ResponseWriter, r *http.Request) {
 		&summary.TotalGainFIFO,
 		&summary.RealizedGainAverage,
 		&summary.RealizedGainFIFO,
+		&summary.CostBasisMethod,
 		&summary.CreatedAt,
 		&summary.UpdatedAt,
 	)
@@ -507,7 +654,36 @@ func (s *Server) GetPortfolioSummary(w http.ResponseWriter, r *http.Request) {
 		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
 		return
 	}
+	if isMissingFXRate(err) {
+		s.respondWithError(w, http.StatusBadRequest, fxRateErrorMessage(err))
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get portfolio summary: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Error fetching portfolio summary")
+		return
+	}
+
+	summary.CashBalances, err = s.getCashBalances(portfolioID)
 	if err != nil {
+		s.logger.Error("%v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Error fetching portfolio summary")
+		return
+	}
+
+	// Gains under each cost-basis method, or only the requested one
+	method := CostBasisMethod(strings.ToUpper(r.URL.Query().Get("method")))
+	if method != "" && !method.Valid() {
+		s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid cost basis method: %s", method))
+		return
+	}
+	summary.CostBasis, err = s.getCostBasisSummaries(portfolioID, method, currency)
+	if isMissingFXRate(err) {
+		s.respondWithError(w, http.StatusBadRequest, fxRateErrorMessage(err))
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to get cost basis comparison: %v", err)
 		s.respondWithError(w, http.StatusInternalServerError, "Error fetching portfolio summary")
 		return
 	}
@@ -515,6 +691,52 @@ func (s *Server) GetPortfolioSummary(w http.ResponseWriter, r *http.Request) {
 	s.respondWithJSON(w, http.StatusOK, summary)
 }
 
+// getCostBasisSummaries totals portfolio_cost_basis per method. Unrealized gains
+// use the current price of each holding, or no gain when it has no price.
+// Totals are converted to currency at the latest rate.
+func (s *Server) getCostBasisSummaries(portfolioID int, method CostBasisMethod, currency string) ([]CostBasisSummary, error) {
+	rows, err := s.db.Query(`
+		SELECT
+			cb.method,
+			SUM(cb.cost_basis) * fx_rate($3, $4, $5),
+			SUM(cb.realized_gain) * fx_rate($3, $4, $5),
+			SUM(CASE
+				WHEN h.current_price IS NULL THEN 0
+				ELSE cb.shares * h.current_price - cb.cost_basis
+			END) * fx_rate($3, $4, $5)
+		FROM portfolio_cost_basis cb
+		LEFT JOIN portfolio_holdings h
+			ON h.portfolio_id = cb.portfolio_id AND h.ticker = cb.ticker
+		WHERE cb.portfolio_id = $1 AND ($2 = '' OR cb.method = $2)
+		GROUP BY cb.method
+	`, portfolioID, string(method), LedgerCurrency, currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byMethod := make(map[CostBasisMethod]CostBasisSummary)
+	for rows.Next() {
+		var cb CostBasisSummary
+		if err := rows.Scan(&cb.Method, &cb.CostBasis, &cb.RealizedGain, &cb.UnrealizedGain); err != nil {
+			return nil, err
+		}
+		cb.TotalGain = cb.RealizedGain + cb.UnrealizedGain
+		byMethod[cb.Method] = cb
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	summaries := []CostBasisSummary{}
+	for _, m := range CostBasisMethods {
+		if cb, ok := byMethod[m]; ok {
+			summaries = append(summaries, cb)
+		}
+	}
+	return summaries, nil
+}
+
 // GetLots returns all FIFO lots for a portfolio
 func (s *Server) GetLots(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -606,7 +828,7 @@ func (h *PortfolioHandler) GetPerformanceReport(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	period := r.URL.Query().Get("period")
+	period := strings.ToUpper(r.URL.Query().Get("period"))
 	if period == "" {
 		period = "ALL"
 	}
@@ -620,7 +842,28 @@ func (h *PortfolioHandler) GetPerformanceReport(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	report, err := h.reportingService.GeneratePerformanceReport(portfolioID, period)
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	if method != "" && !CostBasisMethod(method).Valid() {
+		http.Error(w, fmt.Sprintf("Invalid cost basis method: %s", method), http.StatusBadRequest)
+		return
+	}
+
+	currency, err := normalizeCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.reportingService.GeneratePerformanceReport(portfolioID, period, method, currency, reporting.RiskOptions{})
+	var fxErr *reporting.FXRateError
+	if errors.As(err, &fxErr) {
+		http.Error(w, fxErr.Message, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, reporting.ErrUnknownPeriod) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error generating report: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -635,12 +878,16 @@ func (h *PortfolioHandler) GetPerformanceReport(w http.ResponseWriter, r *http.R
 		Data   struct {
 			PortfolioID     int                            `json:"portfolio_id"`
 			Name            string                         `json:"name"`
+			Currency        string                         `json:"currency"`
 			CurrentValue    float64                        `json:"current_value"`
 			CashBalance     float64                        `json:"cash_balance"`
 			StocksValue     float64                        `json:"stocks_value"`
 			RealizedGains   float64                        `json:"realized_gains"`
 			UnrealizedGains float64                        `json:"unrealized_gains"`
 			DividendIncome  float64                        `json:"dividend_income"`
+			InterestIncome  float64                        `json:"interest_income"`
+			AccountFees     float64                        `json:"account_fees"`
+			TaxesPaid       float64                        `json:"taxes_paid"`
 			TotalReturn     float64                        `json:"total_return"`
 			ReturnPercent   float64                        `json:"return_percent"`
 			Holdings        []reporting.HoldingPerformance `json:"holdings"`
@@ -650,24 +897,32 @@ func (h *PortfolioHandler) GetPerformanceReport(w http.ResponseWriter, r *http.R
 		Data: struct {
 			PortfolioID     int                            `json:"portfolio_id"`
 			Name            string                         `json:"name"`
+			Currency        string                         `json:"currency"`
 			CurrentValue    float64                        `json:"current_value"`
 			CashBalance     float64                        `json:"cash_balance"`
 			StocksValue     float64                        `json:"stocks_value"`
 			RealizedGains   float64                        `json:"realized_gains"`
 			UnrealizedGains float64                        `json:"unrealized_gains"`
 			DividendIncome  float64                        `json:"dividend_income"`
+			InterestIncome  float64                        `json:"interest_income"`
+			AccountFees     float64                        `json:"account_fees"`
+			TaxesPaid       float64                        `json:"taxes_paid"`
 			TotalReturn     float64                        `json:"total_return"`
 			ReturnPercent   float64                        `json:"return_percent"`
 			Holdings        []reporting.HoldingPerformance `json:"holdings"`
 		}{
 			PortfolioID:     report.PortfolioID,
 			Name:            report.Name,
+			Currency:        report.Currency,
 			CurrentValue:    report.CurrentValue,
 			CashBalance:     report.CashBalance,
 			StocksValue:     report.StocksValue,
 			RealizedGains:   report.RealizedGains,
 			UnrealizedGains: report.UnrealizedGains,
 			DividendIncome:  report.DividendIncome,
+			InterestIncome:  report.InterestIncome,
+			AccountFees:     report.AccountFees,
+			TaxesPaid:       report.TaxesPaid,
 			TotalReturn:     report.TotalReturn,
 			ReturnPercent:   report.ReturnPercent,
 			Holdings:        report.Holdings,
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RealizedGainLot is the part of a sale matched to one purchase lot
+type RealizedGainLot struct {
+	SaleTransactionID int       `json:"sale_transaction_id"`
+	Ticker            string    `json:"ticker"`
+	SoldAt            time.Time `json:"sold_at"`
+	LotID             int       `json:"lot_id"`
+	AcquiredAt        time.Time `json:"acquired_at"`
+	Shares            float64   `json:"shares"`
+	PurchasePrice     float64   `json:"purchase_price"`
+	SalePrice         float64   `json:"sale_price"`
+	Cost              float64   `json:"cost"`     // Shares at the purchase price plus their share of the purchase fee
+	Proceeds          float64   `json:"proceeds"` // Shares at the sale price less their share of the sale fee
+	Fees              float64   `json:"fees"`     // Purchase and sale fees allocated to the shares
+	Gain              float64   `json:"gain"`
+	HoldingDays       int       `json:"holding_days"`
+	Specified         bool      `json:"specified"` // Lot chosen on the sale rather than by the cost-basis method
+}
+
+// allocateFees splits the purchase fee of the lot and the sale fee of the sale
+// by the share of each matched to these shares, and computes cost, proceeds
+// and gain
+func (l *RealizedGainLot) allocateFees(purchaseFee, lotShares, saleFee, saleShares float64) {
+	buyFee, sellFee := 0.0, 0.0
+	if lotShares > 0 {
+		buyFee = purchaseFee * l.Shares / lotShares
+	}
+	if saleShares > 0 {
+		sellFee = saleFee * l.Shares / saleShares
+	}
+	l.Cost = l.Shares*l.PurchasePrice + buyFee
+	l.Proceeds = l.Shares*l.SalePrice - sellFee
+	l.Fees = buyFee + sellFee
+	l.Gain = l.Proceeds - l.Cost
+}
+
+// RealizedGainsReport lists the lots consumed by the sales of a portfolio
+type RealizedGainsReport struct {
+	PortfolioID   int                `json:"portfolio_id"`
+	Year          int                `json:"year,omitempty"`
+	Ticker        string             `json:"ticker,omitempty"`
+	Method        CostBasisMethod    `json:"cost_basis_method"`
+	Lots          []RealizedGainLot  `json:"lots"`
+	TotalCost     float64            `json:"total_cost"`
+	TotalProceeds float64            `json:"total_proceeds"`
+	Summary       TransactionSummary `json:"summary"`
+}
+
+// GetRealizedGains reports every sale of a portfolio broken down by the lots
+// it consumed, optionally limited to the sales of one calendar year (year)
+// and one ticker
+func (s *Server) GetRealizedGains(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	report := RealizedGainsReport{
+		PortfolioID: portfolioID,
+		Ticker:      strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("ticker"))),
+		Lots:        []RealizedGainLot{},
+	}
+	conditions := []string{"m.portfolio_id = $1", "t.type = 'SELL'"}
+	args := []interface{}{portfolioID}
+	if raw := r.URL.Query().Get("year"); raw != "" {
+		year, err := strconv.Atoi(raw)
+		if err != nil || year < 1900 || year > 9999 {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid year")
+			return
+		}
+		report.Year = year
+		start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		args = append(args, start, start.AddDate(1, 0, 0))
+		conditions = append(conditions, "t.transaction_at >= $2", "t.transaction_at < $3")
+	}
+	if report.Ticker != "" {
+		args = append(args, report.Ticker)
+		conditions = append(conditions, fmt.Sprintf("t.ticker = $%d", len(args)))
+	}
+
+	err = s.db.QueryRow(`SELECT cost_basis_method FROM portfolios WHERE id = $1`, portfolioID).Scan(&report.Method)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT
+			t.id, t.ticker, t.transaction_at, m.lot_id, l.purchase_date,
+			m.shares, COALESCE(m.purchase_price, 0), COALESCE(m.sale_price, 0),
+			m.specified,
+			COALESCE(lt.fee, 0), l.shares,
+			t.fee, t.shares,
+			t.transaction_at::date - l.purchase_date::date
+		FROM portfolio_lot_matches m
+		JOIN portfolio_transactions t ON t.id = m.sale_transaction_id
+		JOIN portfolio_stock_lots l ON l.id = m.lot_id
+		LEFT JOIN portfolio_transactions lt ON lt.id = l.transaction_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY t.transaction_at, t.id, m.id`, args...)
+	if err != nil {
+		s.logger.Error("Failed to fetch realized gains: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch realized gains")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l RealizedGainLot
+		var purchaseFee, lotShares, saleFee, saleShares float64
+		err := rows.Scan(
+			&l.SaleTransactionID, &l.Ticker, &l.SoldAt, &l.LotID, &l.AcquiredAt,
+			&l.Shares, &l.PurchasePrice, &l.SalePrice, &l.Specified,
+			&purchaseFee, &lotShares, &saleFee, &saleShares,
+			&l.HoldingDays,
+		)
+		if err != nil {
+			s.logger.Error("Error scanning realized gain: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch realized gains")
+			return
+		}
+		l.allocateFees(purchaseFee, lotShares, saleFee, saleShares)
+
+		report.Lots = append(report.Lots, l)
+		report.TotalCost += l.Cost
+		report.TotalProceeds += l.Proceeds
+		report.Summary.TotalFees += l.Fees
+		report.Summary.RealizedGains += l.Gain
+		report.Summary.NetCashFlow += l.Proceeds
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to fetch realized gains: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch realized gains")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealizedGainLotAllocateFees(t *testing.T) {
+	// 300 of a 1000-share lot bought at 2 with a 20 fee, sold as part of a
+	// 500-share sale at 3 with a 10 fee
+	l := RealizedGainLot{Shares: 300, PurchasePrice: 2, SalePrice: 3}
+	l.allocateFees(20, 1000, 10, 500)
+
+	assert.InDelta(t, 600+6, l.Cost, 0.0001)
+	assert.InDelta(t, 900-6, l.Proceeds, 0.0001)
+	assert.InDelta(t, 12, l.Fees, 0.0001)
+	assert.InDelta(t, 894-606, l.Gain, 0.0001)
+}
@@ -0,0 +1,407 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TargetAllocation is the share of a portfolio's value to hold in a ticker
+// or in CASH
+type TargetAllocation struct {
+	Ticker           string  `json:"ticker"`
+	TargetPercentage float64 `json:"target_percentage"`
+}
+
+// TargetAllocationRequest replaces the target allocation of a portfolio.
+// The percentages must add up to 100; holdings left out are targeted at 0.
+type TargetAllocationRequest struct {
+	Targets []TargetAllocation `json:"targets"`
+}
+
+// RebalanceRequest asks for the trades that bring a portfolio to its targets
+type RebalanceRequest struct {
+	Drafts bool `json:"drafts"` // Also save the trades as draft transactions
+}
+
+// RebalancePosition is a holding valued at its latest price, with the trade
+// that moves it to its target. The adjustment fields are also written to
+// portfolio_holdings.
+type RebalancePosition struct {
+	Ticker               string  `json:"ticker"`
+	Shares               float64 `json:"shares"`
+	Price                float64 `json:"price"`
+	Value                float64 `json:"value"`
+	TargetPercentage     float64 `json:"target_percentage"`
+	CurrentPercentage    float64 `json:"current_percentage"`
+	AdjustmentPercentage float64 `json:"adjustment_percentage"` // Target less current
+	AdjustmentValue      float64 `json:"adjustment_value"`      // Value of the trade, negative for a sale
+	AdjustmentQuantity   int64   `json:"adjustment_quantity"`   // Shares to buy, negative to sell
+	Fee                  float64 `json:"fee"`
+}
+
+// RebalancePlan is the result of rebalancing a portfolio
+type RebalancePlan struct {
+	PortfolioID int                 `json:"portfolio_id"`
+	PricedAt    time.Time           `json:"priced_at"`
+	TotalValue  float64             `json:"total_value"`
+	Cash        RebalancePosition   `json:"cash"`
+	CashAfter   float64             `json:"cash_after"`
+	Positions   []RebalancePosition `json:"positions"`
+	Drafted     int                 `json:"drafted,omitempty"`
+	Warnings    []string            `json:"warnings,omitempty"`
+}
+
+// rebalance computes whole-share trades that bring positions towards their
+// target percentages of the total value. Sales run first and their proceeds
+// fund the purchases; the most underweight positions are bought first, and
+// purchases never spend the cash the CASH target keeps. Positions without a
+// price are left out. It returns the cash left after the trades.
+func rebalance(cash, cashTarget float64, positions []RebalancePosition, fee func(tt TransactionType, shares, price float64) float64) float64 {
+	total := cash
+	for i := range positions {
+		p := &positions[i]
+		p.Value = p.Shares * p.Price
+		total += p.Value
+	}
+	if total <= 0 {
+		return cash
+	}
+
+	var underweight []*RebalancePosition
+	for i := range positions {
+		p := &positions[i]
+		if p.Price <= 0 {
+			continue
+		}
+		p.CurrentPercentage = p.Value / total * 100
+		p.AdjustmentPercentage = p.TargetPercentage - p.CurrentPercentage
+
+		target := total * p.TargetPercentage / 100
+		switch {
+		case target < p.Value:
+			shares := math.Min(math.Floor((p.Value-target)/p.Price), math.Floor(p.Shares))
+			if p.TargetPercentage == 0 {
+				shares = math.Floor(p.Shares)
+			}
+			if shares <= 0 {
+				continue
+			}
+			p.Fee = fee(Sell, shares, p.Price)
+			p.AdjustmentQuantity = -int64(shares)
+			p.AdjustmentValue = -shares * p.Price
+			cash += shares*p.Price - p.Fee
+		case target > p.Value:
+			underweight = append(underweight, p)
+		}
+	}
+
+	sort.SliceStable(underweight, func(i, j int) bool {
+		return underweight[i].AdjustmentPercentage > underweight[j].AdjustmentPercentage
+	})
+	available := cash - total*cashTarget/100
+	for _, p := range underweight {
+		budget := math.Min(total*p.TargetPercentage/100-p.Value, available)
+		price := p.Price
+		shares := planShares(budget, price, func(shares float64) float64 {
+			return fee(Buy, shares, price)
+		})
+		if shares <= 0 {
+			continue
+		}
+		p.Fee = fee(Buy, shares, price)
+		p.AdjustmentQuantity = int64(shares)
+		p.AdjustmentValue = shares * price
+		available -= p.AdjustmentValue + p.Fee
+		cash -= p.AdjustmentValue + p.Fee
+	}
+	return cash
+}
+
+// GetTargetAllocation lists the target percentages of a portfolio
+func (s *Server) GetTargetAllocation(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT ticker, target_percentage
+		FROM portfolio_holdings
+		WHERE portfolio_id = $1 AND target_percentage IS NOT NULL
+		ORDER BY ticker = 'CASH', target_percentage DESC, ticker
+	`, portfolioID)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch target allocation")
+		return
+	}
+	defer rows.Close()
+
+	targets := []TargetAllocation{}
+	for rows.Next() {
+		var t TargetAllocation
+		if err := rows.Scan(&t.Ticker, &t.TargetPercentage); err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch target allocation")
+			return
+		}
+		targets = append(targets, t)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, targets)
+}
+
+// SetTargetAllocation replaces the target percentages of a portfolio
+func (s *Server) SetTargetAllocation(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req TargetAllocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	total := 0.0
+	seen := make(map[string]bool)
+	for i := range req.Targets {
+		t := &req.Targets[i]
+		t.Ticker = strings.ToUpper(strings.TrimSpace(t.Ticker))
+		if t.TargetPercentage < 0 || t.TargetPercentage > 100 {
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Target of %s must be between 0 and 100", t.Ticker))
+			return
+		}
+		if seen[t.Ticker] {
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Duplicate target for %s", t.Ticker))
+			return
+		}
+		seen[t.Ticker] = true
+		total += t.TargetPercentage
+	}
+	if math.Abs(total-100) > 0.01 {
+		s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Targets add up to %.2f%%, expected 100%%", total))
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE portfolio_holdings SET target_percentage = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE portfolio_id = $1 AND target_percentage IS NOT NULL
+	`, portfolioID)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to clear targets: %v", err))
+		return
+	}
+	for _, t := range req.Targets {
+		if err := s.validateTicker(t.Ticker, tx); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, err := tx.Exec(`
+			INSERT INTO portfolio_holdings (portfolio_id, ticker, shares, target_percentage)
+			VALUES ($1, $2, 0, $3)
+			ON CONFLICT (portfolio_id, ticker) DO UPDATE SET
+				target_percentage = EXCLUDED.target_percentage,
+				updated_at = CURRENT_TIMESTAMP
+		`, portfolioID, t.Ticker, t.TargetPercentage)
+		if err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to set target of %s: %v", t.Ticker, err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, req.Targets)
+}
+
+// Rebalance values a portfolio at the latest close prices, computes the
+// trades that bring it to its target allocation and writes the current and
+// adjustment columns of its holdings. With drafts the trades are also saved
+// as draft transactions, sales first.
+func (s *Server) Rebalance(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	var req RebalanceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	plan := RebalancePlan{
+		PortfolioID: portfolioID,
+		PricedAt:    time.Now(),
+		Cash:        RebalancePosition{Ticker: "CASH", Price: 1},
+		Positions:   []RebalancePosition{},
+	}
+	rows, err := tx.Query(`
+		SELECT ticker, shares, target_percentage, COALESCE(current_price, 0)
+		FROM portfolio_holdings
+		WHERE portfolio_id = $1 AND (shares <> 0 OR target_percentage IS NOT NULL)
+		ORDER BY ticker
+		FOR UPDATE
+	`, portfolioID)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch holdings: %v", err))
+		return
+	}
+	hasTargets := false
+	for rows.Next() {
+		var p RebalancePosition
+		var target sql.NullFloat64
+		if err := rows.Scan(&p.Ticker, &p.Shares, &target, &p.Price); err != nil {
+			rows.Close()
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch holdings: %v", err))
+			return
+		}
+		hasTargets = hasTargets || target.Valid
+		p.TargetPercentage = target.Float64
+		if p.Ticker == "CASH" {
+			plan.Cash.Shares, plan.Cash.TargetPercentage = p.Shares, p.TargetPercentage
+			continue
+		}
+		plan.Positions = append(plan.Positions, p)
+	}
+	rows.Close()
+	if !hasTargets {
+		s.respondWithError(w, http.StatusBadRequest, "Portfolio has no target allocation; set one with PUT /api/portfolios/{id}/targets")
+		return
+	}
+
+	for i := range plan.Positions {
+		p := &plan.Positions[i]
+		price, err := s.getClosePrice(p.Ticker, plan.PricedAt, tx)
+		if err != nil && !errors.Is(err, ErrInvalidTransaction) {
+			s.respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err == nil {
+			p.Price = price
+		}
+		if p.Price <= 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("no price for %s; it is not valued or traded", p.Ticker))
+		}
+	}
+
+	schedule, err := s.getPortfolioFeeSchedule(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fee := func(tt TransactionType, shares, price float64) float64 {
+		if schedule == nil {
+			return 0
+		}
+		return schedule.Compute(TransactionRequest{Type: tt, Shares: shares, Price: price}).Total
+	}
+
+	plan.CashAfter = rebalance(plan.Cash.Shares, plan.Cash.TargetPercentage, plan.Positions, fee)
+	plan.TotalValue = plan.Cash.Shares
+	for _, p := range plan.Positions {
+		plan.TotalValue += p.Value
+	}
+	plan.Cash.Value = plan.Cash.Shares
+	if plan.TotalValue > 0 {
+		plan.Cash.CurrentPercentage = plan.Cash.Shares / plan.TotalValue * 100
+		plan.Cash.AdjustmentPercentage = plan.Cash.TargetPercentage - plan.Cash.CurrentPercentage
+	}
+	plan.Cash.AdjustmentValue = plan.CashAfter - plan.Cash.Shares
+
+	for _, p := range append([]RebalancePosition{plan.Cash}, plan.Positions...) {
+		_, err := tx.Exec(`
+			UPDATE portfolio_holdings
+			SET current_percentage = $3,
+				adjustment_percentage = $4,
+				adjustment_value = $5,
+				adjustment_quantity = $6,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE portfolio_id = $1 AND ticker = $2
+		`, portfolioID, p.Ticker, math.Round(p.CurrentPercentage*100)/100,
+			math.Round(p.AdjustmentPercentage*100)/100, p.AdjustmentValue, p.AdjustmentQuantity)
+		if err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update holding %s: %v", p.Ticker, err))
+			return
+		}
+	}
+
+	if req.Drafts {
+		notes := fmt.Sprintf("Rebalance %s", plan.PricedAt.Format("2006-01-02"))
+		for _, sales := range []bool{true, false} {
+			for _, p := range plan.Positions {
+				if p.AdjustmentQuantity == 0 || (p.AdjustmentQuantity < 0) != sales {
+					continue
+				}
+				d := DraftTransaction{
+					PortfolioID:   portfolioID,
+					Type:          Buy,
+					Ticker:        p.Ticker,
+					Shares:        math.Abs(float64(p.AdjustmentQuantity)),
+					Price:         p.Price,
+					Amount:        p.AdjustmentValue + p.Fee,
+					TransactionAt: plan.PricedAt,
+					Notes:         notes,
+				}
+				if sales {
+					d.Type, d.Amount = Sell, -p.AdjustmentValue-p.Fee
+				}
+				if err := s.insertDraft(d, tx); err != nil {
+					s.respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				plan.Drafted++
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, plan)
+}
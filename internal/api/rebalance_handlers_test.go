@@ -0,0 +1,33 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalance(t *testing.T) {
+	fee := func(tt TransactionType, shares, price float64) float64 {
+		return shares * price / 100
+	}
+	positions := []RebalancePosition{
+		{Ticker: "BBOB", Shares: 1000, Price: 6, TargetPercentage: 30},
+		{Ticker: "BMNS", Shares: 0, Price: 2, TargetPercentage: 60},
+		{Ticker: "TASC", Shares: 100, Price: 10, TargetPercentage: 0},
+	}
+
+	// Worth 3000 + 6000 + 1000 = 10000, with 10% kept in cash
+	cash := rebalance(3000, 10, positions, fee)
+
+	bbob, bmns, tasc := positions[0], positions[1], positions[2]
+	assert.InDelta(t, 60, bbob.CurrentPercentage, 0.0001)
+	assert.InDelta(t, -30, bbob.AdjustmentPercentage, 0.0001)
+	assert.Equal(t, int64(-500), bbob.AdjustmentQuantity)
+	assert.Equal(t, int64(-100), tasc.AdjustmentQuantity, "a zero target sells everything")
+
+	// 3000 + 2970 + 990 in cash, less the 1000 kept, buys 5960 worth with fees
+	assert.Equal(t, int64(2950), bmns.AdjustmentQuantity)
+	assert.InDelta(t, 59, bmns.Fee, 0.0001)
+	assert.InDelta(t, 6960-5900-59, cash, 0.0001)
+	assert.GreaterOrEqual(t, cash, 1000.0)
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// markToMarketClient names the revaluation job in the audit log
+const markToMarketClient = "mark-to-market"
+
+// RevaluationResult reports a mark-to-market run
+type RevaluationResult struct {
+	Portfolios int       `json:"portfolios"`
+	Holdings   int       `json:"holdings"` // Holdings priced, CASH excluded
+	RevaluedAt time.Time `json:"revalued_at"`
+}
+
+// revalueHoldings marks the holdings of the given portfolios to the latest
+// close price and recomputes their position costs, unrealized gains and
+// weights. A ticker without any close price keeps its last trade price. It
+// returns the number of holdings priced.
+func (s *Server) revalueHoldings(portfolioIDs []int, tx *sql.Tx) (int, error) {
+	result, err := tx.Exec(`
+		WITH latest AS (
+			SELECT DISTINCT ON (ticker) ticker, close_price, date
+			FROM daily_stock_prices
+			WHERE close_price > 0
+				AND ticker IN (SELECT ticker FROM portfolio_holdings WHERE portfolio_id = ANY($1))
+			ORDER BY ticker, date DESC
+		),
+		priced AS (
+			SELECT h.id,
+				COALESCE(l.close_price, h.current_price) AS price,
+				COALESCE(l.date, h.price_last_date) AS price_date
+			FROM portfolio_holdings h
+			LEFT JOIN latest l ON l.ticker = h.ticker
+			WHERE h.portfolio_id = ANY($1) AND h.ticker <> 'CASH'
+		)
+		UPDATE portfolio_holdings h
+		SET current_price = p.price,
+			price_last_date = p.price_date,
+			position_cost_average = h.shares * h.purchase_cost_average,
+			position_cost_fifo = h.shares * h.purchase_cost_fifo,
+			unrealized_gain_average = h.shares * (p.price - h.purchase_cost_average),
+			unrealized_gain_fifo = h.shares * (p.price - h.purchase_cost_fifo),
+			updated_at = CURRENT_TIMESTAMP
+		FROM priced p
+		WHERE h.id = p.id
+	`, pq.Array(portfolioIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to revalue holdings: %v", err)
+	}
+	priced, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// Weights are of the CASH balance plus the market value of the holdings
+	_, err = tx.Exec(`
+		WITH holding_values AS (
+			SELECT id, portfolio_id,
+				CASE WHEN ticker = 'CASH' THEN shares ELSE shares * COALESCE(current_price, 0) END AS value
+			FROM portfolio_holdings
+			WHERE portfolio_id = ANY($1)
+		),
+		totals AS (
+			SELECT portfolio_id, SUM(value) AS total
+			FROM holding_values
+			GROUP BY portfolio_id
+		)
+		UPDATE portfolio_holdings h
+		SET current_percentage = CASE WHEN t.total > 0 THEN ROUND(v.value / t.total * 100, 2) END,
+			updated_at = CURRENT_TIMESTAMP
+		FROM holding_values v
+		JOIN totals t ON t.portfolio_id = v.portfolio_id
+		WHERE h.id = v.id
+	`, pq.Array(portfolioIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to update holding weights: %v", err)
+	}
+	return int(priced), nil
+}
+
+// revalueAll marks every portfolio to market
+func (s *Server) revalueAll(tx *sql.Tx) (*RevaluationResult, error) {
+	rows, err := tx.Query(`SELECT id FROM portfolios ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list portfolios: %v", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list portfolios: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	holdings, err := s.revalueHoldings(ids, tx)
+	if err != nil {
+		return nil, err
+	}
+	return &RevaluationResult{Portfolios: len(ids), Holdings: holdings, RevaluedAt: time.Now()}, nil
+}
+
+// markToMarket revalues every portfolio after a scrape
+func (s *Server) markToMarket() error {
+	tx, err := s.beginTaggedTx(newRequestID(), markToMarketClient)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := s.revalueAll(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.logger.Info("Marked %d holdings in %d portfolios to market", result.Holdings, result.Portfolios)
+	return nil
+}
+
+// RevaluePortfolio marks the holdings of one portfolio to market on demand
+func (s *Server) RevaluePortfolio(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	holdings, err := s.revalueHoldings([]int{portfolioID}, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, RevaluationResult{Portfolios: 1, Holdings: holdings, RevaluedAt: time.Now()})
+}
+
+// RevalueAll marks every portfolio to market on demand
+func (s *Server) RevalueAll(w http.ResponseWriter, r *http.Request) {
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := s.revalueAll(tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, result)
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -53,12 +54,17 @@ func NewServer(logger *utils.AppLogger, config *utils.Config, db *sql.DB, scrape
 
 	// Create reporting service and handler
 	reportingService := reporting.NewReportingService(db)
+	reportingService.RiskFreeRate = config.Reporting.RiskFreeRate
+	if config.Reporting.Benchmark != "" {
+		reportingService.Benchmark = strings.ToUpper(config.Reporting.Benchmark)
+	}
 	reportingHandler := reporting.NewReportingHandler(reportingService)
 
 	server.setupRouter()
 	server.setupRoutes(reportingHandler)
 	server.verifyRoutes()
 	server.startStockUpdater()
+	server.startPlanScheduler()
 	return server
 }
 
@@ -104,22 +110,162 @@ func (s *Server) setupRoutes(reportingHandler *reporting.ReportingHandler) {
 	portfolioRouter.HandleFunc("/{id}", s.DeletePortfolio).Methods("DELETE")
 	portfolioRouter.HandleFunc("/{id}/rename", s.RenamePortfolio).Methods("PUT")
 	portfolioRouter.HandleFunc("/{id}/holdings", s.GetPortfolioHoldings).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/cost-basis", s.SetCostBasisMethod).Methods("PUT")
 
 	// Add these transaction routes
 	portfolioRouter.HandleFunc("/{id}/transactions", s.GetTransactions).Methods("GET")
 	portfolioRouter.HandleFunc("/{id}/transactions", s.CreateTransaction).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/transactions/import", s.ImportTransactions).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/transactions/{txId}", s.UpdateTransaction).Methods("PUT")
+	portfolioRouter.HandleFunc("/{id}/transactions/{txId}", s.DeleteTransaction).Methods("DELETE")
 
+	s.logger.Debug("Registered route: PUT /api/portfolios/{id}/cost-basis")
 	s.logger.Debug("Registered route: GET /api/portfolios/{id}/transactions")
 	s.logger.Debug("Registered route: POST /api/portfolios/{id}/transactions")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/transactions/import")
+	s.logger.Debug("Registered route: PUT /api/portfolios/{id}/transactions/{txId}")
+	s.logger.Debug("Registered route: DELETE /api/portfolios/{id}/transactions/{txId}")
 
 	s.logger.Info("Portfolio routes registered")
 
+	// Corporate action routes
+	corporateActionsRouter := apiRouter.PathPrefix("/corporate-actions").Subrouter()
+	corporateActionsRouter.HandleFunc("", s.ListCorporateActions).Methods("GET")
+	corporateActionsRouter.HandleFunc("", s.CreateCorporateAction).Methods("POST")
+	corporateActionsRouter.HandleFunc("/{actionId}/apply", s.ApplyCorporateAction).Methods("POST")
+	corporateActionsRouter.HandleFunc("/{actionId}/entitlements", s.GetRightsEntitlements).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/corporate-actions/{actionId}/subscribe", s.SubscribeRights).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/corporate-actions")
+	s.logger.Debug("Registered route: POST /api/corporate-actions")
+	s.logger.Debug("Registered route: POST /api/corporate-actions/{actionId}/apply")
+	s.logger.Debug("Registered route: GET /api/corporate-actions/{actionId}/entitlements")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/corporate-actions/{actionId}/subscribe")
+
+	// Fee schedule routes
+	feeSchedulesRouter := apiRouter.PathPrefix("/fee-schedules").Subrouter()
+	feeSchedulesRouter.HandleFunc("", s.ListFeeSchedules).Methods("GET")
+	feeSchedulesRouter.HandleFunc("", s.CreateFeeSchedule).Methods("POST")
+	feeSchedulesRouter.HandleFunc("/{scheduleId}", s.UpdateFeeSchedule).Methods("PUT")
+	feeSchedulesRouter.HandleFunc("/{scheduleId}", s.DeleteFeeSchedule).Methods("DELETE")
+	portfolioRouter.HandleFunc("/{id}/fee-schedule", s.SetPortfolioFeeSchedule).Methods("PUT")
+
+	s.logger.Debug("Registered route: GET /api/fee-schedules")
+	s.logger.Debug("Registered route: POST /api/fee-schedules")
+	s.logger.Debug("Registered route: PUT /api/fee-schedules/{scheduleId}")
+	s.logger.Debug("Registered route: DELETE /api/fee-schedules/{scheduleId}")
+	s.logger.Debug("Registered route: PUT /api/portfolios/{id}/fee-schedule")
+
+	// Transfer routes
+	transfersRouter := apiRouter.PathPrefix("/transfers").Subrouter()
+	transfersRouter.HandleFunc("", s.ListTransfers).Methods("GET")
+	transfersRouter.HandleFunc("", s.CreateTransfer).Methods("POST")
+	transfersRouter.HandleFunc("/{transferId}", s.GetTransfer).Methods("GET")
+	transfersRouter.HandleFunc("/{transferId}", s.DeleteTransfer).Methods("DELETE")
+
+	s.logger.Debug("Registered route: GET /api/transfers")
+	s.logger.Debug("Registered route: POST /api/transfers")
+	s.logger.Debug("Registered route: GET /api/transfers/{transferId}")
+	s.logger.Debug("Registered route: DELETE /api/transfers/{transferId}")
+
+	// Exchange rate routes
+	fxRatesRouter := apiRouter.PathPrefix("/fx-rates").Subrouter()
+	fxRatesRouter.HandleFunc("", s.ListFXRates).Methods("GET")
+	fxRatesRouter.HandleFunc("", s.SetFXRate).Methods("POST")
+	fxRatesRouter.HandleFunc("/import", s.ImportFXRates).Methods("POST")
+	fxRatesRouter.HandleFunc("/{rateId}", s.DeleteFXRate).Methods("DELETE")
+	portfolioRouter.HandleFunc("/{id}/cash", s.GetCashBalances).Methods("GET")
+
+	s.logger.Debug("Registered route: GET /api/fx-rates")
+	s.logger.Debug("Registered route: POST /api/fx-rates")
+	s.logger.Debug("Registered route: POST /api/fx-rates/import")
+	s.logger.Debug("Registered route: DELETE /api/fx-rates/{rateId}")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/cash")
+
+	// Pending order routes
+	portfolioRouter.HandleFunc("/{id}/orders", s.ListOrders).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/orders", s.CreateOrder).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/orders/{orderId}", s.GetOrder).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/orders/{orderId}/cancel", s.CancelOrder).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/orders/{orderId}/confirm", s.ConfirmOrder).Methods("POST")
+	apiRouter.HandleFunc("/orders/process", s.ProcessOrders).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/orders")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/orders")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/orders/{orderId}")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/orders/{orderId}/cancel")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/orders/{orderId}/confirm")
+	s.logger.Debug("Registered route: POST /api/orders/process")
+
+	// Plan and draft transaction routes
+	portfolioRouter.HandleFunc("/{id}/plans", s.ListPlans).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/plans", s.CreatePlan).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/plans/{planId}", s.GetPlan).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/plans/{planId}", s.UpdatePlan).Methods("PUT")
+	portfolioRouter.HandleFunc("/{id}/plans/{planId}", s.DeletePlan).Methods("DELETE")
+	portfolioRouter.HandleFunc("/{id}/drafts", s.ListDrafts).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/drafts/confirm", s.ConfirmDrafts).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/drafts/{draftId}/confirm", s.ConfirmDraft).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/drafts/{draftId}/dismiss", s.DismissDraft).Methods("POST")
+	apiRouter.HandleFunc("/plans/run", s.RunPlans).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/plans")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/plans")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/plans/{planId}")
+	s.logger.Debug("Registered route: PUT /api/portfolios/{id}/plans/{planId}")
+	s.logger.Debug("Registered route: DELETE /api/portfolios/{id}/plans/{planId}")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/drafts")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/drafts/confirm")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/drafts/{draftId}/confirm")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/drafts/{draftId}/dismiss")
+	s.logger.Debug("Registered route: POST /api/plans/run")
+
+	// Target allocation and rebalancing routes
+	portfolioRouter.HandleFunc("/{id}/targets", s.GetTargetAllocation).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/targets", s.SetTargetAllocation).Methods("PUT")
+	portfolioRouter.HandleFunc("/{id}/rebalance", s.Rebalance).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/targets")
+	s.logger.Debug("Registered route: PUT /api/portfolios/{id}/targets")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/rebalance")
+
+	// Mark-to-market routes
+	apiRouter.HandleFunc("/revalue", s.RevalueAll).Methods("POST")
+	portfolioRouter.HandleFunc("/{id}/revalue", s.RevaluePortfolio).Methods("POST")
+
+	s.logger.Debug("Registered route: POST /api/revalue")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/revalue")
+
+	// Valuation history routes
+	portfolioRouter.HandleFunc("/{id}/valuations", s.GetValuations).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/valuations/rebuild", s.RebuildValuations).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/valuations")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/valuations/rebuild")
+
+	// Ledger integrity routes
+	apiRouter.HandleFunc("/integrity", s.CheckIntegrity).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/integrity", s.CheckPortfolioIntegrity).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/integrity/repair", s.RepairPortfolio).Methods("POST")
+
+	s.logger.Debug("Registered route: GET /api/integrity")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/integrity")
+	s.logger.Debug("Registered route: POST /api/portfolios/{id}/integrity/repair")
+
+	// Audit log routes
+	apiRouter.HandleFunc("/audit-log", s.GetAuditLog).Methods("GET")
+	portfolioRouter.HandleFunc("/{id}/audit-log", s.GetAuditLog).Methods("GET")
+
+	s.logger.Debug("Registered route: GET /api/audit-log")
+	s.logger.Debug("Registered route: GET /api/portfolios/{id}/audit-log")
+
 	// Add CORS middleware
 	s.router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Idempotency-Key, X-Request-ID, X-Client-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -145,9 +291,11 @@ func (s *Server) setupRoutes(reportingHandler *reporting.ReportingHandler) {
 	// Add new routes for FIFO tracking
 	s.router.HandleFunc("/api/portfolios/{id}/lots", s.GetLots).Methods("GET")
 	s.router.HandleFunc("/api/portfolios/{id}/summary", s.GetPortfolioSummary).Methods("GET")
+	s.router.HandleFunc("/api/portfolios/{id}/realized-gains", s.GetRealizedGains).Methods("GET")
 
 	// Add reporting routes
 	s.router.HandleFunc("/api/portfolios/{id}/performance", reportingHandler.GetPortfolioPerformance).Methods("GET")
+	s.router.HandleFunc("/api/portfolios/{id}/returns", reportingHandler.GetPortfolioReturns).Methods("GET")
 
 	// Stock routes
 	s.router.HandleFunc("/api/stocks", s.GetStocks).Methods("GET")
@@ -159,11 +307,13 @@ func (s *Server) setupRoutes(reportingHandler *reporting.ReportingHandler) {
 // setupRouter configures middleware for the server.
 func (s *Server) setupRouter() {
 	s.router.HandleFunc("/health", s.healthCheck).Methods("GET")
+	s.router.Use(s.requestContextMiddleware)
 	s.router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Idempotency-Key, X-Request-ID, X-Client-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -241,7 +391,9 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// ResetPortfolio resets a portfolio by deleting all transactions associated with it
+// ResetPortfolio resets a portfolio by deleting all transactions associated
+// with it and replaying the empty ledger. Portfolios that are part of a
+// transfer are refused until the transfers are deleted.
 func (s *Server) ResetPortfolio(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	portfolioID, err := strconv.Atoi(vars["id"])
@@ -251,13 +403,34 @@ func (s *Server) ResetPortfolio(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Start transaction
-	tx, err := s.db.Begin()
+	tx, err := s.beginTx(r)
 	if err != nil {
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
 		return
 	}
 	defer tx.Rollback()
 
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	conflict, err := s.transferConflict(portfolioID, tx)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if conflict != "" {
+		s.respondWithError(w, http.StatusConflict, conflict)
+		return
+	}
+
 	// Delete all transactions
 	query := `DELETE FROM portfolio_transactions WHERE portfolio_id = $1`
 	_, err = tx.Exec(query, portfolioID)
@@ -266,6 +439,12 @@ func (s *Server) ResetPortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clear the holdings, lots and balances the transactions built up
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
@@ -305,6 +484,7 @@ func (s *Server) startStockUpdater() {
 		} else {
 			s.logger.Info("Initial stock update completed successfully")
 		}
+		s.afterStockUpdate()
 	}()
 
 	// Set up hourly updates
@@ -319,6 +499,7 @@ func (s *Server) startStockUpdater() {
 				} else {
 					s.logger.Info("Hourly stock update completed successfully")
 				}
+				s.afterStockUpdate()
 			case <-s.ctx.Done():
 				ticker.Stop()
 				return
@@ -327,6 +508,21 @@ func (s *Server) startStockUpdater() {
 	}()
 }
 
+// afterStockUpdate runs the jobs that depend on fresh prices. It also runs
+// after a failed scrape, since prices of the tickers that succeeded are saved.
+func (s *Server) afterStockUpdate() {
+	if err := s.markToMarket(); err != nil {
+		s.logger.Error("Mark-to-market failed: %v", err)
+	}
+	if _, err := s.processOrders(); err != nil {
+		s.logger.Error("Order processing failed: %v", err)
+	}
+	// Valued last so the day includes any orders just filled
+	if err := s.updateAllValuations(); err != nil {
+		s.logger.Error("Valuation update failed: %v", err)
+	}
+}
+
 func (s *Server) verifyRoutes() {
 	s.logger.Debug("Verifying registered routes:")
 	s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -1,14 +1,21 @@
 package api
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
 //Logic for handling transactions
@@ -124,6 +131,132 @@ CREATE INDEX IF NOT EXISTS idx_portfolio_transactions_portfolio_ticker_date
 
 */
 //Transaction handlers
+
+// transactionFilter holds the query parameters of GetTransactions
+type transactionFilter struct {
+	From, To  time.Time
+	Types     []string
+	Ticker    string
+	Search    string // Case-insensitive text in notes
+	Ascending bool
+	Limit     int
+	After     *transactionCursor
+}
+
+// transactionCursor is the position of the last transaction of a page
+type transactionCursor struct {
+	TransactionAt time.Time
+	ID            int
+}
+
+// encode returns the cursor as an opaque string
+func (c transactionCursor) encode() string {
+	raw := fmt.Sprintf("%s,%d", c.TransactionAt.Format(time.RFC3339Nano), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeTransactionCursor(encoded string) (*transactionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	var c transactionCursor
+	if c.TransactionAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return nil, err
+	}
+	if c.ID, err = strconv.Atoi(id); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseTransactionFilter reads the filters, sort order and page of a
+// transaction listing
+func parseTransactionFilter(query url.Values) (transactionFilter, error) {
+	f := transactionFilter{Limit: 100}
+
+	for param, at := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if raw := query.Get(param); raw != "" {
+			t, err := parseQueryTime(raw)
+			if err != nil {
+				return f, fmt.Errorf("Invalid %s date", param)
+			}
+			*at = t
+		}
+	}
+
+	if raw := query.Get("type"); raw != "" {
+		for _, value := range strings.Split(raw, ",") {
+			tt := TransactionType(strings.ToUpper(strings.TrimSpace(value)))
+			if !tt.Valid() {
+				return f, fmt.Errorf("Invalid transaction type: %s", value)
+			}
+			f.Types = append(f.Types, string(tt))
+		}
+	}
+	f.Ticker = strings.ToUpper(strings.TrimSpace(query.Get("ticker")))
+	f.Search = strings.TrimSpace(query.Get("q"))
+
+	switch strings.ToLower(query.Get("sort")) {
+	case "", "desc":
+	case "asc":
+		f.Ascending = true
+	default:
+		return f, fmt.Errorf("sort must be asc or desc")
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			return f, fmt.Errorf("limit must be between 1 and 1000")
+		}
+		f.Limit = n
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeTransactionCursor(raw)
+		if err != nil {
+			return f, fmt.Errorf("Invalid cursor")
+		}
+		f.After = cursor
+	}
+	return f, nil
+}
+
+// conditions returns the WHERE clause of the filter, without the cursor,
+// with its arguments numbered from $1
+func (f transactionFilter) conditions(portfolioID int) (string, []interface{}) {
+	conditions := []string{"portfolio_id = $1"}
+	args := []interface{}{portfolioID}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if !f.From.IsZero() {
+		addCondition("transaction_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		addCondition("transaction_at < $%d", f.To)
+	}
+	if len(f.Types) > 0 {
+		addCondition("type::text = ANY($%d)", pq.Array(f.Types))
+	}
+	if f.Ticker != "" {
+		addCondition("ticker = $%d", f.Ticker)
+	}
+	if f.Search != "" {
+		addCondition("strpos(lower(notes), lower($%d)) > 0", f.Search)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// GetTransactions lists the transactions of a portfolio one page at a time,
+// newest first unless sort=asc. The summary and total cover every
+// transaction matching the filters, not just the page.
 func (s *Server) GetTransactions(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	portfolioID, err := strconv.Atoi(vars["id"])
@@ -132,26 +265,42 @@ func (s *Server) GetTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `
-		SELECT 
-			id, portfolio_id, type::text, 
-			COALESCE(ticker, '') as ticker,  -- Handle NULL ticker
-			COALESCE(shares, 0) as shares, 
-			COALESCE(price, 0) as price, 
-			amount, fee,
-			COALESCE(notes, '') as notes,  -- Handle NULL notes
-			transaction_at, created_at,
-			COALESCE(cash_balance_before, 0) as cash_balance_before,
-			COALESCE(cash_balance_after, 0) as cash_balance_after,
-			COALESCE(shares_count_before, 0) as shares_count_before,
-			COALESCE(shares_count_after, 0) as shares_count_after,
-			COALESCE(average_cost_before, 0) as average_cost_before,
-			COALESCE(average_cost_after, 0) as average_cost_after
+	filter, err := parseTransactionFilter(r.URL.Query())
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, args := filter.conditions(portfolioID)
+
+	response := TransactionsListResponse{Transactions: []TransactionResponse{}}
+	response.Total, response.Summary, err = s.getTransactionSummary(where, args)
+	if isMissingFXRate(err) {
+		s.respondWithError(w, http.StatusBadRequest, fxRateErrorMessage(err))
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to summarize transactions: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch transactions")
+		return
+	}
+
+	order, comparison := "DESC", "<"
+	if filter.Ascending {
+		order, comparison = "ASC", ">"
+	}
+	if filter.After != nil {
+		args = append(args, filter.After.TransactionAt, filter.After.ID)
+		where += fmt.Sprintf(" AND (transaction_at, id) %s ($%d, $%d)", comparison, len(args)-1, len(args))
+	}
+
+	// One extra row tells whether there is a next page
+	query := fmt.Sprintf(`SELECT %s
 		FROM portfolio_transactions
-		WHERE portfolio_id = $1
-		ORDER BY transaction_at DESC, id DESC`
+		WHERE %s
+		ORDER BY transaction_at %s, id %s
+		LIMIT %d`, ledgerColumns, where, order, order, filter.Limit+1)
 
-	rows, err := s.db.Query(query, portfolioID)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		s.logger.Error("Failed to fetch transactions: %v", err)
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch transactions")
@@ -159,399 +308,361 @@ func (s *Server) GetTransactions(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	var transactions []Transaction
 	for rows.Next() {
-		var t Transaction
-		var typeStr string
-		err := rows.Scan(
-			&t.ID, &t.PortfolioID, &typeStr, &t.Ticker,
-			&t.Shares, &t.Price, &t.Amount, &t.Fee,
-			&t.Notes, &t.TransactionAt, &t.CreatedAt,
-			&t.CashBalanceBefore, &t.CashBalanceAfter,
-			&t.SharesCountBefore, &t.SharesCountAfter,
-			&t.AverageCostBefore, &t.AverageCostAfter,
-		)
+		t, err := scanLedgerTransaction(rows)
 		if err != nil {
 			s.logger.Error("Error scanning transaction: %v", err)
 			s.respondWithError(w, http.StatusInternalServerError, "Error scanning transaction")
 			return
 		}
-		t.Type = TransactionType(typeStr)
-		transactions = append(transactions, t)
+		if len(response.Transactions) == filter.Limit {
+			last := response.Transactions[filter.Limit-1].Transaction
+			response.NextCursor = transactionCursor{last.TransactionAt, last.ID}.encode()
+			break
+		}
+		response.Transactions = append(response.Transactions, TransactionResponse{
+			Transaction: t,
+			TotalAmount: t.Amount,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to fetch transactions: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch transactions")
+		return
 	}
 
-	s.respondWithJSON(w, http.StatusOK, transactions)
+	s.respondWithJSON(w, http.StatusOK, response)
 }
 
-// CreateDeposit handles deposit transactions
-func (s *Server) CreateDeposit(portfolioID int, req TransactionRequest, tx *sql.Tx) error {
-	s.logger.Debug("Creating deposit transaction for portfolio %d", portfolioID)
-
-	// Get current cash balance
-	cashBefore, err := s.getPortfolioBalance(portfolioID, tx)
+// getTransactionSummary counts and totals the transactions matching where.
+// Amounts are converted to the ledger currency at the rate of each
+// transaction's date. Unrealized gains are those of the current holdings of
+// the tickers among the transactions, under the portfolio's cost-basis method.
+func (s *Server) getTransactionSummary(where string, args []interface{}) (int, TransactionSummary, error) {
+	var total int
+	var summary TransactionSummary
+
+	args = append(args, LedgerCurrency)
+	ledger := len(args)
+	err := s.db.QueryRow(fmt.Sprintf(`
+		WITH filtered AS (
+			SELECT *, fx_rate(currency, $%[2]d, transaction_at) AS rate
+			FROM portfolio_transactions
+			WHERE %[1]s
+		)
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(CASE WHEN type = 'DEPOSIT' THEN amount * rate END), 0),
+			COALESCE(SUM(CASE WHEN type = 'WITHDRAW' THEN amount * rate END), 0),
+			COALESCE(SUM(fee * rate + CASE WHEN type = 'FEE' THEN amount * rate ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN type = 'DIVIDEND' THEN amount * rate END), 0),
+			COALESCE(SUM(realized_gain), 0),
+			COALESCE(SUM(
+				(COALESCE(cash_balance_after, 0) - COALESCE(cash_balance_before, 0)) * rate
+				+ CASE WHEN type = 'FX' THEN to_amount * fx_rate(to_currency, $%[2]d, transaction_at) ELSE 0 END
+			), 0),
+			(SELECT COALESCE(SUM(CASE
+					WHEN h.current_price IS NULL THEN 0
+					ELSE cb.shares * h.current_price - cb.cost_basis
+				END), 0)
+			FROM portfolio_cost_basis cb
+			JOIN portfolios p ON p.id = cb.portfolio_id AND p.cost_basis_method = cb.method
+			LEFT JOIN portfolio_holdings h ON h.portfolio_id = cb.portfolio_id AND h.ticker = cb.ticker
+			WHERE cb.portfolio_id = $1
+				AND cb.ticker IN (SELECT ticker FROM filtered WHERE ticker IS NOT NULL))
+		FROM filtered
+	`, where, ledger), args...).Scan(
+		&total,
+		&summary.TotalDeposits, &summary.TotalWithdrawals,
+		&summary.TotalFees, &summary.TotalDividends,
+		&summary.RealizedGains, &summary.NetCashFlow,
+		&summary.UnrealizedGains,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to get current balance: %v", err)
+		return 0, summary, err
 	}
+	return total, summary, nil
+}
 
-	// Calculate new balance
-	cashAfter := cashBefore + req.Amount
-
-	// Update cash balance
-	result, err := tx.Exec(`
-		UPDATE portfolio_holdings 
-		SET shares = shares + $3,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE portfolio_id = $1 AND ticker = $2
-	`, portfolioID, "CASH", req.Amount)
-
-	if err != nil {
-		return fmt.Errorf("failed to update cash holdings: %v", err)
+// createTransaction records a transaction in the ledger and replays the portfolio.
+// Because the replay runs in transaction_at order, backdated transactions get
+// correct running balances and lot consumption, and cash and share sufficiency
+// is checked as of the transaction date. Later transactions that would no longer
+// be possible cause a *LedgerError.
+func (s *Server) createTransaction(portfolioID int, req TransactionRequest, tx *sql.Tx) (*Transaction, error) {
+	req.normalize()
+	if err := s.fillExchangeRate(&req, tx); err != nil {
+		return nil, err
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("error checking update result: %v", err)
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
 	}
 
-	if rowsAffected == 0 {
-		// Insert new cash holding if it doesn't exist
-		_, err = tx.Exec(`
-			INSERT INTO portfolio_holdings (portfolio_id, ticker, shares)
-			VALUES ($1, $2, $3)
-		`, portfolioID, "CASH", req.Amount)
-		if err != nil {
-			return fmt.Errorf("failed to create cash holding: %v", err)
+	if req.Ticker != "" {
+		if err := s.validateTicker(req.Ticker, tx); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
 		}
 	}
 
-	// Record transaction
-	_, err = tx.Exec(`
-		INSERT INTO portfolio_transactions (
-			portfolio_id, type, amount, fee, notes, transaction_at,
-			cash_balance_before, cash_balance_after
-		) VALUES ($1, 'DEPOSIT', $2, $3, $4, $5, $6, $7)
-	`, portfolioID, req.Amount, req.Fee, req.Notes, req.TransactionAt,
-		cashBefore, cashAfter)
-
-	if err != nil {
-		return fmt.Errorf("failed to record transaction: %v", err)
-	}
-
-	return nil
-}
-
-// CreateWithdraw handles withdraw transactions
-func (s *Server) CreateWithdraw(portfolioID int, req TransactionRequest, tx *sql.Tx) error {
-	s.logger.Debug("Creating withdraw transaction for portfolio %d", portfolioID)
-
-	// Get current cash balance
-	cashBefore, err := s.getPortfolioBalance(portfolioID, tx)
+	transactionID, err := s.insertTransaction(portfolioID, req, tx)
 	if err != nil {
-		return fmt.Errorf("failed to get current balance: %v", err)
+		return nil, err
 	}
 
-	// Validate sufficient funds
-	if cashBefore < req.Amount {
-		return fmt.Errorf("insufficient funds: have %.2f, need %.2f", cashBefore, req.Amount)
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		return nil, err
 	}
 
-	// Calculate new balance
-	cashAfter := cashBefore - req.Amount
+	return s.getTransaction(portfolioID, transactionID, tx)
+}
 
-	// Insert withdraw transaction - Note NULL values for ticker, shares, and price
-	query := `
-		INSERT INTO portfolio_transactions (
-			portfolio_id, type, ticker, shares, price, amount, fee,
-			notes, transaction_at,
-			cash_balance_before, cash_balance_after,
-			shares_count_before, shares_count_after,
-			average_cost_before, average_cost_after
-		) VALUES (
-			$1, 'WITHDRAW', NULL, NULL, NULL, $2, $3,
-			$4, $5,
-			$6, $7,
-			0, 0,
-			0, 0
-		) RETURNING id`
+// insertTransaction stores the user-supplied fields of a transaction; the
+// derived fields are filled in by replayLedger
+func (s *Server) insertTransaction(portfolioID int, req TransactionRequest, tx *sql.Tx) (int, error) {
+	ticker, shares, price, amount := ledgerValues(req)
 
 	var transactionID int
-	err = tx.QueryRow(
-		query,
-		portfolioID,
-		req.Amount,
-		0, // Fee is 0 for withdrawals
-		req.Notes,
-		req.TransactionAt,
-		cashBefore,
-		cashAfter,
-	).Scan(&transactionID)
-
-	if err != nil {
-		return fmt.Errorf("failed to insert withdraw transaction: %v", err)
-	}
-
-	// Update cash holdings
-	holdingsQuery := `
-		UPDATE portfolio_holdings 
-		SET 
-			shares = shares - $2,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE portfolio_id = $1 
-		AND ticker = 'CASH'
-		AND shares >= $2` // Ensure sufficient balance
-
-	result, err := tx.Exec(holdingsQuery, portfolioID, req.Amount)
+	err := tx.QueryRow(`
+		INSERT INTO portfolio_transactions (
+			portfolio_id, type, ticker, shares, price,
+			amount, fee, notes, transaction_at,
+			withholding_tax, ex_date, idempotency_key, request_hash,
+			currency, to_currency, to_amount, exchange_rate
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING id
+	`, portfolioID, req.Type, ticker, shares, price,
+		amount, req.feeAmount(), req.Notes, req.TransactionAt,
+		req.WithholdingTax, nullIfZeroTime(req.ExDate),
+		nullIfEmpty(req.IdempotencyKey), nullIfEmpty(req.requestHash),
+		req.Currency, nullIfEmpty(req.ToCurrency), nullIfZero(req.ToAmount), nullIfZero(req.ExchangeRate)).Scan(&transactionID)
 	if err != nil {
-		return fmt.Errorf("failed to update cash holdings: %v", err)
+		return 0, fmt.Errorf("failed to record transaction: %v", err)
 	}
 
-	// Check if update was successful
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("error checking update result: %v", err)
-	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("insufficient cash balance for withdrawal")
+	if len(req.Lots) > 0 {
+		if err := s.saveLotSelections(portfolioID, transactionID, req.Lots, tx); err != nil {
+			return 0, err
+		}
 	}
 
-	s.logger.Debug("Successfully created withdraw transaction %d", transactionID)
-	return nil
+	s.logger.Debug("Recorded %s transaction %d for portfolio %d", req.Type, transactionID, portfolioID)
+	return transactionID, nil
 }
 
-// CreateBuy handles buy transactions
-func (s *Server) CreateBuy(portfolioID int, req TransactionRequest, tx *sql.Tx) error {
-	// Validate ticker
-	if err := s.validateTicker(req.Ticker, tx); err != nil {
-		return err
+// CreateTransaction records a new transaction of any type
+func (s *Server) CreateTransaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
 	}
 
-	// Initialize holding for this ticker if it doesn't exist
-	if err := s.initializeTickerHolding(portfolioID, req.Ticker, tx); err != nil {
-		return err
+	// Parse request body
+	var req TransactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
 	}
-
-	// Get current cash and share balances
-	cashBefore, err := s.getPortfolioBalance(portfolioID, tx)
-	if err != nil {
-		return fmt.Errorf("failed to get cash balance: %v", err)
+	req.IdempotencyKey = strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(req.IdempotencyKey) > 255 {
+		s.respondWithError(w, http.StatusBadRequest, "Idempotency-Key cannot be longer than 255 characters")
+		return
 	}
-
-	var sharesBefore float64
-	err = tx.QueryRow(`
-		SELECT COALESCE(shares, 0) 
-		FROM portfolio_holdings 
-		WHERE portfolio_id = $1 AND ticker = $2
-	`, portfolioID, req.Ticker).Scan(&sharesBefore)
-	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("failed to get current shares: %v", err)
+	if req.IdempotencyKey != "" {
+		req.requestHash = req.hash()
 	}
 
-	// Calculate totals
-	totalCost := (req.Shares * req.Price) + req.Fee
-	cashAfter := cashBefore - totalCost
-
-	// Validate sufficient funds
-	if cashAfter < 0 {
-		return fmt.Errorf("insufficient funds: have %.2f, need %.2f", cashBefore, totalCost)
+	// Start transaction
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
 	}
+	defer tx.Rollback()
 
-	sharesAfter := sharesBefore + req.Shares
-
-	// Create FIFO lot
-	_, err = tx.Exec(`
-		INSERT INTO portfolio_stock_lots (
-			portfolio_id, ticker, shares, remaining_shares,
-			purchase_price, purchase_date
-		) VALUES ($1, $2, $3, $3, $4, $5)
-	`, portfolioID, req.Ticker, req.Shares, req.Price, req.TransactionAt)
+	// Initialize holdings if needed
+	err = s.initializePortfolioHoldings(portfolioID, tx)
 	if err != nil {
-		return fmt.Errorf("failed to create stock lot: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to initialize holdings: %v", err))
+		return
 	}
 
-	// Update holdings with FIFO cost
-	_, err = tx.Exec(`
-		INSERT INTO portfolio_holdings (
-			portfolio_id, ticker, shares,
-			purchase_cost_average, purchase_cost_fifo,
-			current_price, price_last_date
-		) VALUES (
-			$1, $2, $3, $4, $4, $5, $6
-		)
-		ON CONFLICT (portfolio_id, ticker) DO UPDATE SET
-			shares = portfolio_holdings.shares + $3,
-			purchase_cost_average = (portfolio_holdings.shares * portfolio_holdings.purchase_cost_average + $3 * $4) 
-				/ (portfolio_holdings.shares + $3),
-			purchase_cost_fifo = (
-				SELECT SUM(shares * purchase_price) / SUM(shares)
-				FROM portfolio_stock_lots
-				WHERE portfolio_id = $1 AND ticker = $2
-			),
-			current_price = $5,
-			price_last_date = $6,
-			updated_at = CURRENT_TIMESTAMP
-	`, portfolioID, req.Ticker, req.Shares, req.Price, req.Price, req.TransactionAt)
+	if req.IdempotencyKey != "" {
+		original, err := s.findIdempotentTransaction(portfolioID, req, tx)
+		if err != nil {
+			s.respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if original != nil {
+			if original.requestHash == "" {
+				s.respondWithError(w, http.StatusConflict, fmt.Sprintf(
+					"Idempotency-Key was used for transaction %d, which has been edited since", original.ID))
+				return
+			}
+			if original.requestHash != req.requestHash {
+				s.respondWithError(w, http.StatusUnprocessableEntity,
+					"Idempotency-Key was already used for a different transaction")
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			s.respondWithJSON(w, http.StatusOK, TransactionResponse{
+				Transaction: original.Transaction,
+				TotalAmount: original.Amount,
+			})
+			return
+		}
+	}
 
+	feeBreakdown, err := s.chargeFee(portfolioID, &req, tx)
 	if err != nil {
-		return fmt.Errorf("failed to update holdings: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	// Update cash balance
-	_, err = tx.Exec(`
-		UPDATE portfolio_holdings 
-		SET shares = shares - $2,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE portfolio_id = $1 AND ticker = 'CASH'
-	`, portfolioID, totalCost)
-
+	// Similar transactions are reported, not rejected: identical fills on the
+	// same day are legitimate, and retries are caught by the Idempotency-Key
+	req.normalize()
+	duplicateOf, err := s.findSimilarTransaction(portfolioID, req, tx)
 	if err != nil {
-		return fmt.Errorf("failed to update cash balance: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check transaction: %v", err))
+		return
 	}
 
-	// Record transaction
-	_, err = tx.Exec(`
-		INSERT INTO portfolio_transactions (
-			portfolio_id, type, ticker, shares, price, 
-			amount, fee, notes, transaction_at,
-			cash_balance_before, cash_balance_after,
-			shares_count_before, shares_count_after,
-			average_cost_before, average_cost_after
-		) VALUES ($1, 'BUY', $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
-	`, portfolioID, req.Ticker, req.Shares, req.Price,
-		totalCost, req.Fee, req.Notes, req.TransactionAt,
-		cashBefore, cashAfter,
-		sharesBefore, sharesAfter,
-		sharesBefore*req.Price, sharesAfter*req.Price)
-
+	transaction, err := s.createTransaction(portfolioID, req, tx)
 	if err != nil {
-		return fmt.Errorf("failed to record transaction: %v", err)
+		s.respondWithLedgerError(w, err)
+		return
 	}
 
-	return nil
-}
-
-// getFIFOLots retrieves available lots for selling in FIFO order
-func (s *Server) getFIFOLots(portfolioID int, ticker string, tx *sql.Tx) ([]StockLot, error) {
-	query := `
-		SELECT id, portfolio_id, ticker, shares, price, purchase_date, remaining_shares, created_at
-		FROM portfolio_stock_lots
-		WHERE portfolio_id = $1 
-		AND ticker = $2 
-		AND remaining_shares > 0
-		ORDER BY purchase_date ASC, id ASC`
-
-	rows, err := tx.Query(query, portfolioID, ticker)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch stock lots: %v", err)
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
 	}
-	defer rows.Close()
 
-	var lots []StockLot
-	for rows.Next() {
-		var lot StockLot
-		err := rows.Scan(
-			&lot.ID, &lot.PortfolioID, &lot.Ticker,
-			&lot.Shares, &lot.PurchasePrice, &lot.PurchaseDate,
-			&lot.RemainingShares, &lot.CreatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("error scanning lot: %v", err)
-		}
-		lots = append(lots, lot)
+	response := TransactionResponse{
+		Transaction:  *transaction,
+		TotalAmount:  transaction.Amount,
+		FeeBreakdown: feeBreakdown,
 	}
+	if duplicateOf != 0 {
+		response.PossibleDuplicateOf = duplicateOf
+		response.Warnings = append(response.Warnings,
+			fmt.Sprintf("possible duplicate of transaction %d", duplicateOf))
+	}
+	s.respondWithJSON(w, http.StatusCreated, response)
+}
 
-	return lots, nil
+// idempotentTransaction is a transaction created with an Idempotency-Key
+type idempotentTransaction struct {
+	Transaction
+	requestHash string
 }
 
-// CreateSell handles sell transactions
-func (s *Server) CreateSell(portfolioID int, req TransactionRequest, tx *sql.Tx) error {
-	// Get current holding
-	holding, err := s.getHolding(portfolioID, req.Ticker, tx)
+// findIdempotentTransaction returns the transaction created earlier with the
+// request's Idempotency-Key, or nil. Its requestHash is empty once it has
+// been edited. Requests with the same key wait for
+// each other, so a retry never races the original.
+func (s *Server) findIdempotentTransaction(portfolioID int, req TransactionRequest, tx *sql.Tx) (*idempotentTransaction, error) {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, portfolioID, req.IdempotencyKey)
 	if err != nil {
-		return fmt.Errorf("failed to get holding: %v", err)
+		return nil, fmt.Errorf("failed to lock idempotency key: %v", err)
 	}
 
-	// Validate sufficient shares
-	if holding.Shares < req.Shares {
-		return fmt.Errorf("insufficient shares: have %.2f, need %.2f", holding.Shares, req.Shares)
-	}
-
-	// Calculate totals
-	totalProceeds := (req.Shares * req.Price) - req.Fee
-	sharesAfter := holding.Shares - req.Shares
-
-	// Update holdings
-	query := `
-		UPDATE portfolio_holdings 
-		SET 
-			shares = $3,
-			updated_at = CURRENT_TIMESTAMP,
-			current_price = $4,
-			price_last_date = $5
-		WHERE portfolio_id = $1 AND ticker = $2`
-
-	// Just execute without storing result
-	if _, err := tx.Exec(query, portfolioID, req.Ticker, sharesAfter, req.Price, req.TransactionAt); err != nil {
-		return fmt.Errorf("failed to update holdings: %v", err)
+	var transactionID int
+	var requestHash string
+	err = tx.QueryRow(`
+		SELECT id, COALESCE(request_hash, '')
+		FROM portfolio_transactions
+		WHERE portfolio_id = $1 AND idempotency_key = $2
+	`, portfolioID, req.IdempotencyKey).Scan(&transactionID, &requestHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-
-	// Update cash balance
-	_, err = tx.Exec(`
-		UPDATE portfolio_holdings 
-		SET shares = shares + $2,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE portfolio_id = $1 AND ticker = 'CASH'
-	`, portfolioID, totalProceeds)
-
 	if err != nil {
-		return fmt.Errorf("failed to update cash balance: %v", err)
+		return nil, fmt.Errorf("failed to check idempotency key: %v", err)
 	}
 
-	// Update FIFO lots and calculate realized gain
-	realizedGainFIFO, err := s.updateFIFOLots(portfolioID, req.Ticker, req.Shares, req.Price, tx)
+	t, err := s.getTransaction(portfolioID, transactionID, tx)
 	if err != nil {
-		return fmt.Errorf("failed to update FIFO lots: %v", err)
+		return nil, err
 	}
+	return &idempotentTransaction{Transaction: *t, requestHash: requestHash}, nil
+}
 
-	// Calculate average cost realized gain
-	realizedGainAvg := req.Shares * (req.Price - holding.PurchaseCostAverage)
-
-	// Record transaction with realized gains
-	return s.recordTransaction(tx, portfolioID, req, holding.Shares, sharesAfter,
-		realizedGainAvg, realizedGainFIFO)
+// hash identifies the payload of a request independently of JSON formatting
+// and of the time zone its dates were written in
+func (r TransactionRequest) hash() string {
+	canonical := r
+	canonical.IdempotencyKey = ""
+	canonical.TransactionAt = r.TransactionAt.UTC()
+	canonical.ExDate = r.ExDate.UTC()
+	payload, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
 }
 
-// Update CreateTransaction to handle withdrawals
-func (s *Server) CreateTransaction(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	portfolioID, err := strconv.Atoi(vars["id"])
+// UpdateTransaction rewrites a transaction and replays the portfolio ledger.
+// The Idempotency-Key stays so a late retry of the create is not recorded
+// again, but the request hash is cleared: the row is no longer what that
+// request created, and a retry gets a 409.
+func (s *Server) UpdateTransaction(w http.ResponseWriter, r *http.Request) {
+	portfolioID, transactionID, err := transactionIDs(r)
 	if err != nil {
-		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Parse request body
 	var req TransactionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	// Start transaction
-	tx, err := s.db.Begin()
+	tx, err := s.beginTx(r)
 	if err != nil {
 		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
 		return
 	}
 	defer tx.Rollback()
 
-	// Initialize holdings if needed
-	err = s.initializePortfolioHoldings(portfolioID, tx)
+	existing, err := s.getTransaction(portfolioID, transactionID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	} else if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing.TransferID != nil {
+		s.respondWithError(w, http.StatusBadRequest, transferLegMessage(transactionID, *existing.TransferID))
+		return
+	}
+	if existing.CorporateActionID != nil {
+		s.respondWithError(w, http.StatusBadRequest, corporateActionMessage(transactionID, *existing.CorporateActionID))
+		return
+	}
+
+	// The recorded fee is kept unless the request sends a new one
+	if req.Fee == nil {
+		fee := existing.Fee
+		req.Fee = &fee
+	}
+	feeBreakdown, err := s.chargeFee(portfolioID, &req, tx)
 	if err != nil {
-		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to initialize holdings: %v", err))
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.normalize()
+	if err := s.fillExchangeRate(&req, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Validate ticker if present
 	if req.Ticker != "" {
 		if err := s.validateTicker(req.Ticker, tx); err != nil {
 			s.respondWithError(w, http.StatusBadRequest, err.Error())
@@ -559,32 +670,36 @@ func (s *Server) CreateTransaction(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Add before processing transaction
-	exists, err := s.checkTransactionExists(portfolioID, req, tx)
+	ticker, shares, price, amount := ledgerValues(req)
+	_, err = tx.Exec(`
+		UPDATE portfolio_transactions
+		SET type = $3, ticker = $4, shares = $5, price = $6,
+			amount = $7, fee = $8, notes = $9, transaction_at = $10,
+			withholding_tax = $11, ex_date = $12,
+			currency = $13, to_currency = $14, to_amount = $15, exchange_rate = $16,
+			request_hash = NULL
+		WHERE portfolio_id = $1 AND id = $2
+	`, portfolioID, transactionID, req.Type, ticker, shares, price,
+		amount, req.feeAmount(), req.Notes, req.TransactionAt,
+		req.WithholdingTax, nullIfZeroTime(req.ExDate),
+		req.Currency, nullIfEmpty(req.ToCurrency), nullIfZero(req.ToAmount), nullIfZero(req.ExchangeRate))
 	if err != nil {
-		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check transaction: %v", err))
+		s.logger.Error("Failed to update transaction %d: %v", transactionID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to update transaction")
 		return
 	}
-	if exists {
-		s.respondWithError(w, http.StatusConflict, "Transaction already exists")
+
+	if err := s.saveLotSelections(portfolioID, transactionID, req.Lots, tx); err != nil {
+		s.respondWithLedgerError(w, err)
 		return
 	}
 
-	// Process based on transaction type
-	switch req.Type {
-	case Deposit:
-		err = s.CreateDeposit(portfolioID, req, tx)
-	case Withdraw:
-		err = s.CreateWithdraw(portfolioID, req, tx)
-	case Buy:
-		err = s.CreateBuy(portfolioID, req, tx)
-	case Sell:
-		err = s.CreateSell(portfolioID, req, tx)
-	default:
-		s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid transaction type: %s", req.Type))
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
 		return
 	}
 
+	updated, err := s.getTransaction(portfolioID, transactionID, tx)
 	if err != nil {
 		s.respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -595,13 +710,131 @@ func (s *Server) CreateTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.respondWithJSON(w, http.StatusCreated, map[string]string{
-		"message": "Transaction created successfully",
+	s.respondWithJSON(w, http.StatusOK, TransactionResponse{
+		Transaction:  *updated,
+		TotalAmount:  updated.Amount,
+		FeeBreakdown: feeBreakdown,
+	})
+}
+
+// DeleteTransaction removes a transaction and replays the portfolio ledger
+func (s *Server) DeleteTransaction(w http.ResponseWriter, r *http.Request) {
+	portfolioID, transactionID, err := transactionIDs(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var transferID, corporateActionID *int
+	err = tx.QueryRow(`
+		SELECT transfer_id, corporate_action_id FROM portfolio_transactions
+		WHERE portfolio_id = $1 AND id = $2
+	`, portfolioID, transactionID).Scan(&transferID, &corporateActionID)
+	if err != nil && err != sql.ErrNoRows {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to get transaction")
+		return
+	}
+	if transferID != nil {
+		s.respondWithError(w, http.StatusBadRequest, transferLegMessage(transactionID, *transferID))
+		return
+	}
+	if corporateActionID != nil {
+		s.respondWithError(w, http.StatusBadRequest, corporateActionMessage(transactionID, *corporateActionID))
+		return
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM portfolio_transactions
+		WHERE portfolio_id = $1 AND id = $2
+	`, portfolioID, transactionID)
+	if err != nil {
+		s.logger.Error("Failed to delete transaction %d: %v", transactionID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to delete transaction")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		s.respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
+
+	if _, err := s.replayLedger(portfolioID, tx); err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Transaction %d deleted successfully", transactionID),
 	})
+}
+
+// transactionIDs parses the portfolio and transaction IDs from the request path
+func transactionIDs(r *http.Request) (int, int, error) {
+	vars := mux.Vars(r)
+	portfolioID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid portfolio ID")
+	}
+	transactionID, err := strconv.Atoi(vars["txId"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid transaction ID")
+	}
+	return portfolioID, transactionID, nil
+}
+
+// ledgerValues returns the ticker, shares, price and amount stored for a request.
+// Cash transactions keep ticker, shares and price NULL as required by the
+// valid_stock_transaction constraint. Values derived by replayLedger (BUY/SELL
+// amounts, dividend entitlement and net amount) are placeholders here.
+func ledgerValues(req TransactionRequest) (ticker, shares, price interface{}, amount float64) {
+	switch req.Type {
+	case Buy, Sell:
+		return req.Ticker, req.Shares, req.Price, req.Amount
+	case Dividend:
+		if req.DividendPerShare > 0 {
+			// Net amount is computed from the rate and entitlement on replay
+			return req.Ticker, nil, req.DividendPerShare, req.DividendPerShare
+		}
+		// Without a rate the gross amount is stored and the rate derived on replay
+		return req.Ticker, nil, 0.0, req.Amount
+	case Fee, Tax:
+		return nullIfEmpty(req.Ticker), nil, nil, req.Amount
+	default:
+		return nil, nil, nil, req.Amount
+	}
+}
+
+// transferLegMessage explains that one side of a transfer cannot be changed alone
+func transferLegMessage(transactionID, transferID int) string {
+	return fmt.Sprintf("Transaction %d is part of transfer %d; delete the transfer instead", transactionID, transferID)
+}
+
+// corporateActionMessage explains that a row recorded by a corporate action
+// belongs to the action, not to the user
+func corporateActionMessage(transactionID, actionID int) string {
+	return fmt.Sprintf("Transaction %d was recorded by corporate action %d; use the corporate action endpoints instead", transactionID, actionID)
+}
 
-	//Buy Transaction Logic
-	//Sell Transaction Logic
-	//Dividend Transaction Logic
+// respondWithLedgerError maps replay failures to a client or server error
+func (s *Server) respondWithLedgerError(w http.ResponseWriter, err error) {
+	var ledgerErr *LedgerError
+	if errors.As(err, &ledgerErr) || errors.Is(err, ErrInvalidTransaction) {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.logger.Error("Ledger replay failed: %v", err)
+	s.respondWithError(w, http.StatusInternalServerError, err.Error())
 }
 
 // ListTransactions handles GET requests for transactions
@@ -728,126 +961,29 @@ func (s *Server) getHolding(portfolioID int, ticker string, tx *sql.Tx) (*Holdin
 	return &holding, nil
 }
 
-// Add helper function
-func (s *Server) checkTransactionExists(portfolioID int, req TransactionRequest, tx *sql.Tx) (bool, error) {
-	var exists bool
+// findSimilarTransaction returns the id of an existing transaction that looks
+// like the same fill, or 0
+func (s *Server) findSimilarTransaction(portfolioID int, req TransactionRequest, tx *sql.Tx) (int, error) {
+	var transactionID int
 	err := tx.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM portfolio_transactions 
-			WHERE portfolio_id = $1 
-			AND type = $2 
-			AND ABS(amount - $3) < 0.01
-			AND transaction_at = $4
-			AND (
-				(ticker = $5 OR (ticker IS NULL AND $5 = '')) 
-				AND (ABS(shares - $6) < 0.01 OR shares IS NULL)
-				AND (ABS(price - $7) < 0.01 OR price IS NULL)
-				AND (ABS(fee - $8) < 0.01)
-			)
+		SELECT id FROM portfolio_transactions 
+		WHERE portfolio_id = $1 
+		AND type = $2 
+		AND ABS(amount - $3) < 0.01
+		AND transaction_at = $4
+		AND (
+			(ticker = $5 OR (ticker IS NULL AND $5 = '')) 
+			AND (ABS(shares - $6) < 0.01 OR shares IS NULL)
+			AND (ABS(price - $7) < 0.01 OR price IS NULL)
+			AND (ABS(fee - $8) < 0.01)
 		)
+		AND currency = $9
+		ORDER BY id
+		LIMIT 1
 	`, portfolioID, req.Type, req.Amount, req.TransactionAt,
-		req.Ticker, req.Shares, req.Price, req.Fee).Scan(&exists)
-	return exists, err
-}
-
-// Add recordTransaction method
-func (s *Server) recordTransaction(tx *sql.Tx, portfolioID int, req TransactionRequest, sharesBefore, sharesAfter float64, realizedGainAvg, realizedGainFIFO float64) error {
-	// Get current cash balance
-	cashBefore, err := s.getPortfolioBalance(portfolioID, tx)
-	if err != nil {
-		return fmt.Errorf("failed to get cash balance: %v", err)
-	}
-
-	// Calculate cash after
-	var cashAfter float64
-	switch req.Type {
-	case Buy:
-		cashAfter = cashBefore - ((req.Shares * req.Price) + req.Fee)
-	case Sell:
-		cashAfter = cashBefore + ((req.Shares * req.Price) - req.Fee)
-	case Deposit:
-		cashAfter = cashBefore + req.Amount
-	case Withdraw:
-		cashAfter = cashBefore - req.Amount
-	}
-
-	// Record transaction with realized gains
-	_, err = tx.Exec(`
-		INSERT INTO portfolio_transactions (
-			portfolio_id, type, ticker, shares, price, 
-			amount, fee, notes, transaction_at,
-			cash_balance_before, cash_balance_after,
-			shares_count_before, shares_count_after,
-			average_cost_before, average_cost_after,
-			realized_gain_avg, realized_gain_fifo
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
-	`,
-		portfolioID,
-		req.Type,
-		req.Ticker,
-		req.Shares,
-		req.Price,
-		req.Amount,
-		req.Fee,
-		req.Notes,
-		req.TransactionAt,
-		cashBefore,
-		cashAfter,
-		sharesBefore,
-		sharesAfter,
-		sharesBefore*req.Price,
-		sharesAfter*req.Price,
-		realizedGainAvg,
-		realizedGainFIFO,
-	)
-
-	if err != nil {
-		return fmt.Errorf("failed to record transaction: %v", err)
-	}
-
-	return nil
-}
-
-func (s *Server) updateFIFOLots(portfolioID int, ticker string, sharesToSell float64, sellPrice float64, tx *sql.Tx) (float64, error) {
-	var realizedGain float64
-	remainingToSell := sharesToSell
-
-	rows, err := tx.Query(`
-		SELECT id, remaining_shares, purchase_price 
-		FROM portfolio_stock_lots
-		WHERE portfolio_id = $1 AND ticker = $2 AND remaining_shares > 0
-		ORDER BY purchase_date ASC, id ASC
-		FOR UPDATE
-	`, portfolioID, ticker)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	for rows.Next() && remainingToSell > 0 {
-		var id int
-		var remainingShares, purchasePrice float64
-		if err := rows.Scan(&id, &remainingShares, &purchasePrice); err != nil {
-			return 0, err
-		}
-
-		sharesToSellFromLot := math.Min(remainingToSell, remainingShares)
-		remainingToSell -= sharesToSellFromLot
-		realizedGain += sharesToSellFromLot * (sellPrice - purchasePrice)
-
-		_, err = tx.Exec(`
-			UPDATE portfolio_stock_lots 
-			SET remaining_shares = remaining_shares - $1
-			WHERE id = $2
-		`, sharesToSellFromLot, id)
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	if remainingToSell > 0 {
-		return 0, fmt.Errorf("insufficient shares in FIFO lots")
+		req.Ticker, req.Shares, req.Price, req.feeAmount(), req.Currency).Scan(&transactionID)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-
-	return realizedGain, nil
+	return transactionID, err
 }
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionRequestHash(t *testing.T) {
+	decode := func(body string) TransactionRequest {
+		var req TransactionRequest
+		assert.NoError(t, json.Unmarshal([]byte(body), &req))
+		return req
+	}
+
+	original := decode(`{"type": "BUY", "ticker": "BBOB", "shares": 100, "price": 2.5, "transaction_at": "2024-02-21T10:00:00Z"}`)
+	retry := decode(`{"transaction_at":"2024-02-21T13:00:00+03:00","price":2.50,"shares":100,"ticker":"BBOB","type":"BUY"}`)
+	changed := decode(`{"type": "BUY", "ticker": "BBOB", "shares": 200, "price": 2.5, "transaction_at": "2024-02-21T10:00:00Z"}`)
+
+	assert.Equal(t, original.hash(), retry.hash(), "formatting and time zone do not change the hash")
+	assert.NotEqual(t, original.hash(), changed.hash())
+}
+
+func TestParseTransactionFilter(t *testing.T) {
+	cursor := transactionCursor{TransactionAt: time.Date(2024, 2, 21, 10, 0, 0, 500, time.UTC), ID: 456}
+	query := url.Values{
+		"from":   {"2024-01-01"},
+		"type":   {"buy, SELL"},
+		"ticker": {"bbob"},
+		"sort":   {"asc"},
+		"limit":  {"20"},
+		"cursor": {cursor.encode()},
+	}
+
+	f, err := parseTransactionFilter(query)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BUY", "SELL"}, f.Types)
+	assert.Equal(t, "BBOB", f.Ticker)
+	assert.True(t, f.Ascending)
+	assert.Equal(t, 20, f.Limit)
+	assert.True(t, cursor.TransactionAt.Equal(f.After.TransactionAt))
+	assert.Equal(t, 456, f.After.ID)
+
+	where, args := f.conditions(123)
+	assert.Equal(t, "portfolio_id = $1 AND transaction_at >= $2 AND type::text = ANY($3) AND ticker = $4", where)
+	assert.Len(t, args, 4)
+
+	for _, bad := range []url.Values{{"type": {"SWAP"}}, {"sort": {"up"}}, {"limit": {"0"}}, {"cursor": {"x"}}} {
+		_, err := parseTransactionFilter(bad)
+		assert.Error(t, err)
+	}
+}
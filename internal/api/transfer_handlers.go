@@ -0,0 +1,526 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TransferRequest moves CASH, or shares of a ticker in kind, between portfolios
+type TransferRequest struct {
+	FromPortfolioID int            `json:"from_portfolio_id"`
+	ToPortfolioID   int            `json:"to_portfolio_id"`
+	Ticker          string         `json:"ticker,omitempty"` // Empty for a cash transfer
+	Shares          float64        `json:"shares,omitempty"`
+	Amount          float64        `json:"amount,omitempty"`   // Cash to move
+	Currency        string         `json:"currency,omitempty"` // Of the cash, defaults to IQD
+	Price           float64        `json:"price,omitempty"`    // Market price of the shares, defaults to the last close
+	Lots            []LotSelection `json:"lots,omitempty"`     // Lots of the source portfolio to move
+	Notes           string         `json:"notes"`
+	TransferAt      time.Time      `json:"transfer_at"`
+}
+
+// Transfer is a movement between two portfolios. Its amount is the cash moved,
+// or the market value of the shares moved, and is the external flow recorded
+// on each side.
+type Transfer struct {
+	ID              int           `json:"id"`
+	FromPortfolioID *int          `json:"from_portfolio_id"` // nil once the portfolio is deleted
+	ToPortfolioID   *int          `json:"to_portfolio_id"`
+	Ticker          string        `json:"ticker,omitempty"`
+	Shares          float64       `json:"shares,omitempty"`
+	Amount          float64       `json:"amount"`
+	Currency        string        `json:"currency"`
+	Notes           string        `json:"notes"`
+	TransferAt      time.Time     `json:"transfer_at"`
+	CreatedAt       time.Time     `json:"created_at"`
+	Transactions    []Transaction `json:"transactions,omitempty"`
+}
+
+// Validate checks if the transfer request is valid
+func (r *TransferRequest) Validate() error {
+	if r.FromPortfolioID == 0 || r.ToPortfolioID == 0 {
+		return fmt.Errorf("from_portfolio_id and to_portfolio_id are required")
+	}
+	if r.FromPortfolioID == r.ToPortfolioID {
+		return fmt.Errorf("cannot transfer to the same portfolio")
+	}
+	currency, err := normalizeCurrency(r.Currency)
+	if err != nil {
+		return err
+	}
+	if r.Ticker == "" {
+		if r.Amount <= 0 {
+			return fmt.Errorf("amount must be positive for a cash transfer")
+		}
+		if r.Shares != 0 || len(r.Lots) > 0 {
+			return fmt.Errorf("shares and lots require a ticker")
+		}
+		return nil
+	}
+	if r.Shares <= 0 {
+		return fmt.Errorf("shares must be positive for a share transfer")
+	}
+	if currency != LedgerCurrency {
+		return fmt.Errorf("shares are transferred at their value in %s", LedgerCurrency)
+	}
+	if r.Price < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	if r.Amount != 0 {
+		return fmt.Errorf("amount is only used for cash transfers")
+	}
+	if len(r.Lots) > 0 {
+		return validateLotSelections(r.Lots, r.Shares)
+	}
+	return nil
+}
+
+// createTransfer records a transfer and replays both portfolios. Shares leave
+// the source portfolio like a sale, by lot selection or cost-basis method, but
+// at cost. Every lot they come from arrives in the destination as its own
+// TRANSFER_IN with the lot's purchase price and date.
+func (s *Server) createTransfer(req TransferRequest, tx *sql.Tx) (*Transfer, error) {
+	for _, portfolioID := range []int{req.FromPortfolioID, req.ToPortfolioID} {
+		if err := s.initializePortfolioHoldings(portfolioID, tx); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+		}
+	}
+
+	var ticker, shares, price interface{}
+	amount := req.Amount
+	if req.Ticker != "" {
+		if err := s.validateTicker(req.Ticker, tx); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+		}
+		if req.Price == 0 {
+			lastClose, err := s.getClosePrice(req.Ticker, req.TransferAt, tx)
+			if err != nil {
+				return nil, err
+			}
+			req.Price = lastClose
+		}
+		ticker, shares, price = req.Ticker, req.Shares, req.Price
+		amount = req.Shares * req.Price
+	}
+
+	var transferID int
+	err := tx.QueryRow(`
+		INSERT INTO portfolio_transfers (
+			from_portfolio_id, to_portfolio_id, ticker, shares, amount, currency, notes, transfer_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, req.FromPortfolioID, req.ToPortfolioID, ticker, shares, amount, req.Currency,
+		nullIfEmpty(req.Notes), req.TransferAt).Scan(&transferID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record transfer: %v", err)
+	}
+
+	outID, err := s.insertTransferLeg(req.FromPortfolioID, transferID, TransferOut,
+		ticker, shares, price, amount, req.Currency, nil, req.Notes, req.TransferAt, tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Lots) > 0 {
+		if err := s.saveLotSelections(req.FromPortfolioID, outID, req.Lots, tx); err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := s.replayLedger(req.FromPortfolioID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Ticker == "" {
+		_, err := s.insertTransferLeg(req.ToPortfolioID, transferID, TransferIn,
+			nil, nil, nil, amount, req.Currency, nil, req.Notes, req.TransferAt, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range source.matches {
+		if m.SaleTransactionID != outID {
+			continue
+		}
+		acquiredAt := m.Lot.PurchaseDate
+		_, err := s.insertTransferLeg(req.ToPortfolioID, transferID, TransferIn,
+			req.Ticker, m.Shares, m.PurchasePrice, m.Shares*req.Price, req.Currency, &acquiredAt,
+			req.Notes, req.TransferAt, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := s.replayLedger(req.ToPortfolioID, tx); err != nil {
+		return nil, err
+	}
+
+	return s.getTransfer(transferID, tx)
+}
+
+// insertTransferLeg stores one side of a transfer. Shares transferred in are
+// priced at their original lot's purchase price and dated by acquiredAt.
+func (s *Server) insertTransferLeg(portfolioID, transferID int, txType TransactionType,
+	ticker, shares, price interface{}, amount float64, currency string, acquiredAt *time.Time,
+	notes string, at time.Time, tx *sql.Tx) (int, error) {
+	var transactionID int
+	err := tx.QueryRow(`
+		INSERT INTO portfolio_transactions (
+			portfolio_id, type, ticker, shares, price, amount, currency, fee, notes,
+			transaction_at, transfer_id, acquired_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, $9, $10, $11)
+		RETURNING id
+	`, portfolioID, txType, ticker, shares, price, amount, currency, notes,
+		at, transferID, acquiredAt).Scan(&transactionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record %s transaction: %v", txType, err)
+	}
+	return transactionID, nil
+}
+
+// getClosePrice returns the last closing price of a ticker on or before a date
+func (s *Server) getClosePrice(ticker string, at time.Time, tx *sql.Tx) (float64, error) {
+	var price float64
+	err := tx.QueryRow(`
+		SELECT close_price
+		FROM daily_stock_prices
+		WHERE ticker = $1 AND date <= $2 AND close_price > 0
+		ORDER BY date DESC
+		LIMIT 1
+	`, ticker, at).Scan(&price)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: no price for %s on %s, price is required",
+			ErrInvalidTransaction, ticker, at.Format("2006-01-02"))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get close price: %v", err)
+	}
+	return price, nil
+}
+
+const transferColumns = `
+	id, from_portfolio_id, to_portfolio_id,
+	COALESCE(ticker, '') as ticker,
+	COALESCE(shares, 0) as shares,
+	amount, currency,
+	COALESCE(notes, '') as notes,
+	transfer_at, created_at`
+
+func scanTransfer(row scanner) (Transfer, error) {
+	var t Transfer
+	err := row.Scan(
+		&t.ID, &t.FromPortfolioID, &t.ToPortfolioID,
+		&t.Ticker, &t.Shares, &t.Amount, &t.Currency,
+		&t.Notes, &t.TransferAt, &t.CreatedAt,
+	)
+	return t, err
+}
+
+// getTransfer loads a transfer with the transactions of both sides
+func (s *Server) getTransfer(transferID int, tx *sql.Tx) (*Transfer, error) {
+	transfer, err := scanTransfer(tx.QueryRow(`SELECT `+transferColumns+`
+		FROM portfolio_transfers WHERE id = $1`, transferID))
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer: %v", err)
+	}
+
+	rows, err := tx.Query(`SELECT `+ledgerColumns+`
+		FROM portfolio_transactions
+		WHERE transfer_id = $1
+		ORDER BY id`, transferID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer transactions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanLedgerTransaction(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning transaction: %v", err)
+		}
+		transfer.Transactions = append(transfer.Transactions, t)
+	}
+	return &transfer, rows.Err()
+}
+
+// CreateTransfer moves cash or shares between two portfolios atomically
+func (s *Server) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	req.Ticker = strings.ToUpper(req.Ticker)
+	if currency, err := normalizeCurrency(req.Currency); err == nil {
+		req.Currency = currency
+	}
+	if req.TransferAt.IsZero() {
+		req.TransferAt = time.Now()
+	}
+	if err := req.Validate(); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	transfer, err := s.createTransfer(req, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.logger.Info("Transferred %s from portfolio %d to portfolio %d",
+		transferDescription(transfer), req.FromPortfolioID, req.ToPortfolioID)
+	s.respondWithJSON(w, http.StatusCreated, transfer)
+}
+
+func transferDescription(t *Transfer) string {
+	if t.Ticker == "" {
+		return fmt.Sprintf("%.2f cash", t.Amount)
+	}
+	return fmt.Sprintf("%g %s", t.Shares, t.Ticker)
+}
+
+// ListTransfers returns transfers, newest first, optionally for one portfolio
+func (s *Server) ListTransfers(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + transferColumns + ` FROM portfolio_transfers`
+	var args []interface{}
+	if raw := r.URL.Query().Get("portfolio_id"); raw != "" {
+		portfolioID, err := strconv.Atoi(raw)
+		if err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+			return
+		}
+		query += ` WHERE from_portfolio_id = $1 OR to_portfolio_id = $1`
+		args = append(args, portfolioID)
+	}
+	query += ` ORDER BY transfer_at DESC, id DESC`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		s.logger.Error("Failed to list transfers: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to list transfers")
+		return
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			s.logger.Error("Failed to scan transfer: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to list transfers")
+			return
+		}
+		transfers = append(transfers, t)
+	}
+
+	s.respondWithJSON(w, http.StatusOK, transfers)
+}
+
+// GetTransfer returns a transfer with the transactions of both sides
+func (s *Server) GetTransfer(w http.ResponseWriter, r *http.Request) {
+	transferID, err := strconv.Atoi(mux.Vars(r)["transferId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid transfer ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	transfer, err := s.getTransfer(transferID, tx)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Transfer not found")
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, transfer)
+}
+
+// DeleteTransfer removes both sides of a transfer and replays both portfolios.
+// It fails if the destination has since used what it received.
+func (s *Server) DeleteTransfer(w http.ResponseWriter, r *http.Request) {
+	transferID, err := strconv.Atoi(mux.Vars(r)["transferId"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid transfer ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var from, to *int
+	err = tx.QueryRow(`
+		DELETE FROM portfolio_transfers
+		WHERE id = $1
+		RETURNING from_portfolio_id, to_portfolio_id
+	`, transferID).Scan(&from, &to)
+	if err == sql.ErrNoRows {
+		s.respondWithError(w, http.StatusNotFound, "Transfer not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to delete transfer %d: %v", transferID, err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to delete transfer")
+		return
+	}
+
+	for _, portfolioID := range []*int{from, to} {
+		if portfolioID == nil {
+			continue
+		}
+		if _, err := s.replayLedger(*portfolioID, tx); err != nil {
+			s.respondWithLedgerError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Transfer %d deleted successfully", transferID),
+	})
+}
+
+// transferConflict returns a message naming the transfers a portfolio is a
+// side of, or "" if it has none. Removing one leg of a transfer would leave
+// the other portfolio with money or shares from nowhere.
+func (s *Server) transferConflict(portfolioID int, tx *sql.Tx) (string, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT transfer_id FROM portfolio_transactions
+		WHERE portfolio_id = $1 AND transfer_id IS NOT NULL
+		ORDER BY transfer_id
+	`, portfolioID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get transfers: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return "", fmt.Errorf("error scanning transfer: %v", err)
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to get transfers: %v", err)
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Portfolio %d is part of transfers %s; delete them first", portfolioID, strings.Join(ids, ", ")), nil
+}
+
+// transferLeg is a stored TRANSFER_IN row of an in-kind transfer
+type transferLeg struct {
+	Shares     float64
+	Price      float64
+	AcquiredAt *time.Time
+}
+
+// loadTransferLegs returns the TRANSFER_IN rows of the in-kind transfers out
+// of a portfolio, by transfer id, in the order they were created
+func (s *Server) loadTransferLegs(portfolioID int, tx *sql.Tx) (map[int][]transferLeg, error) {
+	rows, err := tx.Query(`
+		SELECT i.transfer_id, i.shares, i.price, i.acquired_at
+		FROM portfolio_transactions i
+		JOIN portfolio_transactions o ON o.transfer_id = i.transfer_id
+		WHERE o.portfolio_id = $1 AND o.type = 'TRANSFER_OUT' AND o.ticker IS NOT NULL
+			AND i.type = 'TRANSFER_IN'
+		ORDER BY i.transfer_id, i.id
+	`, portfolioID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load transfer legs: %v", err)
+	}
+	defer rows.Close()
+
+	legs := make(map[int][]transferLeg)
+	for rows.Next() {
+		var transferID int
+		var leg transferLeg
+		if err := rows.Scan(&transferID, &leg.Shares, &leg.Price, &leg.AcquiredAt); err != nil {
+			return nil, fmt.Errorf("error scanning transfer leg: %v", err)
+		}
+		legs[transferID] = append(legs[transferID], leg)
+	}
+	return legs, rows.Err()
+}
+
+// checkTransferredLots returns a *LedgerError for the first in-kind transfer
+// out of txns whose replayed lot matches no longer agree with the legs its
+// destination was credited with. The destination keeps the cost basis and
+// acquisition dates of the lots it received, so the source's history before
+// a transfer cannot change while the transfer exists. Transfers without legs,
+// such as one being created, are skipped.
+func checkTransferredLots(txns []Transaction, matches []ledgerMatch, legs map[int][]transferLeg) error {
+	for _, t := range txns {
+		if t.Type != TransferOut || t.Ticker == "" || t.TransferID == nil {
+			continue
+		}
+		stored, ok := legs[*t.TransferID]
+		if !ok {
+			continue
+		}
+		var moved []ledgerMatch
+		for _, m := range matches {
+			if m.SaleTransactionID == t.ID {
+				moved = append(moved, m)
+			}
+		}
+		same := len(moved) == len(stored)
+		for i := 0; same && i < len(moved); i++ {
+			same = math.Abs(moved[i].Shares-stored[i].Shares) <= ledgerEpsilon &&
+				math.Abs(moved[i].PurchasePrice-stored[i].Price) <= ledgerEpsilon &&
+				stored[i].AcquiredAt != nil && moved[i].Lot.PurchaseDate.Equal(*stored[i].AcquiredAt)
+		}
+		if !same {
+			return &LedgerError{
+				TransactionID: t.ID,
+				TransactionAt: t.TransactionAt,
+				Message: fmt.Sprintf("the change would alter the lots moved by transfer %d; delete the transfer first",
+					*t.TransferID),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTransferredLots(t *testing.T) {
+	transferID := 9
+	ledger := func(firstPrice float64) []Transaction {
+		return []Transaction{
+			{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+			{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: firstPrice, TransactionAt: ledgerDay(2)},
+			{ID: 3, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 4, TransactionAt: ledgerDay(3)},
+			{ID: 4, Type: TransferOut, Ticker: "BBOB", Shares: 1500, Price: 5, Amount: 7500, TransferID: &transferID, TransactionAt: ledgerDay(10)},
+		}
+	}
+	first, second := ledgerDay(2), ledgerDay(3)
+	legs := map[int][]transferLeg{transferID: {
+		{Shares: 1000, Price: 2, AcquiredAt: &first},
+		{Shares: 500, Price: 4, AcquiredAt: &second},
+	}}
+
+	txns := ledger(2)
+	state, err := replayTransactions(txns, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, checkTransferredLots(txns, state.matches, legs))
+	assert.NoError(t, checkTransferredLots(txns, state.matches, nil), "a transfer being created has no legs yet")
+
+	// Repricing a lot that was moved would leave the destination's cost basis stale
+	txns = ledger(3)
+	state, err = replayTransactions(txns, nil)
+	assert.NoError(t, err)
+	err = checkTransferredLots(txns, state.matches, legs)
+	var ledgerErr *LedgerError
+	assert.True(t, errors.As(err, &ledgerErr))
+	assert.Equal(t, 4, ledgerErr.TransactionID)
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"time"
 )
@@ -61,8 +62,65 @@ const (
 	Buy      TransactionType = "BUY"
 	Sell     TransactionType = "SELL"
 	Dividend TransactionType = "DIVIDEND"
+	Split    TransactionType = "SPLIT"  // Non-cash share adjustment from a corporate action
+	Rights   TransactionType = "RIGHTS" // Rights issue subscription at the subscription price
+
+	// Linked legs of a transfer between portfolios, created through /api/transfers
+	TransferOut TransactionType = "TRANSFER_OUT"
+	TransferIn  TransactionType = "TRANSFER_IN"
+
+	// Converts cash from one currency to another at an exchange rate
+	FX TransactionType = "FX"
+
+	// Income and expenses of the account itself rather than money moved in
+	// or out by the owner. FEE and TAX may name the security they relate to.
+	Interest TransactionType = "INTEREST" // Bank or broker interest credited
+	Fee      TransactionType = "FEE"      // Custody, maintenance and other account charges
+	Tax      TransactionType = "TAX"      // Tax withheld or paid from the account
 )
 
+// TransactionTypes lists every transaction type
+var TransactionTypes = []TransactionType{
+	Deposit, Withdraw, Buy, Sell, Dividend, Split, Rights,
+	TransferOut, TransferIn, FX, Interest, Fee, Tax,
+}
+
+func (tt TransactionType) Valid() bool {
+	for _, known := range TransactionTypes {
+		if tt == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncomeOrExpense reports whether a transaction type is income or an
+// expense of the portfolio rather than an external cash flow
+func (tt TransactionType) isIncomeOrExpense() bool {
+	return tt == Interest || tt == Fee || tt == Tax
+}
+
+// LedgerCurrency is the currency securities trade and settle in. Cash can be
+// held in other currencies; the CASH holding is the balance in this one.
+const LedgerCurrency = "IQD"
+
+// normalizeCurrency upper-cases a currency code, defaulting to LedgerCurrency
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return LedgerCurrency, nil
+	}
+	if len(code) != 3 {
+		return "", fmt.Errorf("invalid currency code: %s", code)
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("invalid currency code: %s", code)
+		}
+	}
+	return code, nil
+}
+
 // Custom time type that can handle both formats
 type JSONTime time.Time
 
@@ -96,6 +154,28 @@ func (t JSONTime) Time() time.Time {
 	return time.Time(t)
 }
 
+// CostBasisMethod selects which lots a sale consumes and how its gain is measured
+type CostBasisMethod string
+
+const (
+	CostBasisFIFO    CostBasisMethod = "FIFO"    // Oldest lots first
+	CostBasisLIFO    CostBasisMethod = "LIFO"    // Newest lots first
+	CostBasisHIFO    CostBasisMethod = "HIFO"    // Highest-cost lots first
+	CostBasisAverage CostBasisMethod = "AVERAGE" // Average cost; lots are consumed oldest first
+)
+
+// CostBasisMethods lists every supported method, FIFO first
+var CostBasisMethods = []CostBasisMethod{CostBasisFIFO, CostBasisLIFO, CostBasisHIFO, CostBasisAverage}
+
+func (m CostBasisMethod) Valid() bool {
+	for _, method := range CostBasisMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 // TransactionRequest represents the incoming transaction request
 type TransactionRequest struct {
 	Type          TransactionType `json:"type"`
@@ -103,13 +183,71 @@ type TransactionRequest struct {
 	Shares        float64         `json:"shares"`
 	Price         float64         `json:"price"`
 	Amount        float64         `json:"amount"`
-	Fee           float64         `json:"fee"`
+	Fee           *float64        `json:"fee,omitempty"` // Computed from the portfolio's fee schedule when omitted
 	Notes         string          `json:"notes"`
 	TransactionAt time.Time       `json:"transaction_at"`
+
+	// Dividend fields
+	DividendPerShare float64   `json:"dividend_per_share,omitempty"`
+	WithholdingTax   float64   `json:"withholding_tax,omitempty"`
+	ExDate           time.Time `json:"ex_date,omitempty"` // Defaults to transaction_at
+
+	// Specific lots to sell from; FIFO is used when empty
+	Lots []LotSelection `json:"lots,omitempty"`
+
+	// Currency of the amount and fee, defaults to IQD. Only cash transactions
+	// can use another currency. FX converts amount into to_amount of
+	// to_currency; one of to_amount and exchange_rate derives the other.
+	Currency     string  `json:"currency,omitempty"`
+	ToCurrency   string  `json:"to_currency,omitempty"`
+	ToAmount     float64 `json:"to_amount,omitempty"`
+	ExchangeRate float64 `json:"exchange_rate,omitempty"` // to_currency per unit of currency
+
+	// Set from the Idempotency-Key header and stored with the transaction
+	IdempotencyKey string `json:"-"`
+	requestHash    string
+}
+
+// LotSelection picks a number of shares from a lot when selling
+type LotSelection struct {
+	LotID  int     `json:"lot_id"`
+	Shares float64 `json:"shares"`
+}
+
+// LotMatch records the shares of a lot consumed by a sale
+type LotMatch struct {
+	LotID         int     `json:"lot_id"`
+	Shares        float64 `json:"shares"`
+	PurchasePrice float64 `json:"purchase_price"`
+	SalePrice     float64 `json:"sale_price"`
+	RealizedGain  float64 `json:"realized_gain"`
+	Specified     bool    `json:"specified"`
+}
+
+// feeAmount returns the fee of the request, zero when none was supplied
+func (r *TransactionRequest) feeAmount() float64 {
+	if r.Fee == nil {
+		return 0
+	}
+	return *r.Fee
 }
 
 // Validate checks if the transaction request is valid
 func (r *TransactionRequest) Validate() error {
+	if r.feeAmount() < 0 {
+		return fmt.Errorf("fee cannot be negative")
+	}
+	currency, err := normalizeCurrency(r.Currency)
+	if err != nil {
+		return err
+	}
+	if r.Ticker != "" && currency != LedgerCurrency {
+		return fmt.Errorf("%s transactions are settled in %s", r.Type, LedgerCurrency)
+	}
+	if r.Type != FX && (r.ToCurrency != "" || r.ToAmount != 0 || r.ExchangeRate != 0) {
+		return fmt.Errorf("to_currency, to_amount and exchange_rate are only used for %s transactions", FX)
+	}
+
 	switch r.Type {
 	case Buy, Sell:
 		if r.Ticker == "" {
@@ -124,19 +262,120 @@ func (r *TransactionRequest) Validate() error {
 		if r.Amount <= 0 {
 			return fmt.Errorf("amount must be positive for %s transactions", r.Type)
 		}
-		if r.Fee < 0 {
-			return fmt.Errorf("fee cannot be negative")
+		if len(r.Lots) > 0 {
+			if r.Type != Sell {
+				return fmt.Errorf("lots can only be selected for %s transactions", Sell)
+			}
+			if err := validateLotSelections(r.Lots, r.Shares); err != nil {
+				return err
+			}
 		}
 	case Deposit, Withdraw:
 		if r.Amount <= 0 {
 			return fmt.Errorf("amount must be positive for %s transactions", r.Type)
 		}
+		if r.Type == Deposit && r.feeAmount() >= r.Amount {
+			return fmt.Errorf("fee must be less than the deposit amount")
+		}
+	case Dividend:
+		if r.Ticker == "" {
+			return fmt.Errorf("ticker is required for %s transactions", r.Type)
+		}
+		if r.DividendPerShare < 0 || r.Amount < 0 {
+			return fmt.Errorf("dividend amounts cannot be negative")
+		}
+		if r.DividendPerShare == 0 && r.Amount == 0 {
+			return fmt.Errorf("dividend_per_share or amount is required for %s transactions", r.Type)
+		}
+		if r.WithholdingTax < 0 {
+			return fmt.Errorf("withholding tax cannot be negative")
+		}
+		if r.Amount > 0 && r.WithholdingTax >= r.Amount {
+			return fmt.Errorf("withholding tax must be less than the gross dividend")
+		}
+	case Interest, Fee, Tax:
+		if r.Type == Interest && r.Ticker != "" {
+			return fmt.Errorf("ticker is not used for %s transactions", r.Type)
+		}
+		if r.Amount <= 0 {
+			return fmt.Errorf("amount must be positive for %s transactions", r.Type)
+		}
+		if r.feeAmount() > 0 {
+			return fmt.Errorf("fee is not used for %s transactions", r.Type)
+		}
+		if r.Shares != 0 || r.Price != 0 {
+			return fmt.Errorf("shares and price are not used for %s transactions", r.Type)
+		}
+	case FX:
+		if r.Ticker != "" {
+			return fmt.Errorf("ticker is not used for %s transactions", r.Type)
+		}
+		if r.Amount <= 0 {
+			return fmt.Errorf("amount must be positive for %s transactions", r.Type)
+		}
+		toCurrency, err := normalizeCurrency(r.ToCurrency)
+		if err != nil {
+			return err
+		}
+		if r.ToCurrency == "" || toCurrency == currency {
+			return fmt.Errorf("to_currency must be a different currency for %s transactions", r.Type)
+		}
+		if r.ExchangeRate < 0 || r.ToAmount < 0 {
+			return fmt.Errorf("exchange rate and to_amount cannot be negative")
+		}
+		if r.ExchangeRate == 0 || r.ToAmount == 0 {
+			return fmt.Errorf("exchange_rate or to_amount is required for %s transactions", r.Type)
+		}
 	default:
 		return fmt.Errorf("invalid transaction type: %s", r.Type)
 	}
 	return nil
 }
 
+// validateLotSelections checks that the selected lots add up to the shares sold
+func validateLotSelections(lots []LotSelection, shares float64) error {
+	seen := make(map[int]bool)
+	total := 0.0
+	for _, lot := range lots {
+		if lot.Shares <= 0 {
+			return fmt.Errorf("shares must be positive for lot %d", lot.LotID)
+		}
+		if seen[lot.LotID] {
+			return fmt.Errorf("lot %d is selected more than once", lot.LotID)
+		}
+		seen[lot.LotID] = true
+		total += lot.Shares
+	}
+	if math.Abs(total-shares) > ledgerEpsilon {
+		return fmt.Errorf("selected lots total %.6f shares, expected %.6f", total, shares)
+	}
+	return nil
+}
+
+// normalize fills in the amount of BUY and SELL requests from shares, price
+// and fee, upper-cases currencies, and completes the to_amount or exchange
+// rate of FX requests
+func (r *TransactionRequest) normalize() {
+	if currency, err := normalizeCurrency(r.Currency); err == nil {
+		r.Currency = currency
+	}
+	r.ToCurrency = strings.ToUpper(strings.TrimSpace(r.ToCurrency))
+
+	switch r.Type {
+	case Buy:
+		r.Amount = r.Shares*r.Price + r.feeAmount()
+	case Sell:
+		r.Amount = r.Shares*r.Price - r.feeAmount()
+	case FX:
+		if r.ToAmount == 0 && r.ExchangeRate > 0 {
+			r.ToAmount = math.Round(r.Amount*r.ExchangeRate*100) / 100
+		}
+		if r.ExchangeRate == 0 && r.ToAmount > 0 && r.Amount > 0 {
+			r.ExchangeRate = r.ToAmount / r.Amount
+		}
+	}
+}
+
 // Transaction represents a portfolio transaction
 type Transaction struct {
 	ID                int             `json:"id"`
@@ -158,12 +397,41 @@ type Transaction struct {
 	AverageCostAfter  float64         `json:"average_cost_after"`
 	RealizedGainAvg   float64         `json:"realized_gain_avg"`
 	RealizedGainFIFO  float64         `json:"realized_gain_fifo"`
+	RealizedGain      float64         `json:"realized_gain"` // Under the portfolio's cost-basis method
+	WithholdingTax    float64         `json:"withholding_tax"`
+	ExDate            *time.Time      `json:"ex_date,omitempty"`
+	SplitRatio        float64         `json:"split_ratio,omitempty"`
+	EntitlementRatio  float64         `json:"entitlement_ratio,omitempty"`
+	CorporateActionID *int            `json:"corporate_action_id,omitempty"`
+	TransferID        *int            `json:"transfer_id,omitempty"`
+	AcquiredAt        *time.Time      `json:"acquired_at,omitempty"` // Original purchase date of shares transferred in
+	IdempotencyKey    string          `json:"idempotency_key,omitempty"`
+	Currency          string          `json:"currency"` // Of amount, fee and cash balances
+	ToCurrency        string          `json:"to_currency,omitempty"`
+	ToAmount          float64         `json:"to_amount,omitempty"`
+	ExchangeRate      float64         `json:"exchange_rate,omitempty"`
+	Lots              []LotSelection  `json:"lots,omitempty"`
+	LotMatches        []LotMatch      `json:"lot_matches,omitempty"`
+}
+
+// currency returns the currency of the transaction's amount and fee
+func (t *Transaction) currency() string {
+	if t.Currency == "" {
+		return LedgerCurrency
+	}
+	return t.Currency
 }
 
 // TransactionResponse includes the transaction and calculated fields
 type TransactionResponse struct {
-	Transaction Transaction `json:"transaction"`
-	TotalAmount float64     `json:"total_amount"`
+	Transaction  Transaction   `json:"transaction"`
+	TotalAmount  float64       `json:"total_amount"`
+	FeeBreakdown *FeeBreakdown `json:"fee_breakdown,omitempty"`
+
+	// Set when an existing transaction has the same type, ticker, amounts and
+	// time. The transaction is still recorded.
+	PossibleDuplicateOf int      `json:"possible_duplicate_of,omitempty"`
+	Warnings            []string `json:"warnings,omitempty"`
 }
 
 // TransactionSummary represents portfolio transaction summary
@@ -180,8 +448,9 @@ type TransactionSummary struct {
 // TransactionsListResponse represents the response for listing transactions
 type TransactionsListResponse struct {
 	Transactions []TransactionResponse `json:"transactions"`
-	Total        int                   `json:"total"`
+	Total        int                   `json:"total"` // Matching transactions on all pages
 	Summary      TransactionSummary    `json:"summary"`
+	NextCursor   string                `json:"next_cursor,omitempty"`
 }
 
 type StockGains struct {
@@ -300,15 +569,28 @@ type StockTransaction struct {
 
 // Add PortfolioSummary type
 type PortfolioSummary struct {
-	Name                string    `json:"name"`
-	Description         string    `json:"description"`
-	TotalValue          float64   `json:"total_value"`
-	TotalCostAverage    float64   `json:"total_cost_average"`
-	TotalCostFIFO       float64   `json:"total_cost_fifo"`
-	TotalGainAverage    float64   `json:"total_gain_average"`
-	TotalGainFIFO       float64   `json:"total_gain_fifo"`
-	RealizedGainAverage float64   `json:"realized_gain_average"`
-	RealizedGainFIFO    float64   `json:"realized_gain_fifo"`
-	CreatedAt           time.Time `json:"created_at"`
-	UpdatedAt           time.Time `json:"updated_at"`
+	Name                string             `json:"name"`
+	Description         string             `json:"description"`
+	Currency            string             `json:"currency"` // Of all amounts below except cash_balances
+	TotalValue          float64            `json:"total_value"`
+	TotalCostAverage    float64            `json:"total_cost_average"`
+	TotalCostFIFO       float64            `json:"total_cost_fifo"`
+	TotalGainAverage    float64            `json:"total_gain_average"`
+	TotalGainFIFO       float64            `json:"total_gain_fifo"`
+	RealizedGainAverage float64            `json:"realized_gain_average"`
+	RealizedGainFIFO    float64            `json:"realized_gain_fifo"`
+	CostBasisMethod     string             `json:"cost_basis_method"`
+	CostBasis           []CostBasisSummary `json:"cost_basis"`
+	CashBalances        []CashBalance      `json:"cash_balances"` // In their own currencies
+	CreatedAt           time.Time          `json:"created_at"`
+	UpdatedAt           time.Time          `json:"updated_at"`
+}
+
+// CostBasisSummary shows a portfolio's gains under one cost-basis method
+type CostBasisSummary struct {
+	Method         CostBasisMethod `json:"method"`
+	CostBasis      float64         `json:"cost_basis"`
+	RealizedGain   float64         `json:"realized_gain"`
+	UnrealizedGain float64         `json:"unrealized_gain"`
+	TotalGain      float64         `json:"total_gain"`
 }
@@ -0,0 +1,527 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// valuationsClient names the valuation job in the audit log
+const valuationsClient = "valuations"
+
+// Intervals of the valuation history
+const (
+	IntervalDaily   = "daily"
+	IntervalWeekly  = "weekly"
+	IntervalMonthly = "monthly"
+)
+
+// ValuationPosition is the value of one holding at the close of a day
+type ValuationPosition struct {
+	Ticker string  `json:"ticker"`
+	Shares float64 `json:"shares"`
+	Price  float64 `json:"price"`
+	Value  float64 `json:"value"`
+}
+
+// Valuation is the value of a portfolio at the close of a trading day, in IQD
+type Valuation struct {
+	Date             time.Time           `json:"date"`
+	Cash             float64             `json:"cash"` // Every currency, converted at the rate of the day
+	MarketValue      float64             `json:"market_value"`
+	TotalValue       float64             `json:"total_value"`
+	NetContributions float64             `json:"net_contributions"` // Deposits and transfers in less withdrawals and transfers out
+	CumulativePnL    float64             `json:"cumulative_pnl"`    // Total value less net contributions
+	Positions        []ValuationPosition `json:"positions"`
+}
+
+// ValuationsResponse is the valuation history of a portfolio
+type ValuationsResponse struct {
+	PortfolioID int         `json:"portfolio_id"`
+	Interval    string      `json:"interval"`
+	Currency    string      `json:"currency"`
+	Valuations  []Valuation `json:"valuations"`
+}
+
+// ValuationRebuildResult reports a rebuilt valuation history
+type ValuationRebuildResult struct {
+	PortfolioID int       `json:"portfolio_id"`
+	Days        int       `json:"days"`
+	RebuiltAt   time.Time `json:"rebuilt_at"`
+}
+
+// datedValue is a close price or exchange rate effective from a date
+type datedValue struct {
+	Date  time.Time
+	Value float64
+}
+
+// priceHistory holds dated values by ticker or currency, oldest first
+type priceHistory map[string][]datedValue
+
+func (h priceHistory) add(key string, date time.Time, value float64) {
+	h[key] = append(h[key], datedValue{Date: date, Value: value})
+}
+
+// on returns the latest value on or before a day
+func (h priceHistory) on(key string, day time.Time) (float64, bool) {
+	values := h[key]
+	i := sort.Search(len(values), func(i int) bool { return values[i].Date.After(day) })
+	if i == 0 {
+		return 0, false
+	}
+	return values[i-1].Value, true
+}
+
+// toLedgerCurrency converts an amount to IQD at the rate of a day. rates
+// holds the IQD value of one unit of each currency.
+func toLedgerCurrency(amount float64, currency string, day time.Time, rates priceHistory) (float64, error) {
+	if currency == "" || currency == LedgerCurrency || amount == 0 {
+		return amount, nil
+	}
+	rate, ok := rates.on(currency, day)
+	if !ok {
+		return 0, fmt.Errorf("%w: no %s to %s exchange rate on or before %s",
+			ErrInvalidTransaction, currency, LedgerCurrency, day.Format("2006-01-02"))
+	}
+	return amount * rate, nil
+}
+
+// externalFlow returns the money or shares a transaction brings into the
+// portfolio (positive) or takes out of it (negative), in its own currency
+func externalFlow(t *Transaction) float64 {
+	switch t.Type {
+	case Deposit, TransferIn:
+		return t.Amount
+	case Withdraw, TransferOut:
+		return -t.Amount
+	}
+	return 0
+}
+
+// utcDay returns the UTC date of a time
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// valueLedger replays txns (already in ledger order) and values the portfolio
+// at the close of each of days, which must be ascending. A ticker without a
+// close on or before a day is valued at its last trade price.
+func valueLedger(txns []Transaction, lotIDs map[int]int, method CostBasisMethod, days []time.Time, closes, rates priceHistory) ([]Valuation, error) {
+	st := newLedgerState(lotIDs, method)
+	valuations := make([]Valuation, 0, len(days))
+	var contributions float64
+	next := 0
+	for _, day := range days {
+		end := day.AddDate(0, 0, 1)
+		for ; next < len(txns) && txns[next].TransactionAt.Before(end); next++ {
+			t := &txns[next]
+			if err := st.apply(t); err != nil {
+				return nil, err
+			}
+			flow, err := toLedgerCurrency(externalFlow(t), t.currency(), t.TransactionAt, rates)
+			if err != nil {
+				return nil, err
+			}
+			contributions += flow
+		}
+
+		v := Valuation{Date: day, NetContributions: contributions, Positions: []ValuationPosition{}}
+		for currency, balance := range st.cashBalances() {
+			cash, err := toLedgerCurrency(balance, currency, day, rates)
+			if err != nil {
+				return nil, err
+			}
+			v.Cash += cash
+		}
+		for _, ticker := range st.Tickers {
+			pos := st.Positions[ticker]
+			if pos.Shares <= ledgerEpsilon {
+				continue
+			}
+			price, ok := closes.on(ticker, day)
+			if !ok {
+				price = pos.LastPrice
+			}
+			value := pos.Shares * price
+			v.Positions = append(v.Positions, ValuationPosition{Ticker: ticker, Shares: pos.Shares, Price: price, Value: value})
+			v.MarketValue += value
+		}
+		v.TotalValue = v.Cash + v.MarketValue
+		v.CumulativePnL = v.TotalValue - v.NetContributions
+		valuations = append(valuations, v)
+	}
+	return valuations, nil
+}
+
+// tradingDays returns the days with closing prices from start up to today
+func (s *Server) tradingDays(start time.Time, tx *sql.Tx) ([]time.Time, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT date
+		FROM daily_stock_prices
+		WHERE date >= $1 AND date <= CURRENT_DATE
+		ORDER BY date`, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trading days: %v", err)
+	}
+	defer rows.Close()
+
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return nil, fmt.Errorf("failed to load trading days: %v", err)
+		}
+		days = append(days, utcDay(day))
+	}
+	return days, rows.Err()
+}
+
+// loadCloses returns the closing price history of the given tickers
+func (s *Server) loadCloses(tickers []string, tx *sql.Tx) (priceHistory, error) {
+	rows, err := tx.Query(`
+		SELECT ticker, date, close_price
+		FROM daily_stock_prices
+		WHERE ticker = ANY($1) AND close_price > 0
+		ORDER BY ticker, date`, pq.Array(tickers))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load close prices: %v", err)
+	}
+	defer rows.Close()
+
+	closes := make(priceHistory)
+	for rows.Next() {
+		var ticker string
+		var date time.Time
+		var price float64
+		if err := rows.Scan(&ticker, &date, &price); err != nil {
+			return nil, fmt.Errorf("failed to load close prices: %v", err)
+		}
+		closes.add(ticker, utcDay(date), price)
+	}
+	return closes, rows.Err()
+}
+
+// loadLedgerRates returns the IQD value of one unit of each currency by date.
+// Like fx_rate, a direct quote is preferred over the inverse of the same day.
+func (s *Server) loadLedgerRates(tx *sql.Tx) (priceHistory, error) {
+	rows, err := tx.Query(`
+		SELECT
+			CASE WHEN quote_currency = $1 THEN base_currency ELSE quote_currency END,
+			rate_date,
+			CASE WHEN quote_currency = $1 THEN rate ELSE 1 / rate END
+		FROM fx_rates
+		WHERE base_currency = $1 OR quote_currency = $1
+		ORDER BY rate_date, quote_currency = $1`, LedgerCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load exchange rates: %v", err)
+	}
+	defer rows.Close()
+
+	rates := make(priceHistory)
+	for rows.Next() {
+		var currency string
+		var date time.Time
+		var rate float64
+		if err := rows.Scan(&currency, &date, &rate); err != nil {
+			return nil, fmt.Errorf("failed to load exchange rates: %v", err)
+		}
+		rates.add(currency, utcDay(date), rate)
+	}
+	return rates, rows.Err()
+}
+
+// updateValuations recomputes the valuation history of a portfolio up to the
+// latest close, starting from the last stored day, or from its first
+// transaction if rebuild is set or nothing is stored. It returns the number
+// of days written.
+func (s *Server) updateValuations(portfolioID int, rebuild bool, tx *sql.Tx) (int, error) {
+	txns, err := s.loadLedger(portfolioID, tx)
+	if err != nil {
+		return 0, err
+	}
+	if rebuild || len(txns) == 0 {
+		if _, err := tx.Exec(`DELETE FROM portfolio_valuations WHERE portfolio_id = $1`, portfolioID); err != nil {
+			return 0, fmt.Errorf("failed to clear valuations: %v", err)
+		}
+	}
+	if len(txns) == 0 {
+		return 0, nil
+	}
+
+	start := utcDay(txns[0].TransactionAt)
+	if !rebuild {
+		var last sql.NullTime
+		err := tx.QueryRow(`SELECT MAX(valuation_date) FROM portfolio_valuations WHERE portfolio_id = $1`,
+			portfolioID).Scan(&last)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get last valuation: %v", err)
+		}
+		// The last day is recomputed in case its closes were updated since
+		if last.Valid && utcDay(last.Time).After(start) {
+			start = utcDay(last.Time)
+		}
+	}
+
+	days, err := s.tradingDays(start, tx)
+	if err != nil {
+		return 0, err
+	}
+	if len(days) == 0 {
+		return 0, nil
+	}
+
+	lotIDs, err := s.loadLotIDs(portfolioID, tx)
+	if err != nil {
+		return 0, err
+	}
+	method, err := s.getCostBasisMethod(portfolioID, tx)
+	if err != nil {
+		return 0, err
+	}
+	var tickers []string
+	for _, t := range txns {
+		if t.Ticker != "" && !containsString(tickers, t.Ticker) {
+			tickers = append(tickers, t.Ticker)
+		}
+	}
+	closes, err := s.loadCloses(tickers, tx)
+	if err != nil {
+		return 0, err
+	}
+	rates, err := s.loadLedgerRates(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	valuations, err := valueLedger(txns, lotIDs, method, days, closes, rates)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO portfolio_valuations (
+			portfolio_id, valuation_date, cash, market_value, total_value,
+			net_contributions, cumulative_pnl, positions
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (portfolio_id, valuation_date) DO UPDATE SET
+			cash = EXCLUDED.cash,
+			market_value = EXCLUDED.market_value,
+			total_value = EXCLUDED.total_value,
+			net_contributions = EXCLUDED.net_contributions,
+			cumulative_pnl = EXCLUDED.cumulative_pnl,
+			positions = EXCLUDED.positions,
+			updated_at = CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare valuation insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, v := range valuations {
+		positions, err := json.Marshal(v.Positions)
+		if err != nil {
+			return 0, err
+		}
+		_, err = stmt.Exec(portfolioID, v.Date, v.Cash, v.MarketValue, v.TotalValue,
+			v.NetContributions, v.CumulativePnL, string(positions))
+		if err != nil {
+			return 0, fmt.Errorf("failed to save valuation of %s: %v", v.Date.Format("2006-01-02"), err)
+		}
+	}
+	return len(valuations), nil
+}
+
+// updateAllValuations extends the valuation history of every portfolio after
+// a scrape. Each portfolio has its own transaction, so one that cannot be
+// valued does not hold back the others.
+func (s *Server) updateAllValuations() error {
+	rows, err := s.db.Query(`SELECT id FROM portfolios ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to list portfolios: %v", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to list portfolios: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	written := 0
+	for _, id := range ids {
+		days, err := s.updatePortfolioValuations(id)
+		if err != nil {
+			s.logger.Error("Failed to update valuations of portfolio %d: %v", id, err)
+			continue
+		}
+		written += days
+	}
+
+	s.logger.Info("Updated %d valuations in %d portfolios", written, len(ids))
+	return nil
+}
+
+func (s *Server) updatePortfolioValuations(portfolioID int) (int, error) {
+	tx, err := s.beginTaggedTx(newRequestID(), valuationsClient)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	days, err := s.updateValuations(portfolioID, false, tx)
+	if err != nil {
+		return 0, err
+	}
+	return days, tx.Commit()
+}
+
+// GetValuations returns the valuation history of a portfolio between from and
+// to (inclusive dates). With a weekly or monthly interval only the last
+// trading day of each week or month is returned.
+func (s *Server) GetValuations(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	query := r.URL.Query()
+	response := ValuationsResponse{
+		PortfolioID: portfolioID,
+		Interval:    IntervalDaily,
+		Currency:    LedgerCurrency,
+		Valuations:  []Valuation{},
+	}
+	if raw := query.Get("interval"); raw != "" {
+		response.Interval = raw
+	}
+	var period string
+	switch response.Interval {
+	case IntervalDaily:
+		period = "day"
+	case IntervalWeekly:
+		period = "week"
+	case IntervalMonthly:
+		period = "month"
+	default:
+		s.respondWithError(w, http.StatusBadRequest, "Invalid interval, must be daily, weekly or monthly")
+		return
+	}
+
+	conditions := "portfolio_id = $1"
+	args := []interface{}{portfolioID, period}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<="}} {
+		raw := query.Get(bound.param)
+		if raw == "" {
+			continue
+		}
+		date, err := parseQueryTime(raw)
+		if err != nil {
+			s.respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s date", bound.param))
+			return
+		}
+		args = append(args, utcDay(date))
+		conditions += fmt.Sprintf(" AND valuation_date %s $%d", bound.op, len(args))
+	}
+
+	var exists bool
+	err = s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT valuation_date, cash, market_value, total_value,
+			net_contributions, cumulative_pnl, positions
+		FROM (
+			SELECT DISTINCT ON (date_trunc($2, valuation_date)) *
+			FROM portfolio_valuations
+			WHERE `+conditions+`
+			ORDER BY date_trunc($2, valuation_date), valuation_date DESC
+		) v
+		ORDER BY valuation_date`, args...)
+	if err != nil {
+		s.logger.Error("Failed to fetch valuations: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch valuations")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v Valuation
+		var positions []byte
+		err := rows.Scan(&v.Date, &v.Cash, &v.MarketValue, &v.TotalValue,
+			&v.NetContributions, &v.CumulativePnL, &positions)
+		if err == nil {
+			err = json.Unmarshal(positions, &v.Positions)
+		}
+		if err != nil {
+			s.logger.Error("Error scanning valuation: %v", err)
+			s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch valuations")
+			return
+		}
+		response.Valuations = append(response.Valuations, v)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to fetch valuations: %v", err)
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to fetch valuations")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, response)
+}
+
+// RebuildValuations recomputes the whole valuation history of a portfolio
+func (s *Server) RebuildValuations(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid portfolio ID")
+		return
+	}
+
+	tx, err := s.beginTx(r)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM portfolios WHERE id = $1)`, portfolioID).Scan(&exists)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check portfolio: %v", err))
+		return
+	}
+	if !exists {
+		s.respondWithError(w, http.StatusNotFound, "Portfolio not found")
+		return
+	}
+
+	days, err := s.updateValuations(portfolioID, true, tx)
+	if err != nil {
+		s.respondWithLedgerError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, ValuationRebuildResult{PortfolioID: portfolioID, Days: days, RebuiltAt: time.Now()})
+}
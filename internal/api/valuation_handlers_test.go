@@ -0,0 +1,55 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueLedger(t *testing.T) {
+	valuationDay := func(day int) time.Time {
+		return time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+	ledger := func() []Transaction {
+		return []Transaction{
+			{ID: 1, Type: Deposit, Amount: 10000, TransactionAt: ledgerDay(1)},
+			{ID: 2, Type: Buy, Ticker: "BBOB", Shares: 1000, Price: 2, Fee: 10, TransactionAt: ledgerDay(2)},
+			{ID: 3, Type: Deposit, Amount: 100, Currency: "USD", TransactionAt: ledgerDay(3)},
+			{ID: 4, Type: Withdraw, Amount: 1000, TransactionAt: ledgerDay(4)},
+		}
+	}
+	closes := make(priceHistory)
+	closes.add("BBOB", valuationDay(1), 1.5)
+	closes.add("BBOB", valuationDay(3), 2.5)
+	rates := make(priceHistory)
+	rates.add("USD", valuationDay(1), 1300)
+	days := []time.Time{valuationDay(2), valuationDay(3), valuationDay(4)}
+
+	valuations, err := valueLedger(ledger(), nil, CostBasisFIFO, days, closes, rates)
+	assert.NoError(t, err)
+	assert.Len(t, valuations, 3)
+
+	// The first day includes the deposit of the day before
+	first := valuations[0]
+	assert.InDelta(t, 7990, first.Cash, 0.001)
+	assert.InDelta(t, 1500, first.MarketValue, 0.001)
+	assert.InDelta(t, 10000, first.NetContributions, 0.001)
+	assert.InDelta(t, -510, first.CumulativePnL, 0.001)
+	assert.Equal(t, []ValuationPosition{{Ticker: "BBOB", Shares: 1000, Price: 1.5, Value: 1500}}, first.Positions)
+
+	// Foreign cash and contributions are converted to IQD
+	assert.InDelta(t, 137990, valuations[1].Cash, 0.001)
+	assert.InDelta(t, 140000, valuations[1].NetContributions, 0.001)
+	assert.InDelta(t, 490, valuations[1].CumulativePnL, 0.001)
+
+	// The last close carries over to a day without one
+	last := valuations[2]
+	assert.InDelta(t, 2500, last.MarketValue, 0.001)
+	assert.InDelta(t, 139490, last.TotalValue, 0.001)
+	assert.InDelta(t, 139000, last.NetContributions, 0.001)
+
+	_, err = valueLedger(ledger(), nil, CostBasisFIFO, days, closes, make(priceHistory))
+	assert.True(t, errors.Is(err, ErrInvalidTransaction), "a missing exchange rate is reported")
+}
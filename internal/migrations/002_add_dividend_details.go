@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddDividendDetails adds the columns needed to record cash dividends:
+// the withholding tax deducted at source and the ex-dividend date used to
+// determine entitlement. The per-share rate is stored in the price column.
+func AddDividendDetails(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS withholding_tax numeric(15,2) NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS ex_date date
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add dividend columns: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD CONSTRAINT non_negative_withholding_tax CHECK (withholding_tax >= 0)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add withholding tax constraint: %v", err)
+	}
+
+	return tx.Commit()
+}
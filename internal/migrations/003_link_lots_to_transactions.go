@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// LinkLotsToTransactions ties every FIFO lot to the BUY transaction that
+// created it so a ledger replay can rebuild lots while keeping their IDs stable.
+func LinkLotsToTransactions(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_stock_lots
+		ADD COLUMN IF NOT EXISTS transaction_id integer
+			REFERENCES portfolio_transactions (id) ON DELETE CASCADE
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add transaction_id to lots: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolio_stock_lots_transaction
+		ON portfolio_stock_lots (transaction_id)
+		WHERE transaction_id IS NOT NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create lot transaction index: %v", err)
+	}
+
+	return tx.Commit()
+}
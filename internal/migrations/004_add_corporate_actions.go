@@ -0,0 +1,69 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddCorporateActions creates the corporate_actions table and the SPLIT
+// transaction type used to record bonus shares, splits and reverse splits
+// in each affected portfolio's ledger.
+func AddCorporateActions(db *sql.DB) error {
+	// New enum values must be committed before they can be used
+	_, err := db.Exec(`ALTER TYPE transaction_type ADD VALUE IF NOT EXISTS 'SPLIT'`)
+	if err != nil {
+		return fmt.Errorf("failed to add SPLIT transaction type: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS corporate_actions (
+			id SERIAL PRIMARY KEY,
+			ticker VARCHAR(10) NOT NULL REFERENCES tickers (ticker),
+			action_type VARCHAR(20) NOT NULL
+				CHECK (action_type IN ('BONUS', 'SPLIT', 'REVERSE_SPLIT')),
+			ratio_new NUMERIC(15,6) NOT NULL CHECK (ratio_new > 0),
+			ratio_old NUMERIC(15,6) NOT NULL CHECK (ratio_old > 0),
+			effective_date DATE NOT NULL,
+			notes TEXT,
+			applied_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create corporate_actions table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS split_ratio NUMERIC(15,8),
+		ADD COLUMN IF NOT EXISTS corporate_action_id INTEGER REFERENCES corporate_actions (id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add corporate action columns: %v", err)
+	}
+
+	// SPLIT rows move no cash, so they carry a zero amount
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		DROP CONSTRAINT IF EXISTS positive_amount,
+		ADD CONSTRAINT positive_amount CHECK (amount > 0 OR type = 'SPLIT'),
+		DROP CONSTRAINT IF EXISTS valid_stock_transaction,
+		ADD CONSTRAINT valid_stock_transaction CHECK (
+			(type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL)
+			OR (type IN ('DEPOSIT', 'WITHDRAW') AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+			OR (type = 'DIVIDEND' AND ticker IS NOT NULL AND amount IS NOT NULL)
+			OR (type = 'SPLIT' AND ticker IS NOT NULL AND split_ratio > 0)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to update transaction constraints: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,54 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddRightsIssues adds RIGHTS corporate actions with a subscription price and
+// the RIGHTS transaction type recording a portfolio's subscription.
+func AddRightsIssues(db *sql.DB) error {
+	// New enum values must be committed before they can be used
+	_, err := db.Exec(`ALTER TYPE transaction_type ADD VALUE IF NOT EXISTS 'RIGHTS'`)
+	if err != nil {
+		return fmt.Errorf("failed to add RIGHTS transaction type: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE corporate_actions
+		ADD COLUMN IF NOT EXISTS subscription_price NUMERIC(15,6),
+		DROP CONSTRAINT IF EXISTS corporate_actions_action_type_check,
+		ADD CONSTRAINT corporate_actions_action_type_check
+			CHECK (action_type IN ('BONUS', 'SPLIT', 'REVERSE_SPLIT', 'RIGHTS')),
+		ADD CONSTRAINT rights_subscription_price
+			CHECK (action_type <> 'RIGHTS' OR subscription_price > 0)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add rights issue columns: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS entitlement_ratio NUMERIC(15,8),
+		DROP CONSTRAINT IF EXISTS valid_stock_transaction,
+		ADD CONSTRAINT valid_stock_transaction CHECK (
+			(type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL)
+			OR (type IN ('DEPOSIT', 'WITHDRAW') AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+			OR (type = 'DIVIDEND' AND ticker IS NOT NULL AND amount IS NOT NULL)
+			OR (type = 'SPLIT' AND ticker IS NOT NULL AND split_ratio > 0)
+			OR (type = 'RIGHTS' AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL
+				AND ex_date IS NOT NULL AND entitlement_ratio > 0 AND corporate_action_id IS NOT NULL)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to update transaction constraints: %v", err)
+	}
+
+	return tx.Commit()
+}
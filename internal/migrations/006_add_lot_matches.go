@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddLotMatches creates portfolio_lot_matches, which records the lots consumed
+// by every sale. Rows marked specified are the lots chosen by the user and are
+// kept across ledger replays; the others are rebuilt from the FIFO order.
+func AddLotMatches(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_lot_matches (
+			id SERIAL PRIMARY KEY,
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			sale_transaction_id INTEGER NOT NULL REFERENCES portfolio_transactions (id) ON DELETE CASCADE,
+			lot_id INTEGER NOT NULL REFERENCES portfolio_stock_lots (id) ON DELETE CASCADE,
+			shares NUMERIC(15,6) NOT NULL CHECK (shares > 0),
+			purchase_price NUMERIC(15,6),
+			sale_price NUMERIC(15,6),
+			realized_gain NUMERIC(15,2),
+			specified BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_portfolio_lot_matches_sale
+		ON portfolio_lot_matches (sale_transaction_id);
+
+		CREATE INDEX IF NOT EXISTS idx_portfolio_lot_matches_portfolio
+		ON portfolio_lot_matches (portfolio_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_lot_matches table: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddCostBasisMethods adds a cost-basis policy to each portfolio, the realized
+// gain under that policy on each sale, and portfolio_cost_basis, which keeps
+// the cost basis and realized gains of every ticker under each method so they
+// can be compared.
+func AddCostBasisMethods(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolios
+		ADD COLUMN IF NOT EXISTS cost_basis_method VARCHAR(10) NOT NULL DEFAULT 'FIFO'
+			CHECK (cost_basis_method IN ('FIFO', 'LIFO', 'HIFO', 'AVERAGE'))
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add cost_basis_method column: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS realized_gain NUMERIC(15,2);
+
+		-- Existing portfolios default to FIFO
+		UPDATE portfolio_transactions
+		SET realized_gain = realized_gain_fifo
+		WHERE type = 'SELL' AND realized_gain IS NULL;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add realized_gain column: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_cost_basis (
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			ticker VARCHAR(10) NOT NULL,
+			method VARCHAR(10) NOT NULL,
+			shares NUMERIC(19,6) NOT NULL DEFAULT 0,
+			cost_basis NUMERIC(19,6) NOT NULL DEFAULT 0,
+			realized_gain NUMERIC(19,6) NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (portfolio_id, ticker, method)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_cost_basis table: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddFeeSchedules creates broker commission schedules and lets each portfolio
+// use one to compute fees that are not supplied with a transaction.
+func AddFeeSchedules(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS fee_schedules (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL UNIQUE,
+			commission_percent NUMERIC(9,6) NOT NULL DEFAULT 0,
+			minimum_commission NUMERIC(15,2) NOT NULL DEFAULT 0,
+			exchange_levy NUMERIC(15,2) NOT NULL DEFAULT 0,
+			clearing_levy NUMERIC(15,2) NOT NULL DEFAULT 0,
+			deposit_fee_percent NUMERIC(9,6) NOT NULL DEFAULT 0,
+			deposit_fee_fixed NUMERIC(15,2) NOT NULL DEFAULT 0,
+			withdraw_fee_percent NUMERIC(9,6) NOT NULL DEFAULT 0,
+			withdraw_fee_fixed NUMERIC(15,2) NOT NULL DEFAULT 0,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT non_negative_fee_schedule CHECK (
+				commission_percent >= 0 AND minimum_commission >= 0
+				AND exchange_levy >= 0 AND clearing_levy >= 0
+				AND deposit_fee_percent >= 0 AND deposit_fee_fixed >= 0
+				AND withdraw_fee_percent >= 0 AND withdraw_fee_fixed >= 0
+			)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create fee_schedules table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolios
+		ADD COLUMN IF NOT EXISTS fee_schedule_id INTEGER REFERENCES fee_schedules (id) ON DELETE SET NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add fee_schedule_id column: %v", err)
+	}
+
+	return tx.Commit()
+}
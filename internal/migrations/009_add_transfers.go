@@ -0,0 +1,76 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddTransfers creates portfolio_transfers and the TRANSFER_OUT and
+// TRANSFER_IN transaction types. A transfer is recorded as linked
+// transactions in both portfolios; shares moved in kind keep the purchase
+// date of their original lot in acquired_at.
+func AddTransfers(db *sql.DB) error {
+	// New enum values must be committed before they can be used
+	for _, value := range []string{"TRANSFER_IN", "TRANSFER_OUT"} {
+		_, err := db.Exec(fmt.Sprintf(`ALTER TYPE transaction_type ADD VALUE IF NOT EXISTS '%s'`, value))
+		if err != nil {
+			return fmt.Errorf("failed to add %s transaction type: %v", value, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A deleted portfolio leaves the other side's leg as a plain external flow
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_transfers (
+			id SERIAL PRIMARY KEY,
+			from_portfolio_id INTEGER REFERENCES portfolios (id) ON DELETE SET NULL,
+			to_portfolio_id INTEGER REFERENCES portfolios (id) ON DELETE SET NULL,
+			ticker VARCHAR(10) REFERENCES tickers (ticker),
+			shares NUMERIC(15,6),
+			amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+			notes TEXT,
+			transfer_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT transfer_shares CHECK ((ticker IS NULL) = (shares IS NULL) AND (shares IS NULL OR shares > 0))
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_transfers table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS transfer_id INTEGER REFERENCES portfolio_transfers (id) ON DELETE CASCADE,
+		ADD COLUMN IF NOT EXISTS acquired_at TIMESTAMP WITH TIME ZONE,
+		DROP CONSTRAINT IF EXISTS valid_stock_transaction,
+		ADD CONSTRAINT valid_stock_transaction CHECK (
+			(type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL)
+			OR (type IN ('DEPOSIT', 'WITHDRAW') AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+			OR (type = 'DIVIDEND' AND ticker IS NOT NULL AND amount IS NOT NULL)
+			OR (type = 'SPLIT' AND ticker IS NOT NULL AND split_ratio > 0)
+			OR (type = 'RIGHTS' AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL
+				AND ex_date IS NOT NULL AND entitlement_ratio > 0 AND corporate_action_id IS NOT NULL)
+			OR (type IN ('TRANSFER_IN', 'TRANSFER_OUT') AND transfer_id IS NOT NULL
+				AND (ticker IS NULL) = (shares IS NULL) AND (ticker IS NULL) = (price IS NULL))
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add transfer columns: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_portfolio_transactions_transfer
+		ON portfolio_transactions (transfer_id)
+		WHERE transfer_id IS NOT NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create transfer index: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddIdempotencyKeys stores the Idempotency-Key a transaction was created
+// with, and a hash of the request, so that a retried request returns the
+// original transaction instead of recording it twice.
+func AddIdempotencyKeys(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS request_hash CHAR(64)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add idempotency columns: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolio_transactions_idempotency_key
+		ON portfolio_transactions (portfolio_id, idempotency_key)
+		WHERE idempotency_key IS NOT NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency key index: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,116 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddAuditLog creates the append-only audit_log and the triggers that record
+// every insert, update and delete on portfolios, transactions, lots and
+// holdings. The triggers run in the transaction making the change and pick up
+// the request ID and client set on it with set_config('app.request_id') and
+// set_config('app.client'). Updates that change nothing but updated_at, like
+// most rows rewritten by a ledger replay, are not recorded.
+func AddAuditLog(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			table_name VARCHAR(63) NOT NULL,
+			operation VARCHAR(6) NOT NULL CHECK (operation IN ('INSERT', 'UPDATE', 'DELETE')),
+			row_id BIGINT,
+			portfolio_id INTEGER,
+			before JSONB,
+			after JSONB,
+			changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+			request_id VARCHAR(100),
+			client TEXT,
+			db_user TEXT NOT NULL DEFAULT current_user
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_portfolio ON audit_log (portfolio_id, id);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_row ON audit_log (table_name, row_id);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_request ON audit_log (request_id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit_log table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE OR REPLACE FUNCTION audit_row_change() RETURNS trigger AS $$
+		DECLARE
+			before_row JSONB;
+			after_row JSONB;
+			changed JSONB;
+		BEGIN
+			IF TG_OP <> 'INSERT' THEN
+				before_row := to_jsonb(OLD);
+			END IF;
+			IF TG_OP <> 'DELETE' THEN
+				after_row := to_jsonb(NEW);
+			END IF;
+			IF TG_OP = 'UPDATE' AND (before_row - 'updated_at') = (after_row - 'updated_at') THEN
+				RETURN NULL;
+			END IF;
+
+			changed := COALESCE(after_row, before_row);
+			INSERT INTO audit_log (
+				table_name, operation, row_id, portfolio_id,
+				before, after, request_id, client
+			) VALUES (
+				TG_TABLE_NAME, TG_OP, (changed->>'id')::BIGINT,
+				CASE WHEN TG_TABLE_NAME = 'portfolios'
+					THEN (changed->>'id')::INTEGER
+					ELSE (changed->>'portfolio_id')::INTEGER
+				END,
+				before_row, after_row,
+				NULLIF(current_setting('app.request_id', true), ''),
+				NULLIF(current_setting('app.client', true), '')
+			);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit trigger function: %v", err)
+	}
+
+	for _, table := range []string{"portfolios", "portfolio_transactions", "portfolio_stock_lots", "portfolio_holdings"} {
+		_, err = tx.Exec(fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS audit_%[1]s ON %[1]s;
+			CREATE TRIGGER audit_%[1]s
+				AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+				FOR EACH ROW EXECUTE FUNCTION audit_row_change()
+		`, table))
+		if err != nil {
+			return fmt.Errorf("failed to create audit trigger on %s: %v", table, err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+		CREATE TRIGGER audit_log_append_only
+			BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+		DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+		CREATE TRIGGER audit_log_no_truncate
+			BEFORE TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to protect audit_log: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,145 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddCurrencies gives cash a currency. Securities trade and settle in IQD,
+// but deposits, withdrawals and cash transfers can be in any currency, and the
+// FX transaction type converts cash from one currency to another. Cash held in
+// each currency is kept in portfolio_cash_balances; the CASH holding remains
+// the IQD balance. fx_rates holds the daily exchange rate history used to
+// report in another base currency.
+func AddCurrencies(db *sql.DB) error {
+	// New enum values must be committed before they can be used
+	_, err := db.Exec(`ALTER TYPE transaction_type ADD VALUE IF NOT EXISTS 'FX'`)
+	if err != nil {
+		return fmt.Errorf("failed to add FX transaction type: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// rate is the number of quote_currency units per base_currency unit
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS fx_rates (
+			id SERIAL PRIMARY KEY,
+			base_currency CHAR(3) NOT NULL,
+			quote_currency CHAR(3) NOT NULL,
+			rate_date DATE NOT NULL,
+			rate NUMERIC(18,8) NOT NULL CHECK (rate > 0),
+			source VARCHAR(20) NOT NULL DEFAULT 'manual',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (base_currency, quote_currency, rate_date),
+			CHECK (base_currency <> quote_currency)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create fx_rates table: %v", err)
+	}
+
+	// fx_rate returns the latest rate on or before a date, in either direction
+	_, err = tx.Exec(`
+		CREATE OR REPLACE FUNCTION fx_rate(from_currency TEXT, to_currency TEXT, on_date TIMESTAMP WITH TIME ZONE)
+		RETURNS NUMERIC AS $$
+		DECLARE
+			result NUMERIC;
+		BEGIN
+			IF from_currency = to_currency THEN
+				RETURN 1;
+			END IF;
+
+			SELECT CASE WHEN base_currency = from_currency THEN rate ELSE 1 / rate END
+			INTO result
+			FROM fx_rates
+			WHERE rate_date <= on_date::date
+				AND ((base_currency = from_currency AND quote_currency = to_currency)
+					OR (base_currency = to_currency AND quote_currency = from_currency))
+			ORDER BY rate_date DESC, base_currency = from_currency DESC
+			LIMIT 1;
+
+			IF result IS NULL THEN
+				RAISE EXCEPTION 'no % to % exchange rate on or before %',
+					from_currency, to_currency, on_date::date
+					USING ERRCODE = 'no_data_found';
+			END IF;
+			RETURN result;
+		END;
+		$$ LANGUAGE plpgsql STABLE
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create fx_rate function: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'IQD',
+		ADD COLUMN IF NOT EXISTS to_currency CHAR(3),
+		ADD COLUMN IF NOT EXISTS to_amount NUMERIC(15,2),
+		ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(18,8),
+		DROP CONSTRAINT IF EXISTS valid_stock_transaction,
+		ADD CONSTRAINT valid_stock_transaction CHECK (
+			(type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL)
+			OR (type IN ('DEPOSIT', 'WITHDRAW') AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+			OR (type = 'DIVIDEND' AND ticker IS NOT NULL AND amount IS NOT NULL)
+			OR (type = 'SPLIT' AND ticker IS NOT NULL AND split_ratio > 0)
+			OR (type = 'RIGHTS' AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL
+				AND ex_date IS NOT NULL AND entitlement_ratio > 0 AND corporate_action_id IS NOT NULL)
+			OR (type IN ('TRANSFER_IN', 'TRANSFER_OUT') AND transfer_id IS NOT NULL
+				AND (ticker IS NULL) = (shares IS NULL) AND (ticker IS NULL) = (price IS NULL))
+			OR (type = 'FX' AND ticker IS NULL AND shares IS NULL AND price IS NULL
+				AND to_currency IS NOT NULL AND to_currency <> currency
+				AND to_amount > 0 AND exchange_rate > 0)
+		),
+		DROP CONSTRAINT IF EXISTS security_currency,
+		ADD CONSTRAINT security_currency CHECK (ticker IS NULL OR currency = 'IQD')
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add currency columns: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transfers
+		ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'IQD'
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add transfer currency: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_cash_balances (
+			id SERIAL PRIMARY KEY,
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			currency CHAR(3) NOT NULL,
+			balance NUMERIC(15,2) NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (portfolio_id, currency)
+		);
+
+		INSERT INTO portfolio_cash_balances (portfolio_id, currency, balance)
+		SELECT portfolio_id, 'IQD', shares
+		FROM portfolio_holdings
+		WHERE ticker = 'CASH'
+		ON CONFLICT (portfolio_id, currency) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_cash_balances table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		DROP TRIGGER IF EXISTS audit_portfolio_cash_balances ON portfolio_cash_balances;
+		CREATE TRIGGER audit_portfolio_cash_balances
+			AFTER INSERT OR UPDATE OR DELETE ON portfolio_cash_balances
+			FOR EACH ROW EXECUTE FUNCTION audit_row_change()
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit trigger on portfolio_cash_balances: %v", err)
+	}
+
+	return tx.Commit()
+}
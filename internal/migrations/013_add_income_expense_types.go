@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddIncomeExpenseTypes adds the INTEREST, FEE and TAX transaction types for
+// interest credited, account charges and taxes paid, which were previously
+// booked as deposits and withdrawals. They carry no shares or price; FEE and
+// TAX may name the security they relate to.
+func AddIncomeExpenseTypes(db *sql.DB) error {
+	// New enum values must be committed before they can be used
+	for _, value := range []string{"INTEREST", "FEE", "TAX"} {
+		_, err := db.Exec(fmt.Sprintf(`ALTER TYPE transaction_type ADD VALUE IF NOT EXISTS '%s'`, value))
+		if err != nil {
+			return fmt.Errorf("failed to add %s transaction type: %v", value, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		ALTER TABLE portfolio_transactions
+		DROP CONSTRAINT IF EXISTS valid_stock_transaction,
+		ADD CONSTRAINT valid_stock_transaction CHECK (
+			(type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL)
+			OR (type IN ('DEPOSIT', 'WITHDRAW') AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+			OR (type = 'DIVIDEND' AND ticker IS NOT NULL AND amount IS NOT NULL)
+			OR (type = 'SPLIT' AND ticker IS NOT NULL AND split_ratio > 0)
+			OR (type = 'RIGHTS' AND ticker IS NOT NULL AND shares IS NOT NULL AND price IS NOT NULL
+				AND ex_date IS NOT NULL AND entitlement_ratio > 0 AND corporate_action_id IS NOT NULL)
+			OR (type IN ('TRANSFER_IN', 'TRANSFER_OUT') AND transfer_id IS NOT NULL
+				AND (ticker IS NULL) = (shares IS NULL) AND (ticker IS NULL) = (price IS NULL))
+			OR (type = 'FX' AND ticker IS NULL AND shares IS NULL AND price IS NULL
+				AND to_currency IS NOT NULL AND to_currency <> currency
+				AND to_amount > 0 AND exchange_rate > 0)
+			OR (type = 'INTEREST' AND ticker IS NULL AND shares IS NULL AND price IS NULL AND amount > 0)
+			OR (type IN ('FEE', 'TAX') AND shares IS NULL AND price IS NULL AND amount > 0)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to update transaction constraint: %v", err)
+	}
+
+	return tx.Commit()
+}
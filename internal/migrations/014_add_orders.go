@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddOrders creates portfolio_orders, the limit orders placed with a broker
+// that have not filled yet. Orders are checked against the daily high and
+// low after every price scrape; a filled order is either recorded as a
+// transaction right away or waits for the user to confirm it.
+func AddOrders(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_orders (
+			id SERIAL PRIMARY KEY,
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			side VARCHAR(4) NOT NULL CHECK (side IN ('BUY', 'SELL')),
+			ticker VARCHAR(10) NOT NULL REFERENCES tickers (ticker),
+			shares NUMERIC(15,6) NOT NULL CHECK (shares > 0),
+			limit_price NUMERIC(15,6) NOT NULL CHECK (limit_price > 0),
+			auto_fill BOOLEAN NOT NULL DEFAULT FALSE,
+			status VARCHAR(10) NOT NULL DEFAULT 'OPEN'
+				CHECK (status IN ('OPEN', 'TRIGGERED', 'FILLED', 'CANCELLED', 'EXPIRED')),
+			placed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE,
+			fill_date DATE,
+			fill_price NUMERIC(15,6),
+			transaction_id INTEGER REFERENCES portfolio_transactions (id) ON DELETE SET NULL,
+			status_message TEXT,
+			notes TEXT,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT order_fill CHECK ((status IN ('OPEN', 'CANCELLED', 'EXPIRED')) OR fill_price > 0)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_portfolio_orders_open
+		ON portfolio_orders (ticker) WHERE status = 'OPEN';
+
+		CREATE INDEX IF NOT EXISTS idx_portfolio_orders_portfolio
+		ON portfolio_orders (portfolio_id, status);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_orders table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		DROP TRIGGER IF EXISTS audit_portfolio_orders ON portfolio_orders;
+		CREATE TRIGGER audit_portfolio_orders
+			AFTER INSERT OR UPDATE OR DELETE ON portfolio_orders
+			FOR EACH ROW EXECUTE FUNCTION audit_row_change()
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit trigger on portfolio_orders: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddPlans creates recurring contribution plans and draft transactions. On
+// each due date a plan drafts a deposit and purchases of its basket; drafts
+// only enter the ledger once the user confirms them.
+func AddPlans(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// occurrences counts the due dates drafted so far; the next one is
+	// derived from start_date so month-end dates do not drift
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_plans (
+			id SERIAL PRIMARY KEY,
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			frequency VARCHAR(10) NOT NULL CHECK (frequency IN ('WEEKLY', 'MONTHLY', 'QUARTERLY')),
+			start_date DATE NOT NULL,
+			end_date DATE,
+			amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+			deposit BOOLEAN NOT NULL DEFAULT TRUE,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			occurrences INTEGER NOT NULL DEFAULT 0,
+			next_due_date DATE,
+			notes TEXT,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS portfolio_plan_allocations (
+			id SERIAL PRIMARY KEY,
+			plan_id INTEGER NOT NULL REFERENCES portfolio_plans (id) ON DELETE CASCADE,
+			ticker VARCHAR(10) NOT NULL REFERENCES tickers (ticker),
+			weight NUMERIC(9,4) NOT NULL CHECK (weight > 0),
+			UNIQUE (plan_id, ticker)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create plan tables: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_draft_transactions (
+			id SERIAL PRIMARY KEY,
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			plan_id INTEGER REFERENCES portfolio_plans (id) ON DELETE SET NULL,
+			type transaction_type NOT NULL CHECK (type IN ('DEPOSIT', 'BUY', 'SELL')),
+			ticker VARCHAR(10) REFERENCES tickers (ticker),
+			shares NUMERIC(15,6),
+			price NUMERIC(15,6),
+			amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+			transaction_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			status VARCHAR(10) NOT NULL DEFAULT 'PENDING'
+				CHECK (status IN ('PENDING', 'CONFIRMED', 'DISMISSED')),
+			transaction_id INTEGER REFERENCES portfolio_transactions (id) ON DELETE SET NULL,
+			notes TEXT,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT draft_trade CHECK (
+				(type = 'DEPOSIT' AND ticker IS NULL AND shares IS NULL AND price IS NULL)
+				OR (type IN ('BUY', 'SELL') AND ticker IS NOT NULL AND shares > 0 AND price > 0)
+			)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_portfolio_draft_transactions_pending
+		ON portfolio_draft_transactions (portfolio_id) WHERE status = 'PENDING';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_draft_transactions table: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddValuations creates the daily valuation history of each portfolio. Rows
+// are computed from the ledger and the closing prices by the server; a
+// change to a transaction discards the rows from its date onwards so they
+// are recomputed after the next scrape.
+func AddValuations(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Amounts are in IQD; positions holds the shares, close and value of each ticker
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS portfolio_valuations (
+			portfolio_id INTEGER NOT NULL REFERENCES portfolios (id) ON DELETE CASCADE,
+			valuation_date DATE NOT NULL,
+			cash NUMERIC(18,2) NOT NULL,
+			market_value NUMERIC(18,2) NOT NULL,
+			total_value NUMERIC(18,2) NOT NULL,
+			net_contributions NUMERIC(18,2) NOT NULL,
+			cumulative_pnl NUMERIC(18,2) NOT NULL,
+			positions JSONB NOT NULL DEFAULT '[]',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (portfolio_id, valuation_date)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create portfolio_valuations table: %v", err)
+	}
+
+	// Replaying the ledger rewrites every transaction, so only real changes count
+	_, err = tx.Exec(`
+		CREATE OR REPLACE FUNCTION invalidate_valuations() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP = 'UPDATE' AND to_jsonb(OLD) = to_jsonb(NEW) THEN
+				RETURN NULL;
+			END IF;
+			IF TG_OP <> 'INSERT' THEN
+				DELETE FROM portfolio_valuations
+				WHERE portfolio_id = OLD.portfolio_id
+					AND valuation_date >= (OLD.transaction_at AT TIME ZONE 'UTC')::date;
+			END IF;
+			IF TG_OP <> 'DELETE' THEN
+				DELETE FROM portfolio_valuations
+				WHERE portfolio_id = NEW.portfolio_id
+					AND valuation_date >= (NEW.transaction_at AT TIME ZONE 'UTC')::date;
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS invalidate_valuations ON portfolio_transactions;
+		CREATE TRIGGER invalidate_valuations
+			AFTER INSERT OR UPDATE OR DELETE ON portfolio_transactions
+			FOR EACH ROW EXECUTE FUNCTION invalidate_valuations();
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create valuation trigger: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ExactSplitRatios stores split ratios without a fixed scale. NUMERIC(15,8)
+// truncated ratios such as 4:3, so replayed share counts drifted off whole
+// shares. Existing SPLIT rows are recomputed from their corporate action.
+func ExactSplitRatios(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`ALTER TABLE portfolio_transactions ALTER COLUMN split_ratio TYPE NUMERIC`)
+	if err != nil {
+		return fmt.Errorf("failed to widen split_ratio: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE portfolio_transactions t
+		SET split_ratio = CASE
+			WHEN ca.action_type = 'BONUS' THEN (ca.ratio_old + ca.ratio_new) / ca.ratio_old
+			ELSE ca.ratio_new / ca.ratio_old
+		END
+		FROM corporate_actions ca
+		WHERE t.corporate_action_id = ca.id AND t.type = 'SPLIT'
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to recompute split ratios: %v", err)
+	}
+
+	return tx.Commit()
+}
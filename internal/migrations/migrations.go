@@ -18,6 +18,86 @@ var Migrations = []Migration{
 		Description: "Add FIFO tracking",
 		Func:        AddFIFOTracking,
 	},
+	{
+		Version:     2,
+		Description: "Add dividend details",
+		Func:        AddDividendDetails,
+	},
+	{
+		Version:     3,
+		Description: "Link stock lots to transactions",
+		Func:        LinkLotsToTransactions,
+	},
+	{
+		Version:     4,
+		Description: "Add corporate actions",
+		Func:        AddCorporateActions,
+	},
+	{
+		Version:     5,
+		Description: "Add rights issues",
+		Func:        AddRightsIssues,
+	},
+	{
+		Version:     6,
+		Description: "Add lot matches",
+		Func:        AddLotMatches,
+	},
+	{
+		Version:     7,
+		Description: "Add cost basis methods",
+		Func:        AddCostBasisMethods,
+	},
+	{
+		Version:     8,
+		Description: "Add fee schedules",
+		Func:        AddFeeSchedules,
+	},
+	{
+		Version:     9,
+		Description: "Add portfolio transfers",
+		Func:        AddTransfers,
+	},
+	{
+		Version:     10,
+		Description: "Add idempotency keys",
+		Func:        AddIdempotencyKeys,
+	},
+	{
+		Version:     11,
+		Description: "Add audit log",
+		Func:        AddAuditLog,
+	},
+	{
+		Version:     12,
+		Description: "Add currencies and FX rates",
+		Func:        AddCurrencies,
+	},
+	{
+		Version:     13,
+		Description: "Add interest, fee and tax transaction types",
+		Func:        AddIncomeExpenseTypes,
+	},
+	{
+		Version:     14,
+		Description: "Add pending limit orders",
+		Func:        AddOrders,
+	},
+	{
+		Version:     15,
+		Description: "Add recurring plans and draft transactions",
+		Func:        AddPlans,
+	},
+	{
+		Version:     16,
+		Description: "Add daily portfolio valuations",
+		Func:        AddValuations,
+	},
+	{
+		Version:     17,
+		Description: "Store exact split ratios",
+		Func:        ExactSplitRatios,
+	},
 	// Add future migrations here
 }
 
@@ -10,6 +10,12 @@ type PerformanceReport struct {
 	ReportDate   time.Time `json:"report_date"`
 	ReportPeriod string    `json:"report_period"` // e.g., "YTD", "1Y", "ALL"
 
+	// Cost-basis method used for cost basis and gains ("FIFO", "LIFO", "HIFO" or "AVERAGE")
+	CostBasisMethod string `json:"cost_basis_method"`
+
+	// Currency all amounts are reported in
+	Currency string `json:"currency"`
+
 	// Position Summary
 	CurrentValue float64 `json:"current_value"`
 	CashBalance  float64 `json:"cash_balance"`
@@ -19,6 +25,9 @@ type PerformanceReport struct {
 	RealizedGains   float64 `json:"realized_gains"`
 	UnrealizedGains float64 `json:"unrealized_gains"`
 	DividendIncome  float64 `json:"dividend_income"`
+	InterestIncome  float64 `json:"interest_income"`
+	AccountFees     float64 `json:"account_fees"` // FEE transactions; trading fees are part of cost basis
+	TaxesPaid       float64 `json:"taxes_paid"`
 	TotalReturn     float64 `json:"total_return"`
 	ReturnPercent   float64 `json:"return_percent"`
 
@@ -28,24 +37,36 @@ type PerformanceReport struct {
 	NetCashFlow float64 `json:"net_cash_flow"`
 
 	// Performance Metrics
-	IRR  float64 `json:"irr"`
-	XIRR float64 `json:"xirr"`
+	IRR       float64 `json:"irr"`                  // Money-weighted return over the report period
+	XIRR      float64 `json:"xirr"`                 // Annualized money-weighted return
+	XIRRError string  `json:"xirr_error,omitempty"` // Why IRR and XIRR could not be computed
+	TWR       float64 `json:"time_weighted_return"` // Over the report period
 
 	// Holdings Performance
 	Holdings []HoldingPerformance `json:"holdings"`
 
-	// Additional Performance Metrics
+	// Time-weighted returns up to the last valuation
 	DailyReturn   float64 `json:"daily_return"`
 	WeeklyReturn  float64 `json:"weekly_return"`
 	MonthlyReturn float64 `json:"monthly_return"`
 	YTDReturn     float64 `json:"ytd_return"`
 	OneYearReturn float64 `json:"one_year_return"`
 
-	// Risk Metrics
-	Volatility      float64    `json:"volatility"`
-	SharpeRatio     float64    `json:"sharpe_ratio"`
-	MaxDrawdown     float64    `json:"max_drawdown"`
-	DrawdownPeriods []Drawdown `json:"drawdown_periods"`
+	// Risk Metrics, from the daily time-weighted returns over the risk window
+	RiskWindowStart    time.Time     `json:"risk_window_start"`
+	RiskWindowEnd      time.Time     `json:"risk_window_end"`
+	Observations       int           `json:"observations"` // Daily returns in the window
+	TradingDaysPerYear float64       `json:"trading_days_per_year"`
+	Volatility         float64       `json:"volatility"` // Annualized, percent
+	RiskFreeRate       float64       `json:"risk_free_rate"`
+	SharpeRatio        float64       `json:"sharpe_ratio"`
+	SortinoRatio       float64       `json:"sortino_ratio"`
+	Benchmark          string        `json:"benchmark"`
+	Beta               float64       `json:"beta"`
+	Correlation        float64       `json:"correlation"`
+	ValueAtRisk        []ValueAtRisk `json:"value_at_risk"`
+	MaxDrawdown        float64       `json:"max_drawdown"`
+	DrawdownPeriods    []Drawdown    `json:"drawdown_periods"`
 }
 
 // HoldingPerformance represents performance metrics for a single holding
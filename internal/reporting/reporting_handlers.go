@@ -2,8 +2,12 @@ package reporting
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -27,17 +31,152 @@ func (h *ReportingHandler) GetPortfolioPerformance(w http.ResponseWriter, r *htt
 	}
 
 	// Get period from query params (default to "ALL")
-	period := r.URL.Query().Get("period")
+	period := strings.ToUpper(r.URL.Query().Get("period"))
 	if period == "" {
 		period = "ALL"
 	}
+	if _, err := periodFrom(period, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Cost-basis method to report gains under (defaults to the portfolio's own)
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	if method != "" && !validCostBasisMethod(method) {
+		http.Error(w, "Invalid cost basis method: "+method, http.StatusBadRequest)
+		return
+	}
+
+	// Currency to report amounts in (defaults to IQD)
+	currency, err := normalizeCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Risk metrics: benchmark, annual risk-free rate in percent, and window
+	risk := RiskOptions{Benchmark: strings.ToUpper(r.URL.Query().Get("benchmark"))}
+	if raw := r.URL.Query().Get("risk_free_rate"); raw != "" {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil || rate <= -100 {
+			http.Error(w, "Invalid risk_free_rate", http.StatusBadRequest)
+			return
+		}
+		risk.RiskFreeRate = &rate
+	}
+	if raw := r.URL.Query().Get("risk_from"); raw != "" {
+		if risk.From, err = time.Parse("2006-01-02", raw); err != nil {
+			http.Error(w, "Invalid risk_from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("risk_to"); raw != "" {
+		if risk.To, err = time.Parse("2006-01-02", raw); err != nil {
+			http.Error(w, "Invalid risk_to date", http.StatusBadRequest)
+			return
+		}
+	}
 
-	report, err := h.service.GeneratePerformanceReport(portfolioID, period)
+	report, err := h.service.GeneratePerformanceReport(portfolioID, period, method, currency, risk)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		reportError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(report)
 }
+
+// GetPortfolioReturns handles requests for time-weighted returns. With from
+// and/or to (YYYY-MM-DD) it returns the return over that range; otherwise the
+// periods in period (comma-separated) or the standard periods.
+func (h *ReportingHandler) GetPortfolioReturns(w http.ResponseWriter, r *http.Request) {
+	portfolioID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid portfolio ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	currency, err := normalizeCurrency(query.Get("currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var report *ReturnsReport
+	if query.Get("from") != "" || query.Get("to") != "" {
+		from, to := time.Time{}, time.Now()
+		if raw := query.Get("from"); raw != "" {
+			if from, err = time.Parse("2006-01-02", raw); err != nil {
+				http.Error(w, "Invalid from date", http.StatusBadRequest)
+				return
+			}
+		}
+		if raw := query.Get("to"); raw != "" {
+			if to, err = time.Parse("2006-01-02", raw); err != nil {
+				http.Error(w, "Invalid to date", http.StatusBadRequest)
+				return
+			}
+		}
+		period, err := h.service.CalculateTWR(portfolioID, currency, from, to)
+		if err != nil {
+			reportError(w, err)
+			return
+		}
+		report = &ReturnsReport{PortfolioID: portfolioID, Currency: currency, AsOf: period.EndDate, Periods: []PeriodReturn{*period}}
+	} else {
+		periods := StandardPeriods
+		if raw := query.Get("period"); raw != "" {
+			periods = strings.Split(strings.ToUpper(raw), ",")
+			for _, period := range periods {
+				if _, err := periodFrom(period, time.Now()); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		report, err = h.service.CalculatePeriodReturns(portfolioID, currency, periods)
+		if err != nil {
+			reportError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// normalizeCurrency upper-cases a currency code and checks that it has three
+// letters. An empty code is the ledger currency.
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return ledgerCurrency, nil
+	}
+	if len(code) != 3 {
+		return "", fmt.Errorf("invalid currency code: %s", code)
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("invalid currency code: %s", code)
+		}
+	}
+	return code, nil
+}
+
+// reportError answers a failed report: a missing exchange rate, an unknown
+// period or an unusable benchmark is a bad request, anything else a server
+// error
+func reportError(w http.ResponseWriter, err error) {
+	var fxErr *FXRateError
+	if errors.As(err, &fxErr) {
+		http.Error(w, fxErr.Message, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrUnknownPeriod) || errors.Is(err, ErrInvalidBenchmark) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -2,70 +2,140 @@ package reporting
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// ledgerCurrency is the currency securities trade and settle in. Cash can also
+// be held in other currencies.
+const ledgerCurrency = "IQD"
+
+// FXRateError reports an amount that cannot be converted to the report
+// currency because no exchange rate is recorded for its date
+type FXRateError struct {
+	Message string
+}
+
+func (e *FXRateError) Error() string {
+	return e.Message
+}
+
+// queryError describes a failed query. The no_data_found error the fx_rate
+// SQL function raises for a missing rate becomes an *FXRateError.
+func queryError(what string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "P0002" {
+		return &FXRateError{Message: pqErr.Message}
+	}
+	return fmt.Errorf("%s: %v", what, err)
+}
+
+// CostBasisMethods are the cost-basis methods gains can be reported under
+var CostBasisMethods = []string{"FIFO", "LIFO", "HIFO", "AVERAGE"}
+
+func validCostBasisMethod(method string) bool {
+	for _, m := range CostBasisMethods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// convertedTransactions stands in for portfolio_transactions with each amount
+// converted to the currency in $2 at the rate on the transaction date
+const convertedTransactions = `(
+		SELECT portfolio_id, type, transaction_at,
+			amount * fx_rate(currency, $2, transaction_at) as amount
+		FROM portfolio_transactions
+	) portfolio_transactions`
+
 // ReportingService handles portfolio performance calculations and reporting
 type ReportingService struct {
 	db *sql.DB
+
+	// Defaults of the risk metrics when a report does not choose them
+	RiskFreeRate float64 // Annual, percent
+	Benchmark    string  // Ticker or MARKET
 }
 
 func NewReportingService(db *sql.DB) *ReportingService {
-	return &ReportingService{db: db}
+	return &ReportingService{db: db, Benchmark: MarketBenchmark}
 }
 
-// GeneratePerformanceReport creates a comprehensive performance report
-func (s *ReportingService) GeneratePerformanceReport(portfolioID int, period string) (*PerformanceReport, error) {
+// GeneratePerformanceReport creates a comprehensive performance report. Cost
+// basis and gains use the given cost-basis method, or the portfolio's own
+// method when it is empty. Amounts are reported in the given currency (IQD
+// when empty): current values at the latest exchange rate, and flows and
+// realized gains at the rate on the day they happened. risk selects the
+// benchmark, risk-free rate and window of the risk metrics.
+func (s *ReportingService) GeneratePerformanceReport(portfolioID int, period, method, currency string, risk RiskOptions) (*PerformanceReport, error) {
 	fmt.Printf("Starting report generation for portfolio %d\n", portfolioID)
 
-	var report PerformanceReport
+	report := PerformanceReport{Currency: currency}
+	if report.Currency == "" {
+		report.Currency = ledgerCurrency
+	}
 
 	// Get basic portfolio info
+	var portfolioMethod string
 	err := s.db.QueryRow(`
-		SELECT id, name 
+		SELECT id, name, cost_basis_method
 		FROM portfolios 
 		WHERE id = $1
-	`, portfolioID).Scan(&report.PortfolioID, &report.Name)
+	`, portfolioID).Scan(&report.PortfolioID, &report.Name, &portfolioMethod)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to get portfolio: %v", err)
 	}
+	report.CostBasisMethod = portfolioMethod
+	if method != "" {
+		report.CostBasisMethod = method
+	}
 
 	fmt.Printf("Found portfolio: %s (ID: %d)\n", report.Name, report.PortfolioID)
 
 	// Set report metadata
 	report.ReportDate = time.Now()
 	report.ReportPeriod = period
+	periodStart, err := periodFrom(period, utcDate(report.ReportDate))
+	if err != nil {
+		return nil, err
+	}
 
 	// Get current positions and values
 	fmt.Println("Getting current positions...")
 	err = s.getCurrentPositions(portfolioID, &report)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get positions: %v", err)
+		return nil, fmt.Errorf("failed to get positions: %w", err)
 	}
 	fmt.Printf("Current positions: Cash=%f, Stocks=%f\n", report.CashBalance, report.StocksValue)
 
 	// Get performance metrics
 	fmt.Println("Getting performance metrics...")
-	err = s.getPerformanceMetrics(portfolioID, period, &report)
+	err = s.getPerformanceMetrics(portfolioID, periodStart, portfolioMethod, &report)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metrics: %v", err)
+		return nil, fmt.Errorf("failed to get metrics: %w", err)
 	}
 
 	fmt.Printf("Performance metrics: Return=%f%%\n", report.ReturnPercent)
 
 	// Calculate returns
-	irr, xirr, err := s.CalculateReturns(portfolioID, s.getPeriodStartDate(period), time.Now())
-	if err != nil {
+	irr, xirr, err := s.CalculateReturns(portfolioID, report.Currency, periodStart, time.Now())
+	if errors.Is(err, ErrNoXIRR) {
+		report.XIRRError = err.Error()
+	} else if err != nil {
 		return nil, err
 	}
 	report.IRR = irr
 	report.XIRR = xirr
 
 	// Calculate additional metrics
-	err = s.calculateAdditionalMetrics(portfolioID, &report)
+	err = s.calculateAdditionalMetrics(portfolioID, &report, risk)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +146,13 @@ func (s *ReportingService) GeneratePerformanceReport(portfolioID int, period str
 func (s *ReportingService) getCurrentPositions(portfolioID int, report *PerformanceReport) error {
 	fmt.Printf("Querying positions for portfolio %d\n", portfolioID)
 
+	// Securities are valued in IQD and converted at the latest rate
+	var rate float64
+	err := s.db.QueryRow(`SELECT fx_rate($1, $2, NOW())`, ledgerCurrency, report.Currency).Scan(&rate)
+	if err != nil {
+		return queryError("failed to get exchange rate", err)
+	}
+
 	rows, err := s.db.Query(`
 		WITH latest_prices AS (
 			SELECT ticker, close_price, date
@@ -91,22 +168,34 @@ func (s *ReportingService) getCurrentPositions(portfolioID int, report *Performa
 			h.shares,
 			COALESCE(lp.close_price, h.current_price, h.purchase_cost_average, 0) as current_price,
 			h.shares * COALESCE(lp.close_price, h.current_price, h.purchase_cost_average, 0) as current_value,
-			h.shares * COALESCE(h.purchase_cost_fifo, 0) as cost_basis,
-			h.shares * (COALESCE(lp.close_price, h.current_price, h.purchase_cost_average, 0) - COALESCE(h.purchase_cost_fifo, 0)) as unrealized_gain,
-			COALESCE(lp.date, h.price_last_date, NOW()) as price_last_date
+			COALESCE(cb.cost_basis, h.shares * COALESCE(h.purchase_cost_fifo, 0)) as cost_basis,
+			h.shares * COALESCE(lp.close_price, h.current_price, h.purchase_cost_average, 0)
+				- COALESCE(cb.cost_basis, h.shares * COALESCE(h.purchase_cost_fifo, 0)) as unrealized_gain,
+			COALESCE(cb.realized_gain, 0) as realized_gain,
+			COALESCE(lp.date, h.price_last_date, NOW()) as price_last_date,
+			COALESCE(d.dividend_income, 0) as dividend_income
 		FROM portfolio_holdings h
 		LEFT JOIN latest_prices lp ON h.ticker = lp.ticker
-		WHERE h.portfolio_id = $1
+		LEFT JOIN portfolio_cost_basis cb
+			ON cb.portfolio_id = h.portfolio_id AND cb.ticker = h.ticker AND cb.method = $2
+		LEFT JOIN (
+			SELECT ticker, SUM(amount * fx_rate(currency, $3, transaction_at)) as dividend_income
+			FROM portfolio_transactions
+			WHERE portfolio_id = $1 AND type = 'DIVIDEND'
+			GROUP BY ticker
+		) d ON h.ticker = d.ticker
+		WHERE h.portfolio_id = $1 AND h.ticker <> 'CASH'
 		ORDER BY h.ticker
-	`, portfolioID)
+	`, portfolioID, report.CostBasisMethod, report.Currency)
 	if err != nil {
-		return fmt.Errorf("failed to get positions: %v", err)
+		return queryError("failed to get positions", err)
 	}
 	defer rows.Close()
 
 	// Initialize values
 	report.CashBalance = 0
 	report.StocksValue = 0
+	report.UnrealizedGains = 0
 	report.Holdings = make([]HoldingPerformance, 0)
 
 	for rows.Next() {
@@ -118,25 +207,43 @@ func (s *ReportingService) getCurrentPositions(portfolioID int, report *Performa
 			&h.CurrentValue,
 			&h.CostBasis,
 			&h.UnrealizedGain,
+			&h.RealizedGain,
 			&h.LastUpdate,
+			&h.DividendIncome,
 		)
 		if err != nil {
 			return fmt.Errorf("failed to scan holding: %v", err)
 		}
 
+		h.CurrentPrice *= rate
+		h.CurrentValue *= rate
+		h.CostBasis *= rate
+		h.UnrealizedGain *= rate
+		h.RealizedGain *= rate
+
 		fmt.Printf("Found holding: %s, Shares=%f, Price=%f, Value=%f\n",
 			h.Ticker, h.Shares, h.CurrentPrice, h.CurrentValue)
 
-		if h.Ticker == "CASH" {
-			report.CashBalance = h.Shares // For CASH, shares = amount
-			fmt.Printf("Set cash balance: %f\n", report.CashBalance)
-		} else {
-			report.StocksValue += h.CurrentValue
-			report.Holdings = append(report.Holdings, h)
-			fmt.Printf("Added stock value: %f (total=%f)\n", h.CurrentValue, report.StocksValue)
-		}
+		report.StocksValue += h.CurrentValue
+		report.UnrealizedGains += h.UnrealizedGain
+		report.Holdings = append(report.Holdings, h)
+		fmt.Printf("Added stock value: %f (total=%f)\n", h.CurrentValue, report.StocksValue)
+	}
+	if err := rows.Err(); err != nil {
+		return queryError("failed to read holdings", err)
 	}
 
+	// Cash is held per currency
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(balance * fx_rate(currency, $2, NOW())), 0)
+		FROM portfolio_cash_balances
+		WHERE portfolio_id = $1
+	`, portfolioID, report.Currency).Scan(&report.CashBalance)
+	if err != nil {
+		return queryError("failed to get cash balance", err)
+	}
+	fmt.Printf("Set cash balance: %f\n", report.CashBalance)
+
 	// Set total portfolio value
 	report.CurrentValue = report.CashBalance + report.StocksValue
 	fmt.Printf("Total portfolio value: Cash=%f + Stocks=%f = %f\n",
@@ -145,30 +252,82 @@ func (s *ReportingService) getCurrentPositions(portfolioID int, report *Performa
 	return nil
 }
 
-func (s *ReportingService) getPerformanceMetrics(portfolioID int, period string, report *PerformanceReport) error {
+func (s *ReportingService) getPerformanceMetrics(portfolioID int, periodStart time.Time, portfolioMethod string, report *PerformanceReport) error {
 	fmt.Println("\nCalculating Performance Metrics:")
 
 	// Get total invested amount
 	var totalInvested float64
 	err := s.db.QueryRow(`
 		SELECT COALESCE(SUM(CASE 
-			WHEN type = 'DEPOSIT' THEN amount 
-			WHEN type = 'WITHDRAW' THEN -amount
+			WHEN type IN ('DEPOSIT', 'TRANSFER_IN') THEN amount
+			WHEN type IN ('WITHDRAW', 'TRANSFER_OUT') THEN -amount
 			ELSE 0 
 		END), 0)
-		FROM portfolio_transactions 
+		FROM `+convertedTransactions+`
 		WHERE portfolio_id = $1
-	`, portfolioID).Scan(&totalInvested)
+	`, portfolioID, report.Currency).Scan(&totalInvested)
 	if err != nil {
-		return fmt.Errorf("failed to get total invested: %v", err)
+		return queryError("failed to get total invested", err)
 	}
 	fmt.Printf("Total Invested: %f\n", totalInvested)
 
-	// Calculate returns
-	report.RealizedGains = 0   // Sum of realized gains from sells
-	report.UnrealizedGains = 0 // Current value - Cost basis
-	report.DividendIncome = 0  // Sum of dividends
-	report.TotalReturn = report.RealizedGains + report.UnrealizedGains + report.DividendIncome
+	// Sum dividends received (amount is stored net of withholding tax)
+	var dividendIncome float64
+	err = s.db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM `+convertedTransactions+`
+		WHERE portfolio_id = $1 AND type = 'DIVIDEND'
+			AND transaction_at >= $3
+	`, portfolioID, report.Currency, periodStart).Scan(&dividendIncome)
+	if err != nil {
+		return queryError("failed to get dividend income", err)
+	}
+
+	// Interest, account fees and taxes are income and expenses of the
+	// portfolio, not money the owner put in or took out
+	var interestIncome, accountFees, taxesPaid float64
+	err = s.db.QueryRow(`
+		SELECT
+			COALESCE(SUM(amount) FILTER (WHERE type = 'INTEREST'), 0),
+			COALESCE(SUM(amount) FILTER (WHERE type = 'FEE'), 0),
+			COALESCE(SUM(amount) FILTER (WHERE type = 'TAX'), 0)
+		FROM `+convertedTransactions+`
+		WHERE portfolio_id = $1 AND type IN ('INTEREST', 'FEE', 'TAX')
+			AND transaction_at >= $3
+	`, portfolioID, report.Currency, periodStart).Scan(&interestIncome, &accountFees, &taxesPaid)
+	if err != nil {
+		return queryError("failed to get income and expenses", err)
+	}
+
+	// Realized gains include tickers that are no longer held. Sales record
+	// their gain under the portfolio's own method, so those are converted at
+	// the rate on the sale date; other methods only have totals.
+	var realizedGains float64
+	if report.CostBasisMethod == portfolioMethod {
+		err = s.db.QueryRow(`
+			SELECT COALESCE(SUM(realized_gain * fx_rate($3, $2, transaction_at)), 0)
+			FROM portfolio_transactions
+			WHERE portfolio_id = $1 AND type = 'SELL'
+		`, portfolioID, report.Currency, ledgerCurrency).Scan(&realizedGains)
+	} else {
+		err = s.db.QueryRow(`
+			SELECT COALESCE(SUM(realized_gain), 0) * fx_rate($4, $3, NOW())
+			FROM portfolio_cost_basis
+			WHERE portfolio_id = $1 AND method = $2
+		`, portfolioID, report.CostBasisMethod, report.Currency, ledgerCurrency).Scan(&realizedGains)
+	}
+	if err != nil {
+		return queryError("failed to get realized gains", err)
+	}
+
+	// Calculate returns (unrealized gains were summed from the current positions)
+	report.RealizedGains = realizedGains
+	report.DividendIncome = dividendIncome
+	report.InterestIncome = interestIncome
+	report.AccountFees = accountFees
+	report.TaxesPaid = taxesPaid
+	report.TotalReturn = report.RealizedGains + report.UnrealizedGains + report.DividendIncome +
+		report.InterestIncome - report.AccountFees - report.TaxesPaid
 
 	// Calculate return percentage
 	if totalInvested > 0 {
@@ -185,355 +344,124 @@ func (s *ReportingService) getPerformanceMetrics(portfolioID int, period string,
 	return nil
 }
 
-func (s *ReportingService) getPeriodStartDate(period string) time.Time {
-	now := time.Now()
-	switch period {
-	case "YTD":
-		return time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
-	case "1Y":
-		return now.AddDate(-1, 0, 0)
-	case "1M":
-		return now.AddDate(0, -1, 0)
-	default:
-		return time.Time{} // Beginning of time for "ALL"
+// CalculateReturns calculates the money-weighted return of a portfolio from
+// startDate to endDate, in the given currency. The cash flows are from the
+// owner's side: deposits and transfers in are money put in (negative),
+// withdrawals and transfers out money taken out (positive). Dividends,
+// interest, fees and taxes stay in the portfolio and show up in its final
+// value, held at the end at the latest closes on or before endDate. A period
+// that starts after inception opens with the value at the close before it.
+// xirr is the annualized rate and irr the return over the period, both in
+// percent. Flows without a return, or a period with no valuation to open
+// with, give an error wrapping ErrNoXIRR.
+func (s *ReportingService) CalculateReturns(portfolioID int, currency string, startDate, endDate time.Time) (irr, xirr float64, err error) {
+	var flows []cashFlow
+	if !startDate.IsZero() {
+		startDate = utcDate(startDate)
+		var opening sql.NullFloat64
+		var heldBefore bool
+		err := s.db.QueryRow(`
+			SELECT (
+				SELECT total_value * fx_rate($3, $2, valuation_date)
+				FROM portfolio_valuations
+				WHERE portfolio_id = $1 AND valuation_date < $4
+				ORDER BY valuation_date DESC
+				LIMIT 1
+			), EXISTS (
+				SELECT 1 FROM portfolio_transactions
+				WHERE portfolio_id = $1 AND transaction_at < $4
+			)
+		`, portfolioID, currency, ledgerCurrency, startDate).Scan(&opening, &heldBefore)
+		if err != nil {
+			return 0, 0, queryError("failed to get opening value", err)
+		}
+		flow, err := openingFlow(startDate, opening, heldBefore)
+		if err != nil {
+			return 0, 0, err
+		}
+		if flow != nil {
+			flows = append(flows, *flow)
+		}
 	}
-}
 
-// CalculateReturns calculates IRR and XIRR for a given period
-func (s *ReportingService) CalculateReturns(portfolioID int, startDate, endDate time.Time) (irr, xirr float64, err error) {
-	// Get all cash flows including current portfolio value
 	rows, err := s.db.Query(`
-		WITH all_flows AS (
-			-- Regular cash flows
-			SELECT 
-				transaction_at as flow_date,
-				CASE 
-					WHEN type = 'DEPOSIT' THEN -amount 
-					WHEN type = 'WITHDRAW' THEN amount
-					WHEN type = 'DIVIDEND' THEN amount
-					ELSE 0 
-				END as flow_amount
-			FROM portfolio_transactions 
-			WHERE portfolio_id = $1 
-				AND transaction_at BETWEEN $2 AND $3
-			
-			UNION ALL
-			
-			-- Add current portfolio value as final flow
-			SELECT 
-				$3 as flow_date,
-				(
-					SELECT COALESCE(SUM(CASE 
-						WHEN ticker = 'CASH' THEN shares
-						ELSE shares * current_price
-					END), 0)
-					FROM portfolio_holdings
-					WHERE portfolio_id = $1
-				) as flow_amount
-		)
-		SELECT flow_date, flow_amount 
-		FROM all_flows 
-		ORDER BY flow_date
-	`, portfolioID, startDate, endDate)
+		SELECT transaction_at,
+			CASE WHEN type IN ('DEPOSIT', 'TRANSFER_IN') THEN -amount ELSE amount END
+		FROM `+convertedTransactions+`
+		WHERE portfolio_id = $1
+			AND type IN ('DEPOSIT', 'TRANSFER_IN', 'WITHDRAW', 'TRANSFER_OUT')
+			AND transaction_at BETWEEN $3 AND $4
+		ORDER BY transaction_at
+	`, portfolioID, currency, startDate, endDate)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get cash flows: %v", err)
+		return 0, 0, queryError("failed to get cash flows", err)
 	}
 	defer rows.Close()
 
-	var flows []struct {
-		date   time.Time
-		amount float64
-	}
-
 	for rows.Next() {
-		var f struct {
-			date   time.Time
-			amount float64
-		}
-		if err := rows.Scan(&f.date, &f.amount); err != nil {
+		var f cashFlow
+		if err := rows.Scan(&f.Date, &f.Amount); err != nil {
 			return 0, 0, fmt.Errorf("failed to scan cash flow: %v", err)
 		}
 		flows = append(flows, f)
 	}
-
-	// Calculate IRR using Newton's method
-	irr = calculateIRR(flows)
-	xirr = calculateXIRR(flows)
-
-	return irr, xirr, nil
-}
-
-// Add this function to calculate additional performance metrics
-func (s *ReportingService) calculateAdditionalMetrics(portfolioID int, report *PerformanceReport) error {
-	// Calculate daily/weekly/monthly/YTD returns
-	err := s.db.QueryRow(`
-		WITH daily_values AS (
-			SELECT 
-				date_trunc('day', transaction_at) as date,
-				SUM(CASE 
-					WHEN type IN ('DEPOSIT', 'BUY') THEN -amount
-					WHEN type IN ('WITHDRAW', 'SELL') THEN amount
-					WHEN type = 'DIVIDEND' THEN amount
-					ELSE 0
-				END) as daily_cashflow
-			FROM portfolio_transactions
-			WHERE portfolio_id = $1
-			GROUP BY date_trunc('day', transaction_at)
-		),
-		period_returns AS (
-			SELECT
-				(SELECT (current_value - initial_value) / NULLIF(initial_value, 0) * 100
-				FROM (
-					SELECT SUM(daily_cashflow) as current_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '1 day'
-				) c,
-				(
-					SELECT SUM(daily_cashflow) as initial_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '2 days'
-					AND date < CURRENT_DATE - INTERVAL '1 day'
-				) i) as daily_return,
-				
-				-- Weekly return calculation
-				(SELECT (current_value - initial_value) / NULLIF(initial_value, 0) * 100
-				FROM (
-					SELECT SUM(daily_cashflow) as current_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '7 days'
-				) c,
-				(
-					SELECT SUM(daily_cashflow) as initial_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '14 days'
-					AND date < CURRENT_DATE - INTERVAL '7 days'
-				) i) as weekly_return,
-				
-				-- Monthly return calculation
-				(SELECT (current_value - initial_value) / NULLIF(initial_value, 0) * 100
-				FROM (
-					SELECT SUM(daily_cashflow) as current_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '30 days'
-				) c,
-				(
-					SELECT SUM(daily_cashflow) as initial_value
-					FROM daily_values
-					WHERE date >= CURRENT_DATE - INTERVAL '60 days'
-					AND date < CURRENT_DATE - INTERVAL '30 days'
-				) i) as monthly_return,
-				
-				-- YTD return calculation
-				(SELECT (current_value - initial_value) / NULLIF(initial_value, 0) * 100
-				FROM (
-					SELECT SUM(daily_cashflow) as current_value
-					FROM daily_values
-					WHERE date >= date_trunc('year', CURRENT_DATE)
-				) c,
-				(
-					SELECT SUM(daily_cashflow) as initial_value
-					FROM daily_values
-					WHERE date < date_trunc('year', CURRENT_DATE)
-				) i) as ytd_return
-		)
-		SELECT 
-			COALESCE(daily_return, 0),
-			COALESCE(weekly_return, 0),
-			COALESCE(monthly_return, 0),
-			COALESCE(ytd_return, 0)
-		FROM period_returns
-	`, portfolioID).Scan(
-		&report.DailyReturn,
-		&report.WeeklyReturn,
-		&report.MonthlyReturn,
-		&report.YTDReturn,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to calculate period returns: %v", err)
-	}
-
-	// Calculate risk metrics
-	err = s.calculateRiskMetrics(portfolioID, report)
-	if err != nil {
-		return err
+	if err := rows.Err(); err != nil {
+		return 0, 0, queryError("failed to get cash flows", err)
 	}
 
-	return nil
-}
-
-func (s *ReportingService) calculateRiskMetrics(portfolioID int, report *PerformanceReport) error {
-	// Calculate volatility using daily returns
-	err := s.db.QueryRow(`
-		WITH daily_returns AS (
-			SELECT 
-				date_trunc('day', transaction_at) as date,
-				(SUM(CASE 
-					WHEN type IN ('DEPOSIT', 'BUY') THEN -amount
-					WHEN type IN ('WITHDRAW', 'SELL') THEN amount
-					WHEN type = 'DIVIDEND' THEN amount
-					ELSE 0
-				END) / NULLIF(LAG(SUM(CASE 
-					WHEN type IN ('DEPOSIT', 'BUY') THEN -amount
-					WHEN type IN ('WITHDRAW', 'SELL') THEN amount
-					WHEN type = 'DIVIDEND' THEN amount
-					ELSE 0
-				END)) OVER (ORDER BY date_trunc('day', transaction_at)), 0) - 1) * 100 as daily_return
-			FROM portfolio_transactions
+	// The final value is held as if taken out at the end
+	var final float64
+	err = s.db.QueryRow(`
+		SELECT (
+			SELECT COALESCE(SUM(h.shares * COALESCE(p.close_price, h.current_price, 0)), 0) * fx_rate($3, $2, $4)
+			FROM portfolio_holdings h
+			LEFT JOIN LATERAL (
+				SELECT close_price
+				FROM daily_stock_prices d
+				WHERE d.ticker = h.ticker AND d.date <= $4::date AND d.close_price > 0
+				ORDER BY d.date DESC
+				LIMIT 1
+			) p ON true
+			WHERE h.portfolio_id = $1 AND h.ticker <> 'CASH'
+		) + (
+			SELECT COALESCE(SUM(balance * fx_rate(currency, $2, $4)), 0)
+			FROM portfolio_cash_balances
 			WHERE portfolio_id = $1
-			GROUP BY date_trunc('day', transaction_at)
 		)
-		SELECT 
-			COALESCE(STDDEV(daily_return) * SQRT(252), 0) as volatility
-		FROM daily_returns
-	`, portfolioID).Scan(&report.Volatility)
+	`, portfolioID, currency, ledgerCurrency, endDate).Scan(&final)
 	if err != nil {
-		return fmt.Errorf("failed to calculate risk metrics: %v", err)
+		return 0, 0, queryError("failed to get final value", err)
 	}
+	flows = append(flows, cashFlow{Date: endDate, Amount: final})
 
-	// Calculate maximum drawdown
-	err = s.calculateDrawdown(portfolioID, report)
+	rate, err := solveXIRR(flows)
 	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// calculateIRR calculates Internal Rate of Return using Newton's method
-func calculateIRR(flows []struct {
-	date   time.Time
-	amount float64
-}) float64 {
-	const (
-		maxIterations = 100
-		tolerance     = 0.000001
-		guess         = 0.1 // 10% initial guess
-	)
-
-	// Newton's method implementation
-	rate := guess
-	for i := 0; i < maxIterations; i++ {
-		f := 0.0  // NPV
-		df := 0.0 // Derivative of NPV
-
-		for _, flow := range flows {
-			t := float64(flow.date.Sub(flows[0].date).Hours()) / 24 / 365 // years
-			v := math.Pow(1+rate, t)
-			f += flow.amount / v
-			df += -t * flow.amount / math.Pow(1+rate, t+1)
-		}
-
-		// Check if we're close enough
-		if math.Abs(f) < tolerance {
-			break
-		}
-
-		// Update rate using Newton's formula
-		rate = rate - f/df
-	}
-
-	return rate * 100 // Convert to percentage
-}
-
-// calculateXIRR calculates XIRR using Excel's method
-func calculateXIRR(flows []struct {
-	date   time.Time
-	amount float64
-}) float64 {
-	// Similar to IRR but accounts for irregular intervals
-	const (
-		maxIterations = 100
-		tolerance     = 0.000001
-		guess         = 0.1
-	)
-
-	rate := guess
-	for i := 0; i < maxIterations; i++ {
-		f := 0.0
-		df := 0.0
-
-		for _, flow := range flows {
-			t := float64(flow.date.Sub(flows[0].date).Hours()) / 24 / 365
-			v := math.Pow(1+rate, t)
-			f += flow.amount / v
-			df += -t * flow.amount / math.Pow(1+rate, t+1)
-		}
-
-		if math.Abs(f) < tolerance {
-			break
-		}
-
-		rate = rate - f/df
+		return 0, 0, err
 	}
-
-	return rate * 100
+	years := flowYears(flows[0].Date, flows[len(flows)-1].Date)
+	return (math.Pow(1+rate, years) - 1) * 100, rate * 100, nil
 }
 
-// calculateDrawdown calculates maximum drawdown and drawdown periods
-func (s *ReportingService) calculateDrawdown(portfolioID int, report *PerformanceReport) error {
-	// Get daily portfolio values
-	rows, err := s.db.Query(`
-		WITH daily_values AS (
-			SELECT 
-				date_trunc('day', transaction_at) as date,
-				SUM(CASE 
-					WHEN type IN ('DEPOSIT', 'BUY') THEN -amount
-					WHEN type IN ('WITHDRAW', 'SELL') THEN amount
-					WHEN type = 'DIVIDEND' THEN amount
-					ELSE 0
-				END) OVER (ORDER BY transaction_at) as cumulative_value
-			FROM portfolio_transactions
-			WHERE portfolio_id = $1
-			ORDER BY date
-		)
-		SELECT date, cumulative_value
-		FROM daily_values
-	`, portfolioID)
+// calculateAdditionalMetrics fills the time-weighted returns from the daily
+// valuations and the risk metrics
+func (s *ReportingService) calculateAdditionalMetrics(portfolioID int, report *PerformanceReport, risk RiskOptions) error {
+	returns, err := s.CalculatePeriodReturns(portfolioID, report.Currency, []string{"1D", "1W", "1M", "YTD", "1Y", report.ReportPeriod})
 	if err != nil {
-		return fmt.Errorf("failed to get daily values: %v", err)
+		return fmt.Errorf("failed to calculate period returns: %w", err)
 	}
-	defer rows.Close()
-
-	var (
-		maxValue    float64
-		currentDD   float64
-		maxDD       float64
-		ddStart     time.Time
-		ddEnd       time.Time
-		currentPeak time.Time
-	)
-
-	for rows.Next() {
-		var (
-			date  time.Time
-			value float64
-		)
-		if err := rows.Scan(&date, &value); err != nil {
-			return fmt.Errorf("failed to scan daily value: %v", err)
-		}
-
-		if value > maxValue {
-			maxValue = value
-			currentPeak = date
-			currentDD = 0
-		} else {
-			currentDD = (maxValue - value) / maxValue * 100
-			if currentDD > maxDD {
-				maxDD = currentDD
-				ddStart = currentPeak
-				ddEnd = date
-			}
-		}
+	if len(returns.Periods) > 0 {
+		report.DailyReturn = returns.Periods[0].TWR
+		report.WeeklyReturn = returns.Periods[1].TWR
+		report.MonthlyReturn = returns.Periods[2].TWR
+		report.YTDReturn = returns.Periods[3].TWR
+		report.OneYearReturn = returns.Periods[4].TWR
+		report.TWR = returns.Periods[5].TWR
 	}
 
-	report.MaxDrawdown = maxDD
-	if maxDD > 0 {
-		report.DrawdownPeriods = append(report.DrawdownPeriods, Drawdown{
-			StartDate:  ddStart,
-			EndDate:    ddEnd,
-			Percentage: maxDD,
-			Duration:   int(ddEnd.Sub(ddStart).Hours() / 24),
-		})
+	// Calculate risk metrics
+	err = s.calculateRiskMetrics(portfolioID, report, risk)
+	if err != nil {
+		return err
 	}
 
 	return nil
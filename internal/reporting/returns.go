@@ -0,0 +1,221 @@
+package reporting
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// StandardPeriods are the periods returns are reported for by default
+var StandardPeriods = []string{"1M", "3M", "YTD", "1Y", "3Y", "ALL"}
+
+// valuationPoint is the value of a portfolio at the close of a trading day
+// and its external cash flow (contributions less withdrawals) since the
+// previous close
+type valuationPoint struct {
+	Date  time.Time
+	Value float64
+	Flow  float64
+}
+
+// PeriodReturn is the time-weighted return of a portfolio over a period,
+// measured from the close before its first day to the close of its last
+type PeriodReturn struct {
+	Period           string    `json:"period"`
+	StartDate        time.Time `json:"start_date"`
+	EndDate          time.Time `json:"end_date"`
+	StartValue       float64   `json:"start_value"`
+	EndValue         float64   `json:"end_value"`
+	NetContributions float64   `json:"net_contributions"`
+	TWR              float64   `json:"time_weighted_return"`        // Percent
+	AnnualizedTWR    float64   `json:"annualized_return,omitempty"` // Percent, for periods over a year
+	SinceInception   bool      `json:"since_inception"`             // The period starts before the first valuation
+}
+
+// ReturnsReport lists the time-weighted returns of a portfolio
+type ReturnsReport struct {
+	PortfolioID int            `json:"portfolio_id"`
+	Currency    string         `json:"currency"`
+	AsOf        time.Time      `json:"as_of"` // Date of the last valuation
+	Periods     []PeriodReturn `json:"periods"`
+}
+
+// ErrUnknownPeriod reports a period that is not one of the standard periods
+var ErrUnknownPeriod = errors.New("unknown period")
+
+// periodFrom returns the first day of a standard period ending on asOf. ALL
+// starts at the zero time. Other periods give an error wrapping
+// ErrUnknownPeriod.
+func periodFrom(period string, asOf time.Time) (time.Time, error) {
+	switch period {
+	case "1D":
+		return asOf, nil
+	case "1W":
+		return asOf.AddDate(0, 0, -6), nil
+	case "1M":
+		return monthsBefore(asOf, 1).AddDate(0, 0, 1), nil
+	case "3M":
+		return monthsBefore(asOf, 3).AddDate(0, 0, 1), nil
+	case "YTD":
+		return time.Date(asOf.Year(), 1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "1Y":
+		return monthsBefore(asOf, 12).AddDate(0, 0, 1), nil
+	case "3Y":
+		return monthsBefore(asOf, 36).AddDate(0, 0, 1), nil
+	case "ALL":
+		return time.Time{}, nil
+	}
+	return time.Time{}, fmt.Errorf("%w %s", ErrUnknownPeriod, period)
+}
+
+// monthsBefore returns the same day a number of months earlier, or the last
+// day of that month if it is shorter
+func monthsBefore(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()-time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+// dailyReturn is the time-weighted return of a portfolio on one trading day
+type dailyReturn struct {
+	Date   time.Time
+	Return float64
+}
+
+// dailyReturns returns the daily returns of points (ascending) from the one
+// at index first, measured from the close before it (zero at inception).
+// Each day's flow is taken to arrive at the start of the day, so the day's
+// return is its close over the previous close plus the flow. Days with
+// nothing invested have no return and are left out.
+func dailyReturns(points []valuationPoint, first int) []dailyReturn {
+	var returns []dailyReturn
+	prev := 0.0
+	if first > 0 {
+		prev = points[first-1].Value
+	}
+	for _, p := range points[first:] {
+		if invested := prev + p.Flow; invested > 0 {
+			returns = append(returns, dailyReturn{Date: p.Date, Return: p.Value/invested - 1})
+		}
+		prev = p.Value
+	}
+	return returns
+}
+
+// firstPointFrom returns the index of the first point on or after from
+func firstPointFrom(points []valuationPoint, from time.Time) int {
+	return sort.Search(len(points), func(i int) bool { return !points[i].Date.Before(from) })
+}
+
+// periodReturn chains the daily returns of points (ascending) from the close
+// before from up to the last point. A period that starts before the first
+// point is measured from inception.
+func periodReturn(points []valuationPoint, from time.Time) PeriodReturn {
+	r := PeriodReturn{StartDate: from}
+	if len(points) == 0 {
+		return r
+	}
+	first := firstPointFrom(points, from)
+	if first == len(points) {
+		return r
+	}
+	if first == 0 {
+		r.StartDate = points[0].Date
+		r.SinceInception = true
+	} else {
+		r.StartValue = points[first-1].Value
+	}
+
+	growth := 1.0
+	for _, d := range dailyReturns(points, first) {
+		growth *= 1 + d.Return
+	}
+	for _, p := range points[first:] {
+		r.NetContributions += p.Flow
+	}
+	last := points[len(points)-1]
+	r.EndDate = last.Date
+	r.EndValue = last.Value
+	r.TWR = (growth - 1) * 100
+
+	if days := r.EndDate.Sub(r.StartDate).Hours()/24 + 1; days > 365 {
+		r.AnnualizedTWR = (math.Pow(growth, 365/days) - 1) * 100
+	}
+	return r
+}
+
+// loadValuationPoints returns the daily valuations of a portfolio up to a
+// date, with values and flows converted to the given currency at the rate of
+// each day
+func (s *ReportingService) loadValuationPoints(portfolioID int, currency string, to time.Time) ([]valuationPoint, error) {
+	rows, err := s.db.Query(`
+		SELECT valuation_date, value * fx_rate($3, $2, valuation_date), flow * fx_rate($3, $2, valuation_date)
+		FROM (
+			SELECT valuation_date, total_value AS value,
+				net_contributions - COALESCE(LAG(net_contributions) OVER (ORDER BY valuation_date), 0) AS flow
+			FROM portfolio_valuations
+			WHERE portfolio_id = $1
+		) v
+		WHERE valuation_date <= $4
+		ORDER BY valuation_date
+	`, portfolioID, currency, ledgerCurrency, to)
+	if err != nil {
+		return nil, queryError("failed to get valuations", err)
+	}
+	defer rows.Close()
+
+	var points []valuationPoint
+	for rows.Next() {
+		var p valuationPoint
+		if err := rows.Scan(&p.Date, &p.Value, &p.Flow); err != nil {
+			return nil, fmt.Errorf("failed to scan valuation: %v", err)
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError("failed to get valuations", err)
+	}
+	return points, nil
+}
+
+// CalculatePeriodReturns computes the time-weighted returns of a portfolio
+// over the given standard periods, ending on the last valuation
+func (s *ReportingService) CalculatePeriodReturns(portfolioID int, currency string, periods []string) (*ReturnsReport, error) {
+	report := &ReturnsReport{PortfolioID: portfolioID, Currency: currency, Periods: []PeriodReturn{}}
+	points, err := s.loadValuationPoints(portfolioID, currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return report, nil
+	}
+	report.AsOf = points[len(points)-1].Date
+
+	for _, period := range periods {
+		from, err := periodFrom(period, report.AsOf)
+		if err != nil {
+			return nil, err
+		}
+		r := periodReturn(points, from)
+		r.Period = period
+		report.Periods = append(report.Periods, r)
+	}
+	return report, nil
+}
+
+// CalculateTWR computes the time-weighted return of a portfolio from the
+// close before from to the last valuation on or before to
+func (s *ReportingService) CalculateTWR(portfolioID int, currency string, from, to time.Time) (*PeriodReturn, error) {
+	points, err := s.loadValuationPoints(portfolioID, currency, to)
+	if err != nil {
+		return nil, err
+	}
+	r := periodReturn(points, from)
+	r.Period = "CUSTOM"
+	return &r, nil
+}
@@ -0,0 +1,51 @@
+package reporting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriodReturn(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	points := []valuationPoint{
+		{Date: day(1), Value: 1000, Flow: 1000},
+		{Date: day(2), Value: 1100},             // +10%
+		{Date: day(3), Value: 2100, Flow: 1100}, // a deposit doubles the portfolio, -4.55%
+		{Date: day(4), Value: 2310},             // +10%
+	}
+
+	all := periodReturn(points, time.Time{})
+	assert.True(t, all.SinceInception)
+	assert.Equal(t, day(1), all.StartDate)
+	assert.InDelta(t, (1.1*2100.0/2200*1.1-1)*100, all.TWR, 0.0001)
+	assert.InDelta(t, 2100, all.NetContributions, 0.0001)
+	assert.InDelta(t, 2310, all.EndValue, 0.0001)
+
+	// Measured from the close before the first day, so the flow is not a gain
+	since := periodReturn(points, day(3))
+	assert.False(t, since.SinceInception)
+	assert.InDelta(t, 1100, since.StartValue, 0.0001)
+	assert.InDelta(t, (2100.0/2200*1.1-1)*100, since.TWR, 0.0001)
+	assert.InDelta(t, 1100, since.NetContributions, 0.0001)
+
+	assert.InDelta(t, 10, periodReturn(points, day(4)).TWR, 0.0001)
+	assert.Zero(t, periodReturn(points, day(5)).TWR)
+}
+
+func TestPeriodFrom(t *testing.T) {
+	asOf := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	from, err := periodFrom("1M", asOf)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), from, "measured from the close of February 29")
+
+	from, _ = periodFrom("YTD", asOf)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), from)
+
+	_, err = periodFrom("5X", asOf)
+	assert.ErrorIs(t, err, ErrUnknownPeriod)
+}
@@ -0,0 +1,317 @@
+package reporting
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// MarketBenchmark is the equal-weighted daily return of every listed ticker
+const MarketBenchmark = "MARKET"
+
+// ErrInvalidBenchmark reports a benchmark ticker that is not listed or has no
+// prices in the risk window
+var ErrInvalidBenchmark = errors.New("invalid benchmark")
+
+// isxTradingDaysPerYear annualizes daily figures when there is less than a
+// year of price history to count ISX sessions from
+const isxTradingDaysPerYear = 240
+
+// VaRConfidences are the confidence levels Value at Risk is reported at
+var VaRConfidences = []float64{0.95, 0.99}
+
+// RiskOptions select the inputs of the risk metrics of a report
+type RiskOptions struct {
+	RiskFreeRate *float64 // Annual, percent; nil uses the service default
+	Benchmark    string   // Ticker or MARKET; empty uses the service default
+	From         time.Time
+	To           time.Time // Zero for the last valuation
+}
+
+// ValueAtRisk is the one-day loss not exceeded at a confidence level, as a
+// percent of the portfolio value and as an amount of its current value
+type ValueAtRisk struct {
+	Confidence       float64 `json:"confidence"` // Percent
+	Historical       float64 `json:"historical"` // Empirical quantile of the daily returns
+	Parametric       float64 `json:"parametric"` // Normal distribution with their mean and deviation
+	HistoricalAmount float64 `json:"historical_amount"`
+	ParametricAmount float64 `json:"parametric_amount"`
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// stdDev returns the sample standard deviation
+func stdDev(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	m := mean(xs)
+	sum := 0.0
+	for _, x := range xs {
+		sum += (x - m) * (x - m)
+	}
+	return math.Sqrt(sum / float64(len(xs)-1))
+}
+
+// riskRatios returns the annualized volatility, Sharpe ratio and Sortino
+// ratio of daily returns, against an annual risk-free rate (fractions)
+func riskRatios(returns []float64, riskFreeRate, tradingDays float64) (volatility, sharpe, sortino float64) {
+	if len(returns) < 2 {
+		return 0, 0, 0
+	}
+	dailyRiskFree := math.Pow(1+riskFreeRate, 1/tradingDays) - 1
+	excess := mean(returns) - dailyRiskFree
+	sd := stdDev(returns)
+	volatility = sd * math.Sqrt(tradingDays)
+	if sd > 0 {
+		sharpe = excess / sd * math.Sqrt(tradingDays)
+	}
+
+	// Downside deviation counts only returns below the risk-free rate
+	downside := 0.0
+	for _, r := range returns {
+		if r < dailyRiskFree {
+			downside += (r - dailyRiskFree) * (r - dailyRiskFree)
+		}
+	}
+	if downside > 0 {
+		sortino = excess / math.Sqrt(downside/float64(len(returns))) * math.Sqrt(tradingDays)
+	}
+	return volatility, sharpe, sortino
+}
+
+// betaCorrelation returns the beta and correlation of paired daily returns
+// of a portfolio and its benchmark
+func betaCorrelation(portfolio, benchmark []float64) (beta, correlation float64) {
+	if len(portfolio) < 2 || len(portfolio) != len(benchmark) {
+		return 0, 0
+	}
+	pm, bm := mean(portfolio), mean(benchmark)
+	var cov, pVar, bVar float64
+	for i := range portfolio {
+		cov += (portfolio[i] - pm) * (benchmark[i] - bm)
+		pVar += (portfolio[i] - pm) * (portfolio[i] - pm)
+		bVar += (benchmark[i] - bm) * (benchmark[i] - bm)
+	}
+	if bVar > 0 {
+		beta = cov / bVar
+	}
+	if pVar > 0 && bVar > 0 {
+		correlation = cov / math.Sqrt(pVar*bVar)
+	}
+	return beta, correlation
+}
+
+// historicalVaR returns the loss (a fraction, positive for a loss) at the
+// 1-confidence quantile of the daily returns
+func historicalVaR(returns []float64, confidence float64) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), returns...)
+	sort.Float64s(sorted)
+	k := int(math.Floor((1 - confidence) * float64(len(sorted))))
+	if k >= len(sorted) {
+		k = len(sorted) - 1
+	}
+	return -sorted[k]
+}
+
+// parametricVaR returns the loss (a fraction, positive for a loss) at the
+// 1-confidence quantile of a normal distribution fitted to the daily returns
+func parametricVaR(returns []float64, confidence float64) float64 {
+	if len(returns) < 2 {
+		return 0
+	}
+	z := math.Sqrt2 * math.Erfinv(2*confidence-1)
+	return z*stdDev(returns) - mean(returns)
+}
+
+// maxDrawdown returns the largest fall of the growth of daily returns from a
+// peak, starting from a peak on start
+func maxDrawdown(returns []dailyReturn, start time.Time) (Drawdown, bool) {
+	var dd Drawdown
+	growth, peak := 1.0, 1.0
+	peakDate := start
+	for _, r := range returns {
+		growth *= 1 + r.Return
+		if growth > peak {
+			peak, peakDate = growth, r.Date
+			continue
+		}
+		if pct := (peak - growth) / peak * 100; pct > dd.Percentage {
+			dd = Drawdown{StartDate: peakDate, EndDate: r.Date, Percentage: pct}
+		}
+	}
+	dd.Duration = int(dd.EndDate.Sub(dd.StartDate).Hours() / 24)
+	return dd, dd.Percentage > 0
+}
+
+// tradingDaysPerYear counts the ISX sessions in the year up to a date, or
+// returns isxTradingDaysPerYear if prices do not go back a full year
+func (s *ReportingService) tradingDaysPerYear(to time.Time) (float64, error) {
+	var sessions int
+	var first sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT COUNT(DISTINCT date) FILTER (WHERE date > $1::date - INTERVAL '1 year'), MIN(date)
+		FROM daily_stock_prices
+		WHERE date <= $1::date
+	`, to).Scan(&sessions, &first)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count trading days: %v", err)
+	}
+	if !first.Valid || first.Time.After(to.AddDate(-1, 0, 0)) || sessions == 0 {
+		return isxTradingDaysPerYear, nil
+	}
+	return float64(sessions), nil
+}
+
+// benchmarkReturns returns the daily close-to-close returns of a ticker, or
+// of every ticker equally weighted for MARKET, by date
+func (s *ReportingService) benchmarkReturns(benchmark string, from, to time.Time) (map[time.Time]float64, error) {
+	ticker := benchmark
+	if benchmark == MarketBenchmark {
+		ticker = ""
+	}
+	rows, err := s.db.Query(`
+		SELECT date, AVG(close_price / prev_close - 1)
+		FROM (
+			SELECT ticker, date, close_price,
+				LAG(close_price) OVER (PARTITION BY ticker ORDER BY date) AS prev_close
+			FROM daily_stock_prices
+			WHERE close_price > 0 AND ($1 = '' OR ticker = $1)
+				AND date >= $2::date - INTERVAL '1 month' AND date <= $3::date
+		) p
+		WHERE prev_close > 0 AND date >= $2::date
+		GROUP BY date
+	`, ticker, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get benchmark returns: %v", err)
+	}
+	defer rows.Close()
+
+	returns := make(map[time.Time]float64)
+	for rows.Next() {
+		var date time.Time
+		var r float64
+		if err := rows.Scan(&date, &r); err != nil {
+			return nil, fmt.Errorf("failed to scan benchmark return: %v", err)
+		}
+		returns[utcDate(date)] = r
+	}
+	return returns, rows.Err()
+}
+
+// calculateRiskMetrics fills the risk metrics of a report from the daily
+// time-weighted returns over the risk window, which defaults to the report
+// period up to the last valuation
+func (s *ReportingService) calculateRiskMetrics(portfolioID int, report *PerformanceReport, opts RiskOptions) error {
+	report.RiskFreeRate = s.RiskFreeRate
+	if opts.RiskFreeRate != nil {
+		report.RiskFreeRate = *opts.RiskFreeRate
+	}
+	report.Benchmark = s.Benchmark
+	if opts.Benchmark != "" {
+		report.Benchmark = opts.Benchmark
+	}
+	report.ValueAtRisk = []ValueAtRisk{}
+	report.DrawdownPeriods = []Drawdown{}
+
+	if report.Benchmark != MarketBenchmark {
+		var listed bool
+		err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM tickers WHERE ticker = $1)`, report.Benchmark).Scan(&listed)
+		if err != nil {
+			return fmt.Errorf("failed to check benchmark: %v", err)
+		}
+		if !listed {
+			return fmt.Errorf("%w: unknown ticker %s", ErrInvalidBenchmark, report.Benchmark)
+		}
+	}
+
+	to := opts.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	points, err := s.loadValuationPoints(portfolioID, report.Currency, to)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	report.RiskWindowEnd = points[len(points)-1].Date
+
+	from := opts.From
+	if from.IsZero() {
+		if from, err = periodFrom(report.ReportPeriod, report.RiskWindowEnd); err != nil {
+			return err
+		}
+	}
+	first := firstPointFrom(points, from)
+	if first == len(points) {
+		return nil
+	}
+	report.RiskWindowStart = points[first].Date
+
+	daily := dailyReturns(points, first)
+	returns := make([]float64, len(daily))
+	for i, d := range daily {
+		returns[i] = d.Return
+	}
+	report.Observations = len(returns)
+
+	report.TradingDaysPerYear, err = s.tradingDaysPerYear(report.RiskWindowEnd)
+	if err != nil {
+		return err
+	}
+	volatility, sharpe, sortino := riskRatios(returns, report.RiskFreeRate/100, report.TradingDaysPerYear)
+	report.Volatility = volatility * 100
+	report.SharpeRatio = sharpe
+	report.SortinoRatio = sortino
+
+	benchmark, err := s.benchmarkReturns(report.Benchmark, report.RiskWindowStart, report.RiskWindowEnd)
+	if err != nil {
+		return err
+	}
+	if len(benchmark) == 0 && report.Benchmark != MarketBenchmark {
+		return fmt.Errorf("%w: %s has no prices between %s and %s", ErrInvalidBenchmark, report.Benchmark,
+			report.RiskWindowStart.Format("2006-01-02"), report.RiskWindowEnd.Format("2006-01-02"))
+	}
+	var paired, benchmarkPaired []float64
+	for _, d := range daily {
+		if b, ok := benchmark[utcDate(d.Date)]; ok {
+			paired = append(paired, d.Return)
+			benchmarkPaired = append(benchmarkPaired, b)
+		}
+	}
+	report.Beta, report.Correlation = betaCorrelation(paired, benchmarkPaired)
+
+	for _, confidence := range VaRConfidences {
+		v := ValueAtRisk{
+			Confidence: confidence * 100,
+			Historical: historicalVaR(returns, confidence) * 100,
+			Parametric: parametricVaR(returns, confidence) * 100,
+		}
+		v.HistoricalAmount = v.Historical / 100 * report.CurrentValue
+		v.ParametricAmount = v.Parametric / 100 * report.CurrentValue
+		report.ValueAtRisk = append(report.ValueAtRisk, v)
+	}
+
+	if dd, ok := maxDrawdown(daily, report.RiskWindowStart); ok {
+		report.MaxDrawdown = dd.Percentage
+		report.DrawdownPeriods = append(report.DrawdownPeriods, dd)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package reporting
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRiskRatios(t *testing.T) {
+	returns := []float64{0.01, -0.02, 0.03, -0.01, 0.02}
+	sd := math.Sqrt(0.00172 / 4)
+
+	volatility, sharpe, sortino := riskRatios(returns, 0, 250)
+	assert.InDelta(t, sd*math.Sqrt(250), volatility, 1e-9)
+	assert.InDelta(t, 0.006/sd*math.Sqrt(250), sharpe, 1e-9)
+	// Downside deviation of the two losses over all five days is 1%
+	assert.InDelta(t, 0.006/0.01*math.Sqrt(250), sortino, 1e-9)
+
+	_, higher, _ := riskRatios(returns, -0.5, 250)
+	assert.Greater(t, higher, sharpe, "a lower risk-free rate raises the Sharpe ratio")
+
+	benchmark := make([]float64, len(returns))
+	for i, r := range returns {
+		benchmark[i] = 2 * r
+	}
+	beta, correlation := betaCorrelation(returns, benchmark)
+	assert.InDelta(t, 0.5, beta, 1e-9)
+	assert.InDelta(t, 1, correlation, 1e-9)
+}
+
+func TestValueAtRisk(t *testing.T) {
+	returns := []float64{-0.05, -0.04}
+	for i := 0; i < 18; i++ {
+		returns = append(returns, 0.01)
+	}
+
+	// The 5% quantile of 20 returns is the second worst
+	assert.InDelta(t, 0.04, historicalVaR(returns, 0.95), 1e-9)
+	assert.InDelta(t, 0.05, historicalVaR(returns, 0.99), 1e-9)
+	assert.InDelta(t, 1.644854*stdDev(returns)-mean(returns), parametricVaR(returns, 0.95), 1e-6)
+	assert.Greater(t, parametricVaR(returns, 0.99), parametricVaR(returns, 0.95))
+}
+
+func TestMaxDrawdown(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	returns := []dailyReturn{
+		{Date: day(1), Return: 0.10},
+		{Date: day(2), Return: -0.20},
+		{Date: day(3), Return: 0.10},
+		{Date: day(4), Return: -0.10},
+		{Date: day(5), Return: 0.50},
+	}
+
+	dd, ok := maxDrawdown(returns, day(1))
+	assert.True(t, ok)
+	assert.InDelta(t, (1.1-0.8712)/1.1*100, dd.Percentage, 1e-9)
+	assert.Equal(t, day(1), dd.StartDate)
+	assert.Equal(t, day(4), dd.EndDate)
+	assert.Equal(t, 3, dd.Duration)
+}
@@ -0,0 +1,142 @@
+package reporting
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrNoXIRR reports cash flows that have no money-weighted return
+var ErrNoXIRR = errors.New("no money-weighted return")
+
+// cashFlow is money put into the portfolio by its owner (negative) or
+// taken out or held at the end (positive)
+type cashFlow struct {
+	Date   time.Time
+	Amount float64
+}
+
+// openingFlow returns the value a period starting on startDate opens with,
+// put in on its first day. opening is the last valuation before startDate.
+// A portfolio with no transactions before the period opens empty; one with
+// transactions but no valuation has no known opening value, and gives an
+// error wrapping ErrNoXIRR.
+func openingFlow(startDate time.Time, opening sql.NullFloat64, heldBefore bool) (*cashFlow, error) {
+	if opening.Valid {
+		return &cashFlow{Date: startDate, Amount: -opening.Float64}, nil
+	}
+	if heldBefore {
+		return nil, fmt.Errorf("%w: there is no valuation before %s to open the period with",
+			ErrNoXIRR, startDate.Format("2006-01-02"))
+	}
+	return nil, nil
+}
+
+// bracketRates are tried in order to find a pair of rates the net present
+// value changes sign between
+var bracketRates = []float64{-0.9999, -0.99, -0.9, -0.75, -0.5, -0.25, 0, 0.25, 0.5, 1, 2, 5, 10, 100, 1000}
+
+// flowYears returns the time from the first flow to a flow in years of 365
+// days, counted in whole calendar days
+func flowYears(first, date time.Time) float64 {
+	days := math.Round(utcDate(date).Sub(utcDate(first)).Hours() / 24)
+	return days / 365
+}
+
+func utcDate(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// xnpv returns the net present value of flows (in date order) at an annual
+// rate, and its derivative by the rate
+func xnpv(rate float64, flows []cashFlow) (npv, dnpv float64) {
+	for _, f := range flows {
+		t := flowYears(flows[0].Date, f.Date)
+		v := math.Pow(1+rate, t)
+		npv += f.Amount / v
+		dnpv -= t * f.Amount / (v * (1 + rate))
+	}
+	return npv, dnpv
+}
+
+// solveXIRR returns the annual rate at which the net present value of flows
+// (in date order) is zero, like Excel's XIRR. Newton's method is tried
+// first; if it fails to converge or leaves the valid range, the root is
+// bracketed and found by bisection. Errors wrap ErrNoXIRR.
+func solveXIRR(flows []cashFlow) (float64, error) {
+	const (
+		newtonIterations    = 50
+		bisectionIterations = 200
+		guess               = 0.1
+	)
+
+	var positive, negative bool
+	scale := 0.0
+	for _, f := range flows {
+		positive = positive || f.Amount > 0
+		negative = negative || f.Amount < 0
+		scale = math.Max(scale, math.Abs(f.Amount))
+	}
+	if !positive || !negative {
+		return 0, fmt.Errorf("%w: cash flows need both money put in and money taken out or held", ErrNoXIRR)
+	}
+	if flowYears(flows[0].Date, flows[len(flows)-1].Date) == 0 {
+		return 0, fmt.Errorf("%w: all cash flows are on the same day", ErrNoXIRR)
+	}
+	tolerance := scale * 1e-9
+
+	rate := guess
+	for i := 0; i < newtonIterations; i++ {
+		npv, dnpv := xnpv(rate, flows)
+		if math.Abs(npv) < tolerance {
+			return rate, nil
+		}
+		if dnpv == 0 || math.IsNaN(dnpv) || math.IsInf(dnpv, 0) {
+			break
+		}
+		next := rate - npv/dnpv
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < 1e-12 {
+			return next, nil
+		}
+		rate = next
+	}
+
+	// Bracket a sign change of the net present value
+	lo, hi := 0.0, 0.0
+	found := false
+	prevRate := bracketRates[0]
+	prevNPV, _ := xnpv(prevRate, flows)
+	for _, r := range bracketRates[1:] {
+		npv, _ := xnpv(r, flows)
+		if math.Signbit(npv) != math.Signbit(prevNPV) {
+			lo, hi, found = prevRate, r, true
+			break
+		}
+		prevRate, prevNPV = r, npv
+	}
+	if !found {
+		return 0, fmt.Errorf("%w: no rate between %.2f%% and %.0f%% values the cash flows at zero",
+			ErrNoXIRR, bracketRates[0]*100, bracketRates[len(bracketRates)-1]*100)
+	}
+
+	loNPV, _ := xnpv(lo, flows)
+	for i := 0; i < bisectionIterations; i++ {
+		mid := (lo + hi) / 2
+		npv, _ := xnpv(mid, flows)
+		if math.Abs(npv) < tolerance || hi-lo < 1e-12 {
+			return mid, nil
+		}
+		if math.Signbit(npv) == math.Signbit(loNPV) {
+			lo, loNPV = mid, npv
+		} else {
+			hi = mid
+		}
+	}
+	return 0, fmt.Errorf("%w: the solver did not converge", ErrNoXIRR)
+}
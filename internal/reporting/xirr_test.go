@@ -0,0 +1,65 @@
+package reporting
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSolveXIRR(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	rate, err := solveXIRR([]cashFlow{
+		{Date: day(2023, 1, 1), Amount: -1000},
+		{Date: day(2024, 1, 1), Amount: 1100},
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.10, rate, 1e-9)
+
+	// A deposit halfway through earns for half the time
+	flows := []cashFlow{
+		{Date: day(2023, 1, 1), Amount: -1000},
+		{Date: day(2023, 7, 2), Amount: -1000},
+		{Date: day(2024, 1, 1), Amount: 2200},
+	}
+	rate, err = solveXIRR(flows)
+	assert.NoError(t, err)
+	npv, _ := xnpv(rate, flows)
+	assert.InDelta(t, 0, npv, 1e-6)
+	assert.True(t, rate > 0.10 && rate < 0.15)
+
+	// Newton overshoots below -100%, so the root is bracketed instead
+	rate, err = solveXIRR([]cashFlow{
+		{Date: day(2023, 1, 1), Amount: -1000},
+		{Date: day(2024, 1, 1), Amount: 1},
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, -0.999, rate, 1e-6)
+
+	_, err = solveXIRR([]cashFlow{
+		{Date: day(2023, 1, 1), Amount: -1000},
+		{Date: day(2024, 1, 1), Amount: 0},
+	})
+	assert.True(t, errors.Is(err, ErrNoXIRR), "flows that never change sign have no return")
+}
+
+func TestOpeningFlow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	flow, err := openingFlow(start, sql.NullFloat64{Float64: 1500, Valid: true}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, &cashFlow{Date: start, Amount: -1500}, flow)
+
+	// A portfolio opened during the period starts empty
+	flow, err = openingFlow(start, sql.NullFloat64{}, false)
+	assert.NoError(t, err)
+	assert.Nil(t, flow)
+
+	_, err = openingFlow(start, sql.NullFloat64{}, true)
+	assert.True(t, errors.Is(err, ErrNoXIRR), "holdings before the period need a valuation to open with")
+}
@@ -8,9 +8,11 @@ import (
 
 // Config holds all configuration settings
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	Scraper  ScraperConfig  `mapstructure:"scraper"`
+	Server    ServerConfig    `mapstructure:"server"`
+	Database  DatabaseConfig  `mapstructure:"database"`
+	Scraper   ScraperConfig   `mapstructure:"scraper"`
+	Orders    OrdersConfig    `mapstructure:"orders"`
+	Reporting ReportingConfig `mapstructure:"reporting"`
 }
 
 // ServerConfig holds server-specific configuration
@@ -36,6 +38,22 @@ type ScraperConfig struct {
 	Delay    int `mapstructure:"delay"`
 }
 
+// OrdersConfig holds settings for pending limit orders
+type OrdersConfig struct {
+	// Days an order stays open when it is placed without an expiry; 0 keeps
+	// it open until it fills or is cancelled
+	DefaultExpiryDays int `mapstructure:"default_expiry_days"`
+}
+
+// ReportingConfig holds the defaults of the performance report risk metrics
+type ReportingConfig struct {
+	// Annual risk-free rate in percent for the Sharpe and Sortino ratios
+	RiskFreeRate float64 `mapstructure:"risk_free_rate"`
+	// Ticker to compute beta and correlation against, or MARKET for the
+	// equal-weighted return of every ticker
+	Benchmark string `mapstructure:"benchmark"`
+}
+
 // LoadConfig reads configuration from a config file
 func LoadConfig(path string) (*Config, error) {
 	viper.AddConfigPath(path)